@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// adminUsage справка по shortener admin
+const adminUsage = `Использование: shortener admin <команда> [флаги]
+
+Команды:
+  backup  --from <хранилище> --out <файл>      снимок хранилища в jsonl
+  restore --in <файл> --to <хранилище>         загрузка снимка в хранилище
+  migrate --from <хранилище> --to <хранилище>  перенос ссылок между хранилищами
+  verify  --from <хранилище> --to <хранилище>  сверка двух хранилищ
+
+Хранилище:
+  file              файл из FILE_STORAGE_PATH
+  file:<путь>       файл по пути
+  postgres          бд из DATABASE_DSN
+  postgres://...    бд по строке подключения
+  sqlite://<путь>   встроенная бд
+  backup:<путь>     снимок, сделанный backup
+
+Общие флаги:
+  -c <путь>         конфиг
+  --dry-run         только прочитать источник, ничего не записывать
+  --batch <n>       размер пачки записи
+  --progress <n>    печатать прогресс каждые n ссылок
+`
+
+// maxVerifyDiffs сколько расхождений verify печатает
+const maxVerifyDiffs = 20
+
+// urlSource хранилище, из которого читаем ссылки
+type urlSource interface {
+	Export(ctx context.Context, uuid string, fn func(url *types.URL) error) error
+	Close() error
+}
+
+// urlSink хранилище, в которое пишем ссылки. Существующие хеши пропускаются
+type urlSink interface {
+	Import(ctx context.Context, urls []*types.URL) (created int, err error)
+	Close() error
+}
+
+// adminOptions флаги команды
+type adminOptions struct {
+	cfg      types.Config
+	from     string
+	to       string
+	dryRun   bool
+	batch    int
+	progress int
+	out      io.Writer
+}
+
+// copyStats итог переноса ссылок
+type copyStats struct {
+	Read      int
+	Created   int
+	Conflicts int
+}
+
+// runAdmin выполняет команду shortener admin. Вывод - в out
+func runAdmin(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(out, adminUsage)
+		return errors.New("не указана команда")
+	}
+
+	command := args[0]
+	opts := adminOptions{out: out}
+
+	fs := flag.NewFlagSet("admin "+command, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	var configPath string
+	fs.StringVar(&configPath, "c", "", "Путь к конфигу")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Только прочитать источник, ничего не записывать")
+	fs.IntVar(&opts.batch, "batch", 1000, "Размер пачки записи")
+	fs.IntVar(&opts.progress, "progress", 10000, "Печатать прогресс каждые n ссылок, 0 - не печатать")
+
+	switch command {
+	case "backup":
+		fs.StringVar(&opts.from, "from", "file", "Хранилище-источник")
+		var path string
+		fs.StringVar(&path, "out", "", "Файл снимка")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if path == "" {
+			return errors.New("не указан --out")
+		}
+		opts.to = "backup:" + path
+	case "restore":
+		fs.StringVar(&opts.to, "to", "", "Хранилище-приемник")
+		var path string
+		fs.StringVar(&path, "in", "", "Файл снимка")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if path == "" {
+			return errors.New("не указан --in")
+		}
+		opts.from = "backup:" + path
+	case "migrate", "verify":
+		fs.StringVar(&opts.from, "from", "", "Хранилище-источник")
+		fs.StringVar(&opts.to, "to", "", "Хранилище-приемник")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprint(out, adminUsage)
+		return fmt.Errorf("неизвестная команда %q", command)
+	}
+
+	if opts.from == "" || opts.to == "" {
+		return errors.New("не указаны --from и --to")
+	}
+	if opts.from == opts.to {
+		return errors.New("источник и приемник совпадают")
+	}
+
+	if configPath != "" {
+		if err := LoadConfig(&opts.cfg, configPath); err != nil {
+			return err
+		}
+	}
+	if err := env.Parse(&opts.cfg); err != nil {
+		return err
+	}
+
+	if command == "verify" {
+		return verify(ctx, opts)
+	}
+
+	return migrate(ctx, opts)
+}
+
+// migrate переносит ссылки из opts.from в opts.to
+func migrate(ctx context.Context, opts adminOptions) error {
+	src, err := openSource(ctx, opts.cfg, opts.from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// в холостом режиме приемник не открываем: открытие бд создает таблицы, а файла - сам файл
+	var dst urlSink
+	if !opts.dryRun {
+		dst, err = openSink(ctx, opts.cfg, opts.to)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+	}
+
+	started := time.Now()
+	stats, err := copyURLs(ctx, src, dst, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.dryRun {
+		fmt.Fprintf(opts.out, "Холостой прогон: из %s в %s будет перенесено до %d ссылок\n", opts.from, opts.to, stats.Read)
+		return nil
+	}
+
+	fmt.Fprintf(opts.out, "Готово за %s: прочитано %d, записано %d, уже были %d\n",
+		time.Since(started).Round(time.Millisecond), stats.Read, stats.Created, stats.Conflicts)
+
+	return nil
+}
+
+// copyURLs читает src и пишет в dst пачками. dst nil - холостой прогон
+func copyURLs(ctx context.Context, src urlSource, dst urlSink, opts adminOptions) (stats copyStats, err error) {
+	size := opts.batch
+	if size <= 0 {
+		size = 1000
+	}
+
+	batch := make([]*types.URL, 0, size)
+	flush := func() error {
+		if len(batch) == 0 || dst == nil {
+			batch = batch[:0]
+			return nil
+		}
+
+		created, importErr := dst.Import(ctx, batch)
+		if importErr != nil {
+			return importErr
+		}
+
+		stats.Created += created
+		stats.Conflicts += len(batch) - created
+		batch = batch[:0]
+
+		return nil
+	}
+
+	err = src.Export(ctx, "", func(url *types.URL) error {
+		stats.Read++
+		batch = append(batch, url)
+
+		if len(batch) >= size {
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+		}
+
+		if opts.progress > 0 && stats.Read%opts.progress == 0 {
+			fmt.Fprintf(opts.out, "прочитано %d, записано %d, уже были %d\n", stats.Read, stats.Created, stats.Conflicts)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	err = flush()
+
+	return stats, err
+}
+
+// urlState то, что должно совпасть у ссылки в двух хранилищах
+type urlState struct {
+	UUID    string
+	URL     string
+	Deleted bool
+}
+
+func newURLState(url *types.URL) urlState {
+	return urlState{UUID: url.UUID, URL: url.URL, Deleted: url.DeletedAt.Valid}
+}
+
+// verify сверяет хеши, владельцев, урлы и удаление в opts.from и opts.to.
+// Приемник целиком читается в память, источник - потоком
+func verify(ctx context.Context, opts adminOptions) error {
+	src, err := openSource(ctx, opts.cfg, opts.from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := openSource(ctx, opts.cfg, opts.to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	expected := map[string]urlState{}
+	err = dst.Export(ctx, "", func(url *types.URL) error {
+		if _, ok := expected[url.Hash]; !ok {
+			expected[url.Hash] = newURLState(url)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var read, missing, mismatched int
+	diffs := 0
+	report := func(format string, args ...interface{}) {
+		if diffs < maxVerifyDiffs {
+			fmt.Fprintf(opts.out, format+"\n", args...)
+		}
+		diffs++
+	}
+
+	seen := map[string]bool{}
+	err = src.Export(ctx, "", func(url *types.URL) error {
+		if seen[url.Hash] {
+			return nil
+		}
+		seen[url.Hash] = true
+		read++
+
+		state, ok := expected[url.Hash]
+		switch {
+		case !ok:
+			missing++
+			report("%s: нет в %s", url.Hash, opts.to)
+		case state != newURLState(url):
+			mismatched++
+			report("%s: %+v в %s, %+v в %s", url.Hash, newURLState(url), opts.from, state, opts.to)
+		}
+
+		if opts.progress > 0 && read%opts.progress == 0 {
+			fmt.Fprintf(opts.out, "сверено %d\n", read)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	extra := 0
+	for hash := range expected {
+		if !seen[hash] {
+			extra++
+			report("%s: нет в %s", hash, opts.from)
+		}
+	}
+
+	fmt.Fprintf(opts.out, "Сверено %d: нет в приемнике %d, различаются %d, лишние в приемнике %d\n",
+		read, missing, mismatched, extra)
+
+	if missing+mismatched+extra > 0 {
+		return errors.New("хранилища расходятся")
+	}
+
+	return nil
+}
+
+// openSource открывает хранилище для чтения. Несуществующий файл - ошибка
+func openSource(ctx context.Context, cfg types.Config, spec string) (urlSource, error) {
+	if path, ok := backupPath(spec); ok {
+		return openBackup(path, false)
+	}
+
+	if path, ok := filePath(cfg, spec); ok {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return storage.NewFileRepository(path)
+	}
+
+	return openDB(ctx, cfg, spec)
+}
+
+// openSink открывает хранилище для записи. Снимок перезаписывается
+func openSink(ctx context.Context, cfg types.Config, spec string) (urlSink, error) {
+	if path, ok := backupPath(spec); ok {
+		return openBackup(path, true)
+	}
+
+	if path, ok := filePath(cfg, spec); ok {
+		return storage.NewFileRepository(path)
+	}
+
+	return openDB(ctx, cfg, spec)
+}
+
+func backupPath(spec string) (string, bool) {
+	if strings.HasPrefix(spec, "backup:") {
+		return strings.TrimPrefix(spec, "backup:"), true
+	}
+
+	return "", false
+}
+
+func filePath(cfg types.Config, spec string) (string, bool) {
+	if spec == "file" {
+		return cfg.DBPath, true
+	}
+	if strings.HasPrefix(spec, "file:") {
+		return strings.TrimPrefix(spec, "file:"), true
+	}
+
+	return "", false
+}
+
+// openDB подключается к бд и проверяет соединение
+func openDB(ctx context.Context, cfg types.Config, spec string) (*storage.DBRepository, error) {
+	dsn := spec
+	if spec == "postgres" || spec == "db" {
+		dsn = cfg.DatabaseDsn
+	}
+
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") && !strings.HasPrefix(dsn, "sqlite://") {
+		return nil, fmt.Errorf("неизвестное хранилище %q", spec)
+	}
+
+	cfg.DatabaseDsn = dsn
+	cfg.DatabaseReplicaDsns = nil
+
+	repo := storage.NewDBRepository(&cfg)
+	if repo.DB == nil {
+		return nil, fmt.Errorf("не удалось подключиться к %s", spec)
+	}
+
+	if err := repo.Ping(ctx); err != nil {
+		repo.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// backupRecord ссылка в снимке
+type backupRecord struct {
+	Hash       string     `json:"hash"`
+	UUID       string     `json:"uuid"`
+	URL        string     `json:"url"`
+	ShortURL   string     `json:"short_url"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ActiveFrom *time.Time `json:"active_from,omitempty"`
+	Clicks     int64      `json:"clicks,omitempty"`
+	Title      string     `json:"title,omitempty"`
+	Notes      string     `json:"notes,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	// PasswordHash хеш пароля, сам пароль нигде не хранится
+	PasswordHash string `json:"password_hash,omitempty"`
+	MaxClicks    int64  `json:"max_clicks,omitempty"`
+	// RedirectCode и QueryPassthrough как ведет переход
+	RedirectCode     int    `json:"redirect_code,omitempty"`
+	QueryPassthrough string `json:"query_passthrough,omitempty"`
+}
+
+// backupFile снимок хранилища: ссылка на строку jsonl
+type backupFile struct {
+	file    *os.File
+	encoder *json.Encoder
+	// written хеши, уже записанные в снимок
+	written map[string]bool
+}
+
+// openBackup открывает снимок на чтение или создает новый
+func openBackup(path string, create bool) (*backupFile, error) {
+	if !create {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &backupFile{file: file}, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backupFile{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		written: map[string]bool{},
+	}, nil
+}
+
+func (b *backupFile) Export(ctx context.Context, uuid string, fn func(url *types.URL) error) error {
+	decoder := json.NewDecoder(b.file)
+
+	for line := 1; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		record := backupRecord{}
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("снимок, запись %d: %w", line, err)
+		}
+
+		if uuid != "" && record.UUID != uuid {
+			continue
+		}
+
+		url := &types.URL{
+			Hash:             record.Hash,
+			UUID:             record.UUID,
+			URL:              record.URL,
+			ShortURL:         record.ShortURL,
+			Clicks:           record.Clicks,
+			Title:            record.Title,
+			Notes:            record.Notes,
+			Tags:             record.Tags,
+			PasswordHash:     record.PasswordHash,
+			MaxClicks:        record.MaxClicks,
+			RedirectCode:     record.RedirectCode,
+			QueryPassthrough: record.QueryPassthrough,
+		}
+		if record.CreatedAt != nil {
+			url.CreatedAt.Time, url.CreatedAt.Valid = *record.CreatedAt, true
+		}
+		if record.UpdatedAt != nil {
+			url.UpdatedAt.Time, url.UpdatedAt.Valid = *record.UpdatedAt, true
+		}
+		if record.DeletedAt != nil {
+			url.DeletedAt.Time, url.DeletedAt.Valid = *record.DeletedAt, true
+		}
+		if record.ExpiresAt != nil {
+			url.ExpiresAt.Time, url.ExpiresAt.Valid = *record.ExpiresAt, true
+		}
+		if record.ActiveFrom != nil {
+			url.ActiveFrom.Time, url.ActiveFrom.Valid = *record.ActiveFrom, true
+		}
+
+		if err = fn(url); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *backupFile) Import(ctx context.Context, urls []*types.URL) (created int, err error) {
+	for _, url := range urls {
+		if b.written[url.Hash] {
+			continue
+		}
+
+		record := backupRecord{
+			Hash:             url.Hash,
+			UUID:             url.UUID,
+			URL:              url.URL,
+			ShortURL:         url.ShortURL,
+			Clicks:           url.Clicks,
+			Title:            url.Title,
+			Notes:            url.Notes,
+			Tags:             url.Tags,
+			PasswordHash:     url.PasswordHash,
+			MaxClicks:        url.MaxClicks,
+			RedirectCode:     url.RedirectCode,
+			QueryPassthrough: url.QueryPassthrough,
+		}
+		if url.CreatedAt.Valid {
+			createdAt := url.CreatedAt.Time.UTC()
+			record.CreatedAt = &createdAt
+		}
+		if url.UpdatedAt.Valid {
+			updatedAt := url.UpdatedAt.Time.UTC()
+			record.UpdatedAt = &updatedAt
+		}
+		if url.DeletedAt.Valid {
+			deletedAt := url.DeletedAt.Time.UTC()
+			record.DeletedAt = &deletedAt
+		}
+		if url.ExpiresAt.Valid {
+			expiresAt := url.ExpiresAt.Time.UTC()
+			record.ExpiresAt = &expiresAt
+		}
+		if url.ActiveFrom.Valid {
+			activeFrom := url.ActiveFrom.Time.UTC()
+			record.ActiveFrom = &activeFrom
+		}
+
+		if err = b.encoder.Encode(record); err != nil {
+			return created, err
+		}
+		b.written[url.Hash] = true
+		created++
+	}
+
+	return created, nil
+}
+
+func (b *backupFile) Close() error {
+	if b.encoder != nil {
+		if err := b.file.Sync(); err != nil {
+			b.file.Close()
+			return err
+		}
+	}
+
+	return b.file.Close()
+}
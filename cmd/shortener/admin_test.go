@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdmin перенос файл -> sqlite, снимок, восстановление и сверка
+func TestAdmin(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	src := filepath.Join(dir, "db")
+	repo, err := storage.NewFileRepository(src)
+	require.NoError(t, err)
+
+	createdAt := sql.NullTime{Time: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC), Valid: true}
+	for _, url := range []*types.URL{
+		{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1", CreatedAt: createdAt},
+		{UUID: "user-1", Hash: "hash-2", URL: "http://yandex.ru?x=2", DeletedAt: sql.NullTime{Time: time.Date(2022, 5, 2, 0, 0, 0, 0, time.UTC), Valid: true}},
+		{UUID: "user-2", Hash: "hash-3", URL: "http://yandex.ru?x=3"},
+	} {
+		require.NoError(t, repo.Save(ctx, url))
+	}
+	require.NoError(t, repo.Close())
+
+	admin := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := runAdmin(ctx, args, out)
+		return out.String(), err
+	}
+
+	fileSpec := "file:" + src
+	dbSpec := "sqlite://" + filepath.Join(dir, "shortener.db")
+	backup := filepath.Join(dir, "backup.jsonl")
+	restored := "file:" + filepath.Join(dir, "restored")
+
+	// холостой прогон ничего не создает
+	out, err := admin("migrate", "--from", fileSpec, "--to", restored, "--dry-run")
+	require.NoError(t, err)
+	assert.Contains(t, out, "до 3 ссылок")
+	_, err = os.Stat(filepath.Join(dir, "restored"))
+	assert.True(t, os.IsNotExist(err))
+
+	out, err = admin("migrate", "--from", fileSpec, "--to", dbSpec, "--batch", "2")
+	require.NoError(t, err)
+	assert.Contains(t, out, "записано 3, уже были 0")
+
+	// повторный перенос ничего не дублирует
+	out, err = admin("migrate", "--from", fileSpec, "--to", dbSpec)
+	require.NoError(t, err)
+	assert.Contains(t, out, "записано 0, уже были 3")
+
+	_, err = admin("verify", "--from", fileSpec, "--to", dbSpec)
+	require.NoError(t, err)
+
+	_, err = admin("backup", "--from", dbSpec, "--out", backup)
+	require.NoError(t, err)
+
+	_, err = admin("restore", "--in", backup, "--to", restored)
+	require.NoError(t, err)
+
+	_, err = admin("verify", "--from", fileSpec, "--to", restored)
+	require.NoError(t, err)
+
+	// в источнике появилась ссылка, которой нет в приемнике
+	repo, err = storage.NewFileRepository(src)
+	require.NoError(t, err)
+	require.NoError(t, repo.Save(ctx, &types.URL{UUID: "user-2", Hash: "hash-4", URL: "http://yandex.ru?x=4"}))
+	require.NoError(t, repo.Close())
+
+	out, err = admin("verify", "--from", fileSpec, "--to", restored)
+	require.Error(t, err)
+	assert.Contains(t, out, "hash-4: нет в "+restored)
+
+	_, err = admin("export")
+	require.Error(t, err)
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
@@ -35,7 +36,15 @@ import (
 )
 
 func main() {
-	r := Router()
+	// Служебные команды: бэкап, восстановление, перенос и сверка хранилищ
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	srv := http.Server{}
 
 	// Логер
@@ -70,9 +79,20 @@ func main() {
 	flag.StringVar(&app.Cfg.ServerPort, "server-port", app.Cfg.ServerPort, "Порт сервера")
 	flag.StringVar(&app.Cfg.BaseURL, "b", app.Cfg.BaseURL, "Базовый адрес результирующего сокращённого URL")
 	flag.StringVar(&app.Cfg.DBPath, "f", app.Cfg.DBPath, "Путь к файлу с ссылками")
-	flag.StringVar(&app.Cfg.DatabaseDsn, "d", app.Cfg.DatabaseDsn, "Строка с адресом подключения к БД")
+	flag.StringVar(&app.Cfg.DatabaseDsn, "d", app.Cfg.DatabaseDsn, "Строка с адресом подключения к БД (postgres://... или sqlite:///path/db)")
+	flag.StringVar(&app.Cfg.TrustedSubnet, "t", app.Cfg.TrustedSubnet, "Подсети CIDR, которым открыты служебные эндпоинты")
 	flag.Parse()
 
+	if !types.ValidOwnershipMode(app.Cfg.OwnershipMode) {
+		log.Fatalf("Неизвестный режим владения ссылками %q", app.Cfg.OwnershipMode)
+	}
+	if _, err = middlewares.ParseSubnets(app.Cfg.TrustedSubnet); err != nil {
+		log.Fatalf("TRUSTED_SUBNET. %s", err)
+	}
+	if _, err = middlewares.ParseSubnets(app.Cfg.TrustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES. %s", err)
+	}
+
 	log.Printf("Starting server on %s", app.Cfg.ServerAddress)
 	log.Println(app.Cfg)
 
@@ -130,11 +150,14 @@ func main() {
 	keyFile.Close()
 
 	// инициируем хранилище
-	err = storage.New(&app.Cfg)
+	st, err := storage.NewStorage(&app.Cfg)
 	if err != nil {
 		log.Printf("Не удалось инициировать хранилище. %s", err)
 		return
 	}
+	storage.Storage = st
+
+	svc := handlers.NewService(&app.Cfg, st)
 
 	// через этот канал сообщим основному потоку, что соединения закрыты
 	idleConnsClosed := make(chan struct{})
@@ -174,7 +197,7 @@ func main() {
 		s := grpc.NewServer()
 
 		// регистрируем сервис
-		proto.RegisterUrlsServer(s, &server.ShortenerServer{})
+		proto.RegisterUrlsServer(s, server.NewShortenerServer(svc))
 		if err := s.Serve(listen); err != nil {
 			log.Fatal(err)
 			return
@@ -184,7 +207,7 @@ func main() {
 
 	// запускаем сервер
 	srv.Addr = app.Cfg.ServerAddress
-	srv.Handler = r
+	srv.Handler = Router(&app.Cfg, svc)
 	if err := srv.ListenAndServeTLS("./cert", "./key"); err != http.ErrServerClosed {
 		// ошибки старта или остановки Listener
 		log.Fatalf("HTTP server ListenAndServe: %v", err)
@@ -199,28 +222,60 @@ func main() {
 	// здесь можно освобождать ресурсы перед выходом,
 	// например закрыть соединение с базой данных,
 	// закрыть открытые файлы
+	if err := st.Close(); err != nil {
+		log.Printf("Storage Close: %v", err)
+	}
 	log.Fatalf("Server Shutdown gracefully")
 }
 
-func Router() (r *chi.Mux) {
+// Router маршруты http сервера поверх сервиса svc
+func Router(cfg *types.Config, svc *handlers.Service) (r *chi.Mux) {
+	// подсети проверены при запуске. Не разобрались - служебные
+	// эндпоинты закрыты, заголовкам прокси не верим
+	trustedSubnet, _ := middlewares.ParseSubnets(cfg.TrustedSubnet)
+	trustedProxies, _ := middlewares.ParseSubnets(cfg.TrustedProxies)
+
 	r = chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(middlewares.RealIP(trustedProxies))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Compress(5))
+	// к типам по умолчанию добавлены форматы выгрузки
+	r.Use(middleware.Compress(5, "text/html", "text/css", "text/plain", "text/javascript",
+		"application/javascript", "application/x-javascript", "application/json",
+		"application/atom+xml", "application/rss+xml", "image/svg+xml",
+		"text/csv", "application/x-ndjson"))
 	r.Use(middlewares.Decompress)
 	r.Use(middlewares.UserCookie)
 
-	r.Post("/", handlers.CreateShortURLHTTPHandler)
-	r.Get("/ping", handlers.PingHTTPHandler)
-	r.Get("/api/user/urls", handlers.GetUserURLSHTTPHandler)
-	r.Delete("/api/user/urls", handlers.APIDeleteShortURLBatchHTTPHandler)
-	r.Post("/api/shorten/batch", handlers.APICreateShortURLBatchHTTPHandler)
-	r.Post("/api/shorten", handlers.APICreateShortURLHTTPHandler)
-	r.Get("/{hash}", handlers.GetShortURLHTTPHandler)
-	r.Get("/api/internal/stats", handlers.APIStatsHTTPHandler)
+	r.Post("/", svc.CreateShortURLHTTPHandler)
+	r.Get("/ping", svc.PingHTTPHandler)
+	r.Get("/api/user/urls", svc.GetUserURLSHTTPHandler)
+	r.Get("/api/user/urls/export", svc.GetUserURLSExportHTTPHandler)
+	r.Post("/api/user/urls/restore", svc.RestoreUserURLSHTTPHandler)
+	r.Patch("/api/user/urls/{hash}", svc.UpdateUserURLHTTPHandler)
+	r.Get("/api/user/urls/{hash}/history", svc.UserURLHistoryHTTPHandler)
+	r.Get("/api/user/utm-templates", svc.UTMTemplatesHTTPHandler)
+	r.Put("/api/user/utm-templates/{name}", svc.SaveUTMTemplateHTTPHandler)
+	r.Delete("/api/user/utm-templates/{name}", svc.DeleteUTMTemplateHTTPHandler)
+	r.Delete("/api/user/urls", svc.APIDeleteShortURLBatchHTTPHandler)
+	r.Post("/api/shorten/batch", svc.APICreateShortURLBatchHTTPHandler)
+	r.Post("/api/shorten/import", svc.APIImportHTTPHandler)
+	r.Post("/api/shorten", svc.APICreateShortURLHTTPHandler)
+	r.Get("/api/preview/{hash}", svc.APIPreviewHTTPHandler)
+	r.Get("/{hash}", svc.GetShortURLHTTPHandler)
+	r.Post("/{hash}", svc.UnlockShortURLHTTPHandler)
+	r.Get("/{hash}+", svc.PreviewHTTPHandler)
+	r.Get("/{hash}/qr", svc.QRCodeHTTPHandler)
+	r.Get("/api/internal/stats", svc.APIStatsHTTPHandler)
+	r.Group(func(r chi.Router) {
+		// выгрузка всех ссылок и починка хранилищ - только из доверенной подсети
+		r.Use(middlewares.TrustedSubnet(trustedSubnet))
+		r.Get("/api/internal/export", svc.APIExportHTTPHandler)
+		r.Get("/api/internal/consistency", svc.ConsistencyHTTPHandler)
+		r.Post("/api/internal/consistency", svc.ConsistencyHTTPHandler)
+	})
 
 	// эндпоинты для профилировщика
 	r.Get("/debug/pprof/", pprof.Index)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"compress/gzip"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/app"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/handlers"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 
@@ -28,12 +30,13 @@ func setup() {
 		ServerPort:    "8080",
 		ServerAddress: "localhost:8080",
 		DBPath:        "./db_test",
+		TrustedSubnet: "127.0.0.0/8",
 	}
 
 	storage.New(&app.Cfg)
 
 	S = suite{
-		Server: httptest.NewServer(Router()),
+		Server: httptest.NewServer(Router(&app.Cfg, handlers.NewService(&app.Cfg, storage.Storage))),
 	}
 }
 
@@ -73,6 +76,24 @@ func TestPostUrl(t *testing.T) {
 				statusCode: http.StatusTemporaryRedirect,
 			},
 		},
+		{
+			name:   "Предпросмотр ссылки",
+			url:    "/580c5ab5ef6a4f27b3da9956ae192f4f+",
+			method: http.MethodGet,
+			body:   nil,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:   "Предпросмотр ссылки в json",
+			url:    "/api/preview/580c5ab5ef6a4f27b3da9956ae192f4f",
+			method: http.MethodGet,
+			body:   nil,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
 		{
 			name:   "Все ссылки пользователя",
 			url:    "/api/user/urls",
@@ -121,6 +142,61 @@ func TestPostUrl(t *testing.T) {
 	}
 }
 
+// TestExportGzip выгрузка сжимается, если клиент принимает gzip
+func TestExportGzip(t *testing.T) {
+	setup()
+	defer S.Server.Close()
+	defer storage.Storage.Drop()
+
+	response, _ := testRequest(t, http.MethodPost, "/", strings.NewReader("http://yandex.ru?x=1"))
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, S.Server.URL+"/api/internal/export?format=jsonl", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"original_url":"http://yandex.ru?x=1"`)
+}
+
+// TestInternalTrustedSubnet служебные эндпоинты закрыты вне доверенной
+// подсети, и X-Real-IP этого не меняет
+func TestInternalTrustedSubnet(t *testing.T) {
+	setup()
+	defer S.Server.Close()
+	defer storage.Storage.Drop()
+
+	S.Server.Config.Handler = Router(&types.Config{TrustedSubnet: "10.0.0.0/8"}, handlers.NewService(&app.Cfg, storage.Storage))
+
+	for _, path := range []string{"/api/internal/export", "/api/internal/consistency"} {
+		req, err := http.NewRequest(http.MethodGet, S.Server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, path)
+	}
+
+	response, _ := testRequest(t, http.MethodPost, "/api/internal/consistency?source=file", nil)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+}
+
 func BenchmarkPostUrl(b *testing.B) {
 	setup()
 
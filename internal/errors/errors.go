@@ -9,3 +9,27 @@ var ErrURLNotFound = errors.New(`url не существует`)
 var ErrURLDeleted = errors.New(`url удален`)
 
 var ErrNoDBConnection = errors.New(`нет подключения к бд`)
+
+var ErrCircuitOpen = errors.New(`бд временно недоступна`)
+
+var ErrPendingWrites = errors.New(`есть отложенные записи в бд, повторите позже`)
+
+var ErrURLExpired = errors.New(`срок действия url истек`)
+
+var ErrInvalidCursor = errors.New(`некорректный курсор`)
+
+var ErrInvalidLink = errors.New(`некорректные параметры ссылки`)
+
+var ErrURLForbidden = errors.New(`url принадлежит другому пользователю`)
+
+var ErrPasswordRequired = errors.New(`url защищен паролем`)
+
+var ErrWrongPassword = errors.New(`неверный пароль`)
+
+var ErrTooManyAttempts = errors.New(`слишком много попыток ввода пароля`)
+
+var ErrURLExhausted = errors.New(`переходы по url закончились`)
+
+var ErrURLNotActive = errors.New(`url еще не действует`)
+
+var ErrTemplateNotFound = errors.New(`шаблон utm не найден`)
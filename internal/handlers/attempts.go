@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// attemptLimiter ограничивает подбор паролей. Неверные попытки считаются
+// по ключу в окне window с первой ошибки, после max ошибок ключ
+// блокируется до конца окна
+type attemptLimiter struct {
+	mx      sync.Mutex
+	max     int
+	window  time.Duration
+	entries map[string]*attemptWindow
+	swept   time.Time
+}
+
+// attemptWindow ошибки ключа в текущем окне
+type attemptWindow struct {
+	failures int
+	until    time.Time
+}
+
+// newAttemptLimiter max <= 0 - без ограничения
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:     max,
+		window:  window,
+		entries: map[string]*attemptWindow{},
+	}
+}
+
+// Allow можно ли ключу key пробовать пароль. Если нельзя - через сколько
+func (l *attemptLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l.max <= 0 {
+		return true, 0
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok || !now.Before(entry.until) || entry.failures < l.max {
+		return true, 0
+	}
+
+	return false, entry.until.Sub(now)
+}
+
+// Fail засчитывает ключу key неверную попытку
+func (l *attemptLimiter) Fail(key string, now time.Time) {
+	if l.max <= 0 {
+		return
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.sweep(now)
+
+	entry, ok := l.entries[key]
+	if !ok || !now.Before(entry.until) {
+		entry = &attemptWindow{until: now.Add(l.window)}
+		l.entries[key] = entry
+	}
+	entry.failures++
+}
+
+// Reset забывает ошибки ключа key после верного пароля
+func (l *attemptLimiter) Reset(key string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	delete(l.entries, key)
+}
+
+// sweep раз в окно выбрасывает закончившиеся окна, чтобы карта не росла
+func (l *attemptLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+
+	for key, entry := range l.entries {
+		if !now.Before(entry.until) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/app"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// Обработчики уровня пакета работают поверх глобальных app.Cfg и storage.Storage.
+// Оставлены для совместимости, новый код использует Service.
+
+// Default сервис на глобальных app.Cfg и storage.Storage
+func Default() *Service {
+	return NewService(&app.Cfg, storage.Storage)
+}
+
+// CreateShortURLHandler — создает короткий урл.
+//
+// Deprecated: используйте Service.CreateShortURLHandler
+func CreateShortURLHandler(ctx context.Context, originalURL string, uuid string) (*types.URL, error) {
+	return Default().CreateShortURLHandler(ctx, originalURL, uuid)
+}
+
+// GetShortURLHandler — возвращает полный урл по короткому.
+//
+// Deprecated: используйте Service.GetShortURLHandler
+func GetShortURLHandler(ctx context.Context, hash string) (*types.URL, error) {
+	return Default().GetShortURLHandler(ctx, hash)
+}
+
+// APICreateShortURLHandler Api для создания короткого урла
+//
+// Deprecated: используйте Service.APICreateShortURLHandler
+func APICreateShortURLHandler(ctx context.Context, originalURL string, uuid string) (*types.URL, error) {
+	return Default().APICreateShortURLHandler(ctx, originalURL, uuid)
+}
+
+// APICreateShortURLBatchHandler Api для создания коротких урлов пачками
+//
+// Deprecated: используйте Service.APICreateShortURLBatchHandler
+func APICreateShortURLBatchHandler(ctx context.Context, urls []*types.URL) ([]*types.URL, error) {
+	return Default().APICreateShortURLBatchHandler(ctx, urls)
+}
+
+// APIDeleteShortURLBatchHandler удаляет урлы пользователя uuid из базы
+// по идентификаторам
+//
+// Deprecated: используйте Service.APIDeleteShortURLBatchHandler
+func APIDeleteShortURLBatchHandler(uuid string, hashes []string) {
+	Default().APIDeleteShortURLBatchHandler(uuid, hashes)
+}
+
+// APIStatsHandler статистика по урлам
+//
+// Deprecated: используйте Service.APIStatsHandler
+func APIStatsHandler(ctx context.Context) types.Statistic {
+	return Default().APIStatsHandler(ctx)
+}
+
+// GetUserURLSHandler — возвращает все сокращенные урлы пользователя.
+//
+// Deprecated: используйте Service.GetUserURLSHandler
+func GetUserURLSHandler(ctx context.Context, uuid string) (map[string]*types.URL, error) {
+	return Default().GetUserURLSHandler(ctx, uuid)
+}
+
+// PingHandler проверяет соединение с базой
+//
+// Deprecated: используйте Service.PingHandler
+func PingHandler(ctx context.Context) error {
+	return Default().PingHandler(ctx)
+}
+
+// CreateShortURLHTTPHandler — создает короткий урл.
+//
+// Deprecated: используйте Service.CreateShortURLHTTPHandler
+func CreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().CreateShortURLHTTPHandler(w, r)
+}
+
+// GetShortURLHTTPHandler — возвращает полный урл по короткому.
+//
+// Deprecated: используйте Service.GetShortURLHTTPHandler
+func GetShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().GetShortURLHTTPHandler(w, r)
+}
+
+// APICreateShortURLHTTPHandler Api для создания короткого урла
+//
+// Deprecated: используйте Service.APICreateShortURLHTTPHandler
+func APICreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().APICreateShortURLHTTPHandler(w, r)
+}
+
+// APICreateShortURLBatchHTTPHandler Api для создания коротких урлов пачками
+//
+// Deprecated: используйте Service.APICreateShortURLBatchHTTPHandler
+func APICreateShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().APICreateShortURLBatchHTTPHandler(w, r)
+}
+
+// APIDeleteShortURLBatchHTTPHandler удаляет урлы из базы по идентификаторам
+//
+// Deprecated: используйте Service.APIDeleteShortURLBatchHTTPHandler
+func APIDeleteShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().APIDeleteShortURLBatchHTTPHandler(w, r)
+}
+
+// APIStatsHTTPHandler статистика по урлам
+//
+// Deprecated: используйте Service.APIStatsHTTPHandler
+func APIStatsHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().APIStatsHTTPHandler(w, r)
+}
+
+// GetUserURLSHTTPHandler — возвращает все сокращенные урлы пользователя.
+//
+// Deprecated: используйте Service.GetUserURLSHTTPHandler
+func GetUserURLSHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().GetUserURLSHTTPHandler(w, r)
+}
+
+// PingHTTPHandler проверяет соединение с базой
+//
+// Deprecated: используйте Service.PingHTTPHandler
+func PingHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	Default().PingHTTPHandler(w, r)
+}
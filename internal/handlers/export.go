@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// Форматы выгрузки
+const (
+	ExportFormatCSV   = "csv"
+	ExportFormatJSONL = "jsonl"
+)
+
+// exportURL ссылка в выгрузке
+type exportURL struct {
+	Hash        string `json:"hash"`
+	OriginalURL string `json:"original_url"`
+	ShortURL    string `json:"short_url"`
+	UUID        string `json:"uuid"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	DeletedAt   string `json:"deleted_at,omitempty"`
+}
+
+// exportHeader заголовок csv, в порядке полей exportURL
+var exportHeader = []string{"hash", "original_url", "short_url", "uuid", "created_at", "deleted_at"}
+
+func newExportURL(url *types.URL) exportURL {
+	item := exportURL{
+		Hash:        url.Hash,
+		OriginalURL: url.URL,
+		ShortURL:    url.ShortURL,
+		UUID:        url.UUID,
+	}
+
+	if url.CreatedAt.Valid {
+		item.CreatedAt = url.CreatedAt.Time.UTC().Format(time.RFC3339)
+	}
+	if url.DeletedAt.Valid {
+		item.DeletedAt = url.DeletedAt.Time.UTC().Format(time.RFC3339)
+	}
+
+	return item
+}
+
+// exportWriter пишет ссылки в выгрузку по одной
+type exportWriter interface {
+	Write(url *types.URL) error
+	// Flush дописывает буфер. Вызывается в конце выгрузки
+	Flush() error
+}
+
+// ExportContentType Content-Type выгрузки в формате format
+func ExportContentType(format string) (string, error) {
+	switch format {
+	case ExportFormatCSV:
+		return "text/csv; charset=utf-8", nil
+	case ExportFormatJSONL:
+		return "application/x-ndjson", nil
+	}
+
+	return "", fmt.Errorf("неизвестный формат выгрузки %q", format)
+}
+
+// newExportWriter писатель для формата format
+func newExportWriter(w io.Writer, format string) (exportWriter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return &csvExportWriter{writer: csv.NewWriter(w)}, nil
+	case ExportFormatJSONL:
+		return &jsonlExportWriter{encoder: json.NewEncoder(w)}, nil
+	}
+
+	return nil, fmt.Errorf("неизвестный формат выгрузки %q", format)
+}
+
+// csvExportWriter csv с заголовком в первой строке
+type csvExportWriter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+func (w *csvExportWriter) Write(url *types.URL) error {
+	if !w.headerWritten {
+		w.headerWritten = true
+		if err := w.writer.Write(exportHeader); err != nil {
+			return err
+		}
+	}
+
+	item := newExportURL(url)
+
+	return w.writer.Write([]string{item.Hash, item.OriginalURL, item.ShortURL, item.UUID, item.CreatedAt, item.DeletedAt})
+}
+
+func (w *csvExportWriter) Flush() error {
+	// пустая выгрузка - только заголовок
+	if !w.headerWritten {
+		w.headerWritten = true
+		if err := w.writer.Write(exportHeader); err != nil {
+			return err
+		}
+	}
+
+	w.writer.Flush()
+
+	return w.writer.Error()
+}
+
+// jsonlExportWriter json объект на строку
+type jsonlExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonlExportWriter) Write(url *types.URL) error {
+	return w.encoder.Encode(newExportURL(url))
+}
+
+func (w *jsonlExportWriter) Flush() error {
+	return nil
+}
@@ -1,19 +1,54 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/nastradamus39/ya_practicum_go_advanced/internal/app"
 	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/utils"
+	"io"
 	"log"
+	"strings"
+	"time"
 )
 
+// Service сервис сокращения ссылок. Конфиг и хранилище передаются явно,
+// поэтому в одном процессе может работать несколько независимых экземпляров.
+type Service struct {
+	cfg     *types.Config
+	storage storage.Store
+	// attempts неверные пароли ссылок по ip и хешу
+	attempts *attemptLimiter
+	// linkAttempts неверные пароли ссылок по хешу со всех ip
+	linkAttempts *attemptLimiter
+}
+
+// NewService конструктор сервиса
+func NewService(cfg *types.Config, st storage.Store) *Service {
+	return &Service{
+		cfg:          cfg,
+		storage:      st,
+		attempts:     newAttemptLimiter(cfg.PasswordMaxAttempts, cfg.PasswordLockout.Duration),
+		linkAttempts: newAttemptLimiter(cfg.PasswordMaxLinkAttempts, cfg.PasswordLockout.Duration),
+	}
+}
+
+// Config конфиг сервиса
+func (s *Service) Config() *types.Config {
+	return s.cfg
+}
+
+// Storage хранилище сервиса
+func (s *Service) Storage() storage.Store {
+	return s.storage
+}
+
 // CreateShortURLHandler — создает короткий урл.
-func CreateShortURLHandler(originalURL string, uuid string) (url *types.URL, err error) {
-	hash, shortURL := utils.GetShortURL(originalURL)
+func (s *Service) CreateShortURLHandler(ctx context.Context, originalURL string, uuid string) (url *types.URL, err error) {
+	hash, shortURL := s.shortURL(originalURL, uuid)
 
 	url = &types.URL{
 		UUID:     uuid,
@@ -22,7 +57,7 @@ func CreateShortURLHandler(originalURL string, uuid string) (url *types.URL, err
 		ShortURL: shortURL,
 	}
 
-	err = storage.Storage.Save(url)
+	err = s.storage.Save(ctx, url)
 
 	// Если такой url уже есть - отдаем соответствующий статус
 	if errors.Is(err, shortenerErrors.ErrURLConflict) {
@@ -39,10 +74,62 @@ func CreateShortURLHandler(originalURL string, uuid string) (url *types.URL, err
 }
 
 // GetShortURLHandler — возвращает полный урл по короткому.
-func GetShortURLHandler(hash string) (url *types.URL, err error) {
-	var exist bool
+// Для ссылок с паролем - ErrPasswordRequired, см. UnlockShortURLHandler
+func (s *Service) GetShortURLHandler(ctx context.Context, hash string) (url *types.URL, err error) {
+	url, err = s.activeURL(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if url.Protected() {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrPasswordRequired)
+	}
+
+	if err = s.click(ctx, url); err != nil {
+		return nil, err
+	}
+
+	return url, nil
+}
+
+// click засчитывает переход по ссылке. Переходы по ссылке с лимитом
+// считаются сразу и атомарно, последний сверх лимита - ErrURLExhausted
+func (s *Service) click(ctx context.Context, url *types.URL) error {
+	if url.MaxClicks <= 0 {
+		s.storage.Click(url.Hash)
+		return nil
+	}
+
+	clicks, err := s.storage.ConsumeClick(ctx, url.Hash)
+	if err != nil {
+		return err
+	}
+	url.Clicks = clicks
+
+	return nil
+}
+
+// PreviewHandler — ссылка для страницы предпросмотра. В отличие от
+// GetShortURLHandler переход не засчитывается. Куда ведет ссылка
+// с паролем, без пароля не показываем - ErrPasswordRequired
+func (s *Service) PreviewHandler(ctx context.Context, hash string) (*types.URL, error) {
+	url, err := s.activeURL(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if url.Protected() {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrPasswordRequired)
+	}
+
+	return url, nil
+}
 
-	exist, url, err = storage.Storage.FindByHash(hash)
+// activeURL ссылка hash, по которой можно перейти. Удаленные, истекшие,
+// еще не начавшие действовать и исчерпавшие лимит переходов ссылки -
+// ErrURLDeleted, ErrURLExpired, ErrURLNotActive и ErrURLExhausted
+func (s *Service) activeURL(ctx context.Context, hash string) (*types.URL, error) {
+	exist, url, err := s.storage.FindByHash(ctx, hash)
 
 	if !exist {
 		return nil, shortenerErrors.ErrURLNotFound
@@ -58,21 +145,66 @@ func GetShortURLHandler(hash string) (url *types.URL, err error) {
 		return nil, shortenerErrors.ErrURLDeleted
 	}
 
+	now := time.Now()
+
+	if url.Expired(now) {
+		return nil, shortenerErrors.ErrURLExpired
+	}
+
+	if url.Pending(now) {
+		return nil, &notActiveError{activeFrom: url.ActiveFrom.Time}
+	}
+
+	if url.Exhausted() {
+		return nil, shortenerErrors.ErrURLExhausted
+	}
+
 	return url, nil
 }
 
 // APICreateShortURLHandler Api для создания короткого урла
-func APICreateShortURLHandler(originalURL string, uuid string) (url *types.URL, err error) {
-	hash, shortURL := utils.GetShortURL(originalURL)
+func (s *Service) APICreateShortURLHandler(ctx context.Context, originalURL string, uuid string) (url *types.URL, err error) {
+	return s.APICreateShortURLWithOptionsHandler(ctx, originalURL, uuid, types.LinkOptions{})
+}
+
+// APICreateShortURLWithOptionsHandler Api для создания короткого урла со сроком
+// действия и описанием. Некорректные параметры - ErrInvalidLink
+func (s *Service) APICreateShortURLWithOptionsHandler(ctx context.Context, originalURL string, uuid string, opts types.LinkOptions) (url *types.URL, err error) {
+	opts, err = normalizeLinkOptions(opts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// хеш считается от урла уже с метками
+	originalURL, err = s.composeUTM(ctx, uuid, originalURL, opts.UTM, opts.UTMTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, shortURL := s.shortURL(originalURL, uuid)
 
 	url = &types.URL{
-		UUID:     uuid,
-		Hash:     hash,
-		URL:      originalURL,
-		ShortURL: shortURL,
+		UUID:             uuid,
+		Hash:             hash,
+		URL:              originalURL,
+		ShortURL:         shortURL,
+		ExpiresAt:        sql.NullTime{Time: opts.ExpiresAt, Valid: !opts.ExpiresAt.IsZero()},
+		ActiveFrom:       sql.NullTime{Time: opts.ActiveFrom, Valid: !opts.ActiveFrom.IsZero()},
+		Title:            opts.Title,
+		Notes:            opts.Notes,
+		Tags:             opts.Tags,
+		MaxClicks:        opts.MaxClicks,
+		RedirectCode:     opts.RedirectCode,
+		QueryPassthrough: opts.QueryPassthrough,
+	}
+
+	if opts.Password != "" {
+		if url.PasswordHash, err = utils.HashPassword(opts.Password); err != nil {
+			return nil, err
+		}
 	}
 
-	err = storage.Storage.Save(url)
+	err = s.storage.Save(ctx, url)
 
 	if err != nil {
 		return url, err
@@ -82,41 +214,214 @@ func APICreateShortURLHandler(originalURL string, uuid string) (url *types.URL,
 }
 
 // APICreateShortURLBatchHandler Api для создания коротких урлов пачками
-func APICreateShortURLBatchHandler(urls []*types.URL) ([]*types.URL, error) {
+func (s *Service) APICreateShortURLBatchHandler(ctx context.Context, urls []*types.URL) ([]*types.URL, error) {
 	// Вычисляем короткий url для каждой ссылки
 	for _, url := range urls {
-		url.ShortURL = fmt.Sprintf("%s/%s", app.Cfg.BaseURL, url.Hash)
+		url.ShortURL = fmt.Sprintf("%s/%s", s.cfg.BaseURL, url.Hash)
 	}
 
-	err := storage.Storage.SaveBatch(urls)
+	err := s.storage.SaveBatch(ctx, urls)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
 	return urls, nil
 }
 
-// APIDeleteShortURLBatchHandler удаляет урлы из базы по идентификаторам
-func APIDeleteShortURLBatchHandler(hashes []string) {
-	if len(hashes) > 0 {
-		go storage.Storage.DeleteByHash(hashes)
+// APIImportHandler потоково импортирует ссылки пользователя uuid из body.
+// Строки пишутся в хранилище пачками по ImportBatchSize, уже существующие
+// хеши считаются конфликтами, битые строки пропускаются. Ошибка хранилища
+// прерывает импорт, в результате остается то, что успели записать
+func (s *Service) APIImportHandler(ctx context.Context, body io.Reader, format string, uuid string) (result types.ImportResult, err error) {
+	reader, err := newImportReader(body, format)
+	if err != nil {
+		return result, err
+	}
+
+	size := s.cfg.ImportBatchSize
+	if size <= 0 {
+		size = 1000
+	}
+
+	batch := make([]*types.URL, 0, size)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		created, importErr := s.storage.Import(ctx, batch)
+		if importErr != nil {
+			return importErr
+		}
+
+		result.Created += created
+		result.Conflicts += len(batch) - created
+		batch = batch[:0]
+
+		return nil
+	}
+
+	invalid := func(line int, err error) {
+		result.Invalid++
+		if len(result.Errors) < maxImportErrors {
+			result.Errors = append(result.Errors, types.ImportError{Line: line, Error: err.Error()})
+		}
+	}
+
+	for {
+		line, row, e := reader.Next()
+		if errors.Is(e, io.EOF) {
+			break
+		}
+
+		var lineErr *lineError
+		if errors.As(e, &lineErr) {
+			invalid(line, lineErr.err)
+			continue
+		}
+		if e != nil {
+			return result, e
+		}
+
+		originalURL := strings.TrimSpace(row.OriginalURL)
+		if !validURL(originalURL) {
+			invalid(line, fmt.Errorf("некорректный url %q", originalURL))
+			continue
+		}
+
+		if e = checkHash(row.CorrelationID); e != nil {
+			invalid(line, e)
+			continue
+		}
+
+		hash, shortURL := s.shortURL(originalURL, uuid)
+		if row.CorrelationID != "" {
+			hash = row.CorrelationID
+			shortURL = fmt.Sprintf("%s/%s", s.cfg.BaseURL, hash)
+		}
+
+		batch = append(batch, &types.URL{
+			UUID:     uuid,
+			Hash:     hash,
+			URL:      originalURL,
+			ShortURL: shortURL,
+		})
+
+		if len(batch) >= size {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	err = flush()
+
+	return result, err
+}
+
+// ExportHandler потоково пишет в w ссылки пользователя uuid в формате format.
+// Пустой uuid - выгрузка всех ссылок
+func (s *Service) ExportHandler(ctx context.Context, w io.Writer, format string, uuid string) error {
+	writer, err := newExportWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.Export(ctx, uuid, writer.Write)
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// shortURL хеш и короткий урл для originalURL пользователя uuid
+// с учетом режима владения OwnershipMode
+func (s *Service) shortURL(originalURL string, uuid string) (hash string, shortURL string) {
+	if s.cfg.OwnershipMode == types.OwnershipUser {
+		return utils.GetUserShortURL(s.cfg.BaseURL, originalURL, uuid)
+	}
+
+	return utils.GetShortURL(s.cfg.BaseURL, originalURL)
+}
+
+// APIDeleteShortURLBatchHandler удаляет урлы пользователя uuid из базы по
+// идентификаторам, чужие хеши пропускаются. Удаление асинхронное, поэтому
+// контекст запроса не используем - он будет отменен сразу после ответа клиенту.
+// Без uuid ничего не удаляется: для хранилища пустой uuid - любой владелец
+func (s *Service) APIDeleteShortURLBatchHandler(uuid string, hashes []string) {
+	if uuid != "" && len(hashes) > 0 {
+		go func() {
+			if err := s.storage.DeleteByHash(context.Background(), uuid, hashes); err != nil {
+				log.Printf("APIDeleteShortURLBatchHandler. Не удалось удалить ссылки. %s", err)
+			}
+		}()
 	}
 }
 
 // APIStatsHandler статистика по урлам
-func APIStatsHandler() (statistic types.Statistic) {
-	return storage.Storage.Statistic()
+func (s *Service) APIStatsHandler(ctx context.Context) (statistic types.Statistic) {
+	return s.storage.Statistic(ctx)
 }
 
 // GetUserURLSHandler — возвращает все сокращенные урлы пользователя.
-func GetUserURLSHandler(uuid string) (urls map[string]*types.URL, err error) {
-	urls, err = storage.Storage.FindByUUID(uuid)
+func (s *Service) GetUserURLSHandler(ctx context.Context, uuid string) (urls map[string]*types.URL, err error) {
+	urls, err = s.storage.FindByUUID(ctx, uuid)
 
 	return urls, err
 }
 
+// UpdateUserURLHandler меняет адрес, название, заметки, метки или пароль
+// ссылки пользователя uuid. Хеш остается прежним, старое значение попадает в историю
+func (s *Service) UpdateUserURLHandler(ctx context.Context, uuid string, hash string, update types.URLUpdate) (*types.URL, error) {
+	update, err := normalizeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	// пустой пароль снимает защиту
+	if update.Password != nil {
+		passwordHash := ""
+		if *update.Password != "" {
+			if passwordHash, err = utils.HashPassword(*update.Password); err != nil {
+				return nil, err
+			}
+		}
+		update.Password, update.PasswordHash = nil, &passwordHash
+	}
+
+	return s.storage.UpdateURL(ctx, uuid, hash, update)
+}
+
+// RestoreUserURLSHandler снимает удаление со ссылок пользователя uuid.
+// Чужие, неудаленные и несуществующие хеши попадают в NotFound, удаленные
+// дольше RestoreGracePeriod - в Expired
+func (s *Service) RestoreUserURLSHandler(ctx context.Context, uuid string, hashes []string) (types.RestoreResult, error) {
+	return s.storage.RestoreByHash(ctx, uuid, hashes)
+}
+
+// UserURLHistoryHandler история изменений ссылки пользователя uuid
+func (s *Service) UserURLHistoryHandler(ctx context.Context, uuid string, hash string) ([]types.URLRevision, error) {
+	return s.storage.URLHistory(ctx, uuid, hash)
+}
+
+// ListUserURLSHandler — страница сокращенных урлов пользователя
+// с фильтрами и сортировкой
+func (s *Service) ListUserURLSHandler(ctx context.Context, q types.URLQuery) (types.URLPage, error) {
+	return s.storage.ListURLs(ctx, q)
+}
+
 // PingHandler проверяет соединение с базой
-func PingHandler() (err error) {
-	return storage.Storage.Ping()
+func (s *Service) PingHandler(ctx context.Context) (err error) {
+	return s.storage.Ping(ctx)
+}
+
+// ConsistencyHandler сверка слоев хранилища. repair - исправить по слою source
+func (s *Service) ConsistencyHandler(ctx context.Context, source string, repair bool) (types.ConsistencyReport, error) {
+	return s.storage.CheckConsistency(ctx, source, repair)
+}
+
+// HealthHandler состояние хранилища
+func (s *Service) HealthHandler() types.Health {
+	return s.storage.Health()
 }
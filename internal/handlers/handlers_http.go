@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,10 +9,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/nastradamus39/ya_practicum_go_advanced/internal/app"
 	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/middlewares"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 
 	"github.com/go-chi/chi/v5"
@@ -20,12 +24,36 @@ import (
 // url для сокращения
 type url struct {
 	URL string `json:"url"`
+	// ExpiresAt после этого времени ссылка перестает работать
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ActiveFrom до этого времени ссылка еще не работает
+	ActiveFrom *time.Time `json:"active_from,omitempty"`
+	Title      string     `json:"title,omitempty"`
+	Notes      string     `json:"notes,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	// Password пароль на переход по ссылке
+	Password string `json:"password,omitempty"`
+	// MaxClicks сколько переходов разрешено. 0 - без ограничения
+	MaxClicks int64 `json:"max_clicks,omitempty"`
+	// RedirectCode код редиректа: 301, 302, 307 или 308. Нет - 307
+	RedirectCode int `json:"redirect_code,omitempty"`
+	// QueryPassthrough перенос параметров запроса: append или merge
+	QueryPassthrough string `json:"query_passthrough,omitempty"`
+	// UTM и UTMTemplate utm-метки полного урла: из сохраненного шаблона
+	// и поверх - заданные явно
+	UTM         *types.UTM `json:"utm,omitempty"`
+	UTMTemplate string     `json:"utm_template,omitempty"`
+	// QR формат QR-кода в ответе: png или svg. Пусто - без кода
+	QR string `json:"qr,omitempty"`
 }
 
 // batchURL в пакетной обработке
 type batchURL struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	// UTM и UTMTemplate utm-метки, как в /api/shorten
+	UTM         *types.UTM `json:"utm,omitempty"`
+	UTMTemplate string     `json:"utm_template,omitempty"`
 }
 
 // shortenBatchURL сокращенный урл в пакетной обработке
@@ -37,16 +65,64 @@ type shortenBatchURL struct {
 // Сокращенный url
 type response struct {
 	URL string `json:"result"`
+	// QR картинка QR-кода строкой data:, если ее запросили
+	QR string `json:"qr,omitempty"`
 }
 
 // URL пользователя
 type userURL struct {
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	ShortURL    string   `json:"short_url"`
+	OriginalURL string   `json:"original_url"`
+	Title       string   `json:"title,omitempty"`
+	Notes       string   `json:"notes,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Clicks      int64    `json:"clicks"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+	UpdatedAt   string   `json:"updated_at,omitempty"`
+	DeletedAt   string   `json:"deleted_at,omitempty"`
+	ExpiresAt   string   `json:"expires_at,omitempty"`
+	ActiveFrom  string   `json:"active_from,omitempty"`
+	// Protected нужен ли пароль для перехода
+	Protected bool `json:"protected,omitempty"`
+	// MaxClicks и RemainingClicks лимит переходов и сколько осталось.
+	// Нет - без ограничения
+	MaxClicks       int64  `json:"max_clicks,omitempty"`
+	RemainingClicks *int64 `json:"remaining_clicks,omitempty"`
+	// RedirectCode и QueryPassthrough как ведет переход. Нет - по умолчанию
+	RedirectCode     int    `json:"redirect_code,omitempty"`
+	QueryPassthrough string `json:"query_passthrough,omitempty"`
 }
 
+// urlUpdate изменение ссылки. Отсутствующее поле не меняется
+type urlUpdate struct {
+	URL   *string   `json:"url"`
+	Title *string   `json:"title"`
+	Notes *string   `json:"notes"`
+	Tags  *[]string `json:"tags"`
+	// Password новый пароль, "" - снять пароль
+	Password *string `json:"password"`
+	// MaxClicks новый лимит переходов, 0 - снять лимит
+	MaxClicks *int64 `json:"max_clicks"`
+	// RedirectCode новый код редиректа, 0 - по умолчанию
+	RedirectCode *int `json:"redirect_code"`
+	// QueryPassthrough перенос параметров запроса, "" - отключить
+	QueryPassthrough *string `json:"query_passthrough"`
+}
+
+// urlRevision прежнее значение ссылки
+type urlRevision struct {
+	OriginalURL string   `json:"original_url"`
+	Title       string   `json:"title,omitempty"`
+	Notes       string   `json:"notes,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	ChangedAt   string   `json:"changed_at"`
+}
+
+// maxUserURLSLimit наибольший размер страницы ссылок пользователя
+const maxUserURLSLimit = 1000
+
 // CreateShortURLHTTPHandler — создает короткий урл.
-func CreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Service) CreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	originalURL, _ := ioutil.ReadAll(r.Body)
 
 	defer func(Body io.ReadCloser) {
@@ -56,8 +132,8 @@ func CreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}(r.Body)
 
-	uuid := middlewares.UserSignedCookie.UUID
-	url, err := CreateShortURLHandler(string(originalURL), uuid)
+	uuid := middlewares.UUIDFromContext(r.Context())
+	url, err := s.CreateShortURLHandler(r.Context(), string(originalURL), uuid)
 
 	// Если такой url уже есть - отдаем соответствующий статус
 	if errors.Is(err, shortenerErrors.ErrURLConflict) {
@@ -78,10 +154,10 @@ func CreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetShortURLHTTPHandler — возвращает полный урл по короткому.
-func GetShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Service) GetShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	hash := chi.URLParam(r, "hash")
 
-	url, err := GetShortURLHandler(hash)
+	url, err := s.GetShortURLHandler(r.Context(), hash)
 
 	// Если url не найден - отдаем соответствующий статус
 	if errors.Is(err, shortenerErrors.ErrURLNotFound) {
@@ -89,25 +165,41 @@ func GetShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	if errors.Is(err, shortenerErrors.ErrURLDeleted) || errors.Is(err, shortenerErrors.ErrURLExpired) ||
+		errors.Is(err, shortenerErrors.ErrURLExhausted) {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("gone"))
 		return
 	}
 
-	if errors.Is(err, shortenerErrors.ErrURLDeleted) {
-		w.WriteHeader(http.StatusGone)
-		w.Write([]byte("gone"))
+	// Ссылка еще не действует - страница со временем начала или 404
+	var notActiveErr *notActiveError
+	if errors.As(err, &notActiveErr) {
+		if s.cfg.NotActivePage {
+			notActivePage(w, notActiveErr.activeFrom)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
 		return
 	}
 
-	w.Header().Add("Location", url.URL)
-	w.WriteHeader(http.StatusTemporaryRedirect)
-	w.Write([]byte(url.URL))
+	// Ссылка с паролем - форма, переход после UnlockShortURLHTTPHandler
+	if errors.Is(err, shortenerErrors.ErrPasswordRequired) {
+		passwordForm(w, http.StatusOK, "")
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	redirect(w, r, url, redirectStatus(url))
 }
 
 // APICreateShortURLHTTPHandler Api для создания короткого урла
-func APICreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Service) APICreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	u := url{}
 
 	// Обрабатываем входящий json
@@ -116,13 +208,52 @@ func APICreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uuid := middlewares.UserSignedCookie.UUID
+	if u.QR != "" && u.QR != qrFormatPNG && u.QR != qrFormatSVG {
+		http.Error(w, "qr: png или svg", http.StatusBadRequest)
+		return
+	}
 
-	url, err := APICreateShortURLHandler(u.URL, uuid)
+	opts := types.LinkOptions{
+		Title:            u.Title,
+		Notes:            u.Notes,
+		Tags:             u.Tags,
+		Password:         u.Password,
+		MaxClicks:        u.MaxClicks,
+		RedirectCode:     u.RedirectCode,
+		QueryPassthrough: u.QueryPassthrough,
+		UTM:              u.UTM,
+		UTMTemplate:      u.UTMTemplate,
+	}
+	if u.ExpiresAt != nil {
+		opts.ExpiresAt = *u.ExpiresAt
+	}
+	if u.ActiveFrom != nil {
+		opts.ActiveFrom = *u.ActiveFrom
+	}
+
+	uuid := middlewares.UUIDFromContext(r.Context())
+
+	url, err := s.APICreateShortURLWithOptionsHandler(r.Context(), u.URL, uuid, opts)
+
+	if errors.Is(err, shortenerErrors.ErrInvalidLink) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := response{}
+	if url != nil {
+		result.URL = url.ShortURL
+	}
+	if url != nil && u.QR != "" {
+		var qrErr error
+		if result.QR, qrErr = shortenQR(url.ShortURL, u.QR); qrErr != nil {
+			log.Printf("APICreateShortURLHTTPHandler. Не удалось построить qr-код. %s", qrErr)
+		}
+	}
 
 	// Если такой url уже есть - отдаем соответствующий статус
 	if errors.Is(err, shortenerErrors.ErrURLConflict) {
-		resp, _ := json.Marshal(response{URL: url.ShortURL})
+		resp, _ := json.Marshal(result)
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
 		w.Write(resp)
@@ -130,11 +261,11 @@ func APICreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	resp, _ := json.Marshal(response{URL: url.ShortURL})
+	resp, _ := json.Marshal(result)
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("Accept", "application/json")
@@ -143,7 +274,7 @@ func APICreateShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // APICreateShortURLBatchHTTPHandler Api для создания коротких урлов пачками
-func APICreateShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Service) APICreateShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	var incomingData []batchURL
 
 	// Обрабатываем входящий json
@@ -155,15 +286,27 @@ func APICreateShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
 
 	var urls []*types.URL
 	var resp []*shortenBatchURL
-	uuid := middlewares.UserSignedCookie.UUID
+	uuid := middlewares.UUIDFromContext(r.Context())
 
 	for _, url := range incomingData {
-		shortURL := fmt.Sprintf("%s/%s", app.Cfg.BaseURL, url.CorrelationID)
+		if err := checkHash(url.CorrelationID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		shortURL := fmt.Sprintf("%s/%s", s.cfg.BaseURL, url.CorrelationID)
+
+		// метки проверяются до записи: одна ошибка - не пишется ничего
+		originalURL, err := s.composeUTM(r.Context(), uuid, url.OriginalURL, url.UTM, url.UTMTemplate)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %s", url.CorrelationID, err), userURLErrorStatus(err))
+			return
+		}
 
 		urls = append(urls, &types.URL{
 			UUID:     uuid,
 			Hash:     url.CorrelationID,
-			URL:      url.OriginalURL,
+			URL:      originalURL,
 			ShortURL: shortURL,
 		})
 		resp = append(resp, &shortenBatchURL{
@@ -172,9 +315,17 @@ func APICreateShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	_, err := APICreateShortURLBatchHandler(urls)
+	_, err := s.APICreateShortURLBatchHandler(r.Context(), urls)
+
+	// пачка пишется целиком или никак: при ошибке ссылок не появилось
+	if errors.Is(err, shortenerErrors.ErrURLConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
 	if err != nil {
-		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	response, _ := json.Marshal(resp)
@@ -185,8 +336,33 @@ func APICreateShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(response)
 }
 
+// APIImportHTTPHandler потоковый импорт ссылок из NDJSON или CSV (Content-Type: text/csv)
+func (s *Service) APIImportHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	format := ImportFormatNDJSON
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		format = ImportFormatCSV
+	}
+
+	uuid := middlewares.UUIDFromContext(r.Context())
+
+	result, err := s.APIImportHandler(r.Context(), r.Body, format, uuid)
+
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("APIImportHandler. Импорт прерван. %s", err)
+		result.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+
+	resp, _ := json.Marshal(result)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
 // APIDeleteShortURLBatchHTTPHandler удаляет урлы из базы по идентификаторам
-func APIDeleteShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Service) APIDeleteShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	var incomingData []string
 
 	// Обрабатываем входящий json
@@ -196,16 +372,56 @@ func APIDeleteShortURLBatchHTTPHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	APIDeleteShortURLBatchHandler(incomingData)
+	s.APIDeleteShortURLBatchHandler(middlewares.UUIDFromContext(r.Context()), incomingData)
 
 	w.WriteHeader(http.StatusAccepted)
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write([]byte("ok"))
 }
 
+// GetUserURLSExportHTTPHandler выгрузка ссылок пользователя, ?format=csv|jsonl
+func (s *Service) GetUserURLSExportHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	uuid := middlewares.UUIDFromContext(r.Context())
+	// пустой uuid для хранилища значит "все ссылки"
+	if uuid == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	s.export(w, r, uuid)
+}
+
+// APIExportHTTPHandler выгрузка всех ссылок, ?format=csv|jsonl
+func (s *Service) APIExportHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	s.export(w, r, "")
+}
+
+// export отдает выгрузку файлом. Ответ уходит по мере чтения хранилища,
+// поэтому ошибку посреди выгрузки клиент увидит только как оборванный файл
+func (s *Service) export(w http.ResponseWriter, r *http.Request, uuid string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportFormatJSONL
+	}
+
+	contentType, err := ExportContentType(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="urls.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	if err = s.ExportHandler(r.Context(), w, format, uuid); err != nil {
+		log.Printf("ExportHandler. Выгрузка прервана. %s", err)
+	}
+}
+
 // APIStatsHTTPHandler статистика по урлам
-func APIStatsHTTPHandler(w http.ResponseWriter, r *http.Request) {
-	resp := APIStatsHandler()
+func (s *Service) APIStatsHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	resp := s.APIStatsHandler(r.Context())
 
 	respString, _ := json.Marshal(resp)
 
@@ -216,29 +432,46 @@ func APIStatsHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(respString)
 }
 
-// GetUserURLSHTTPHandler — возвращает все сокращенные урлы пользователя.
-func GetUserURLSHTTPHandler(w http.ResponseWriter, r *http.Request) {
-	uuid := middlewares.UserSignedCookie.UUID
+// GetUserURLSHTTPHandler — возвращает сокращенные урлы пользователя.
+// Параметры: sort=created|clicks, order=asc|desc, deleted и expired=true|false,
+// domain, search, limit и cursor. Без limit отдаются все ссылки. Удаленные
+// ссылки скрыты, если не передан include_deleted=true или deleted.
+// Общее число подходящих ссылок - в X-Total-Count, курсор следующей
+// страницы - в X-Next-Cursor
+func (s *Service) GetUserURLSHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseURLQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.UUID = middlewares.UUIDFromContext(r.Context())
 
-	urls, err := GetUserURLSHandler(uuid)
+	page, err := s.ListUserURLSHandler(r.Context(), q)
+
+	if errors.Is(err, shortenerErrors.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if len(urls) == 0 {
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+
+	if len(page.URLs) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	resp := make([]userURL, 0, len(urls))
+	resp := make([]userURL, 0, len(page.URLs))
 
-	for _, url := range urls {
-		resp = append(resp, userURL{
-			ShortURL:    url.ShortURL,
-			OriginalURL: url.URL,
-		})
+	for _, url := range page.URLs {
+		resp = append(resp, newUserURL(url))
 	}
 
 	respString, _ := json.Marshal(resp)
@@ -250,9 +483,264 @@ func GetUserURLSHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(respString)
 }
 
+// newUserURL ссылка пользователя в ответе
+func newUserURL(url *types.URL) userURL {
+	u := userURL{
+		ShortURL:         url.ShortURL,
+		OriginalURL:      url.URL,
+		Title:            url.Title,
+		Notes:            url.Notes,
+		Tags:             url.Tags,
+		Clicks:           url.Clicks,
+		CreatedAt:        formatTime(url.CreatedAt),
+		UpdatedAt:        formatTime(url.UpdatedAt),
+		DeletedAt:        formatTime(url.DeletedAt),
+		ExpiresAt:        formatTime(url.ExpiresAt),
+		ActiveFrom:       formatTime(url.ActiveFrom),
+		Protected:        url.Protected(),
+		RedirectCode:     url.RedirectCode,
+		QueryPassthrough: url.QueryPassthrough,
+	}
+
+	if url.MaxClicks > 0 {
+		remaining := url.RemainingClicks()
+		u.MaxClicks, u.RemainingClicks = url.MaxClicks, &remaining
+	}
+
+	return u
+}
+
+// formatTime время в RFC3339. Пусто, если времени нет
+func formatTime(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+
+	return t.Time.UTC().Format(time.RFC3339)
+}
+
+// parseURLQuery разбирает параметры выборки ссылок пользователя
+func parseURLQuery(r *http.Request) (q types.URLQuery, err error) {
+	params := r.URL.Query()
+
+	switch sortBy := params.Get("sort"); sortBy {
+	case "", types.SortCreated, types.SortClicks:
+		q.Sort = sortBy
+	default:
+		return q, fmt.Errorf("sort: created или clicks")
+	}
+
+	switch params.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Asc = true
+	default:
+		return q, fmt.Errorf("order: asc или desc")
+	}
+
+	if q.Deleted, err = parseBoolParam(params.Get("deleted")); err != nil {
+		return q, fmt.Errorf("deleted: %w", err)
+	}
+	includeDeleted, err := parseBoolParam(params.Get("include_deleted"))
+	if err != nil {
+		return q, fmt.Errorf("include_deleted: %w", err)
+	}
+	if q.Deleted == nil && (includeDeleted == nil || !*includeDeleted) {
+		q.Deleted = new(bool)
+	}
+	if q.Expired, err = parseBoolParam(params.Get("expired")); err != nil {
+		return q, fmt.Errorf("expired: %w", err)
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > maxUserURLSLimit {
+			return q, fmt.Errorf("limit: от 1 до %d", maxUserURLSLimit)
+		}
+	}
+
+	q.Domain = params.Get("domain")
+	q.Search = params.Get("search")
+	q.Cursor = params.Get("cursor")
+
+	return q, nil
+}
+
+// parseBoolParam необязательный флаг. Пусто - nil
+func parseBoolParam(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flag, nil
+}
+
+// UpdateUserURLHTTPHandler меняет адрес, описание, пароль, лимит переходов
+// или редирект ссылки текущего пользователя
+func (s *Service) UpdateUserURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	u := urlUpdate{}
+
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uuid := middlewares.UUIDFromContext(r.Context())
+
+	url, err := s.UpdateUserURLHandler(r.Context(), uuid, chi.URLParam(r, "hash"), types.URLUpdate{
+		URL:              u.URL,
+		Title:            u.Title,
+		Notes:            u.Notes,
+		Tags:             u.Tags,
+		Password:         u.Password,
+		MaxClicks:        u.MaxClicks,
+		RedirectCode:     u.RedirectCode,
+		QueryPassthrough: u.QueryPassthrough,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), userURLErrorStatus(err))
+		return
+	}
+
+	resp, _ := json.Marshal(newUserURL(url))
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// RestoreUserURLSHTTPHandler восстанавливает удаленные ссылки текущего
+// пользователя. Тело - массив хешей, как при удалении
+func (s *Service) RestoreUserURLSHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	var hashes []string
+
+	if err := json.NewDecoder(r.Body).Decode(&hashes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(hashes) == 0 {
+		http.Error(w, "нет хешей для восстановления", http.StatusBadRequest)
+		return
+	}
+
+	uuid := middlewares.UUIDFromContext(r.Context())
+
+	result, err := s.RestoreUserURLSHandler(r.Context(), uuid, hashes)
+
+	// бд доступна, но сначала должны выполниться отложенные записи
+	if errors.Is(err, shortenerErrors.ErrPendingWrites) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if errors.Is(err, shortenerErrors.ErrCircuitOpen) || errors.Is(err, shortenerErrors.ErrNoDBConnection) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err != nil {
+		log.Printf("RestoreUserURLSHandler. %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, _ := json.Marshal(result)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// UserURLHistoryHTTPHandler история изменений ссылки текущего пользователя
+func (s *Service) UserURLHistoryHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	uuid := middlewares.UUIDFromContext(r.Context())
+
+	revisions, err := s.UserURLHistoryHandler(r.Context(), uuid, chi.URLParam(r, "hash"))
+	if err != nil {
+		http.Error(w, err.Error(), userURLErrorStatus(err))
+		return
+	}
+
+	resp := make([]urlRevision, 0, len(revisions))
+	for _, revision := range revisions {
+		resp = append(resp, urlRevision{
+			OriginalURL: revision.URL,
+			Title:       revision.Title,
+			Notes:       revision.Notes,
+			Tags:        revision.Tags,
+			ChangedAt:   revision.ChangedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	respString, _ := json.Marshal(resp)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respString)
+}
+
+// userURLErrorStatus статус ответа на ошибку работы со ссылкой пользователя
+func userURLErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, shortenerErrors.ErrInvalidLink):
+		return http.StatusBadRequest
+	case errors.Is(err, shortenerErrors.ErrURLForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, shortenerErrors.ErrURLNotFound), errors.Is(err, shortenerErrors.ErrURLNotActive),
+		errors.Is(err, shortenerErrors.ErrTemplateNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, shortenerErrors.ErrURLDeleted), errors.Is(err, shortenerErrors.ErrURLExpired),
+		errors.Is(err, shortenerErrors.ErrURLExhausted):
+		return http.StatusGone
+	case errors.Is(err, shortenerErrors.ErrPasswordRequired), errors.Is(err, shortenerErrors.ErrWrongPassword):
+		return http.StatusUnauthorized
+	case errors.Is(err, shortenerErrors.ErrTooManyAttempts):
+		return http.StatusTooManyRequests
+	}
+
+	log.Printf("Ошибка работы со ссылкой пользователя. %s", err)
+
+	return http.StatusInternalServerError
+}
+
+// ConsistencyHTTPHandler сверка слоев хранилища. GET - только отчет,
+// POST ?source=db|file|memory - исправление по выбранному слою
+func (s *Service) ConsistencyHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	repair := r.Method == http.MethodPost
+	source := r.URL.Query().Get("source")
+
+	if repair && source != storage.TierDB && source != storage.TierFile && source != storage.TierMemory {
+		http.Error(w, "source: db, file или memory", http.StatusBadRequest)
+		return
+	}
+
+	report, err := s.ConsistencyHandler(r.Context(), source, repair)
+	if err != nil {
+		log.Printf("ConsistencyHandler. %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, _ := json.Marshal(report)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
 // PingHTTPHandler проверяет соединение с базой
-func PingHTTPHandler(w http.ResponseWriter, r *http.Request) {
-	err := PingHandler()
+func (s *Service) PingHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.PingHandler(r.Context())
+
+	health := s.HealthHandler()
+	w.Header().Set("X-Outbox-Depth", strconv.Itoa(health.OutboxDepth))
+	w.Header().Set("X-Circuit-Breaker", health.BreakerState)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -2,15 +2,23 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	neturl "net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang/mock/gomock"
-	"github.com/nastradamus39/ya_practicum_go_advanced/internal/storage"
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/middlewares"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/qr"
 	mocksStorage "github.com/nastradamus39/ya_practicum_go_advanced/internal/storage/mocks"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 	"github.com/stretchr/testify/assert"
@@ -22,19 +30,20 @@ type HandlersTestSuite struct {
 	suite.Suite
 
 	ctrl    *gomock.Controller
-	storage *mocksStorage.Mockstore
+	storage *mocksStorage.MockStore
+	svc     *Service
 }
 
 func (s *HandlersTestSuite) SetupTest() {
 	s.ctrl = gomock.NewController(s.T())
-	s.storage = mocksStorage.NewMockstore(s.ctrl)
+	s.storage = mocksStorage.NewMockStore(s.ctrl)
 
-	storage.Storage = s.storage
+	s.svc = NewService(&types.Config{}, s.storage)
 }
 
 // TestCreateShortURLHandler создание короткого url
 func (s *HandlersTestSuite) TestCreateShortURLHandler() {
-	s.storage.EXPECT().Save(gomock.Any()).Return(nil).Times(1)
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).Return(nil).Times(1)
 
 	request := httptest.NewRequest(
 		http.MethodPost,
@@ -43,7 +52,7 @@ func (s *HandlersTestSuite) TestCreateShortURLHandler() {
 	)
 	w := httptest.NewRecorder()
 
-	CreateShortURLHTTPHandler(w, request)
+	s.svc.CreateShortURLHTTPHandler(w, request)
 
 	result := w.Result()
 
@@ -58,12 +67,13 @@ func (s *HandlersTestSuite) TestCreateShortURLHandler() {
 
 // TestGetShortURLHandler возвращает полный url по короткому
 func (s *HandlersTestSuite) TestGetShortURLHandler() {
-	s.storage.EXPECT().FindByHash(gomock.Any()).Return(true, &types.URL{
+	s.storage.EXPECT().FindByHash(gomock.Any(), gomock.Any()).Return(true, &types.URL{
 		UUID:     "uuid",
 		Hash:     "580c5ab5ef6a4f27b3da9956ae192f4f",
 		URL:      "https://ya.ru?x=y",
 		ShortURL: "https://localhost/580c5ab5ef6a4f27b3da9956ae192f4f",
 	}, nil).AnyTimes()
+	s.storage.EXPECT().Click("580c5ab5ef6a4f27b3da9956ae192f4f").Times(1)
 
 	rctx := chi.NewRouteContext()
 	rctx.URLParams.Add("hash", "580c5ab5ef6a4f27b3da9956ae192f4f")
@@ -73,7 +83,7 @@ func (s *HandlersTestSuite) TestGetShortURLHandler() {
 
 	w := httptest.NewRecorder()
 
-	GetShortURLHTTPHandler(w, request)
+	s.svc.GetShortURLHTTPHandler(w, request)
 
 	result := w.Result()
 
@@ -87,7 +97,7 @@ func (s *HandlersTestSuite) TestGetShortURLHandler() {
 
 // TestAPICreateShortURLHandler Api для создания короткого урла
 func (s *HandlersTestSuite) TestAPICreateShortURLHandler() {
-	s.storage.EXPECT().Save(gomock.Any()).Return(nil).Times(1)
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).Return(nil).Times(1)
 
 	request := httptest.NewRequest(
 		http.MethodPost,
@@ -97,7 +107,7 @@ func (s *HandlersTestSuite) TestAPICreateShortURLHandler() {
 
 	w := httptest.NewRecorder()
 
-	APICreateShortURLHTTPHandler(w, request)
+	s.svc.APICreateShortURLHTTPHandler(w, request)
 
 	result := w.Result()
 
@@ -107,11 +117,60 @@ func (s *HandlersTestSuite) TestAPICreateShortURLHandler() {
 
 	err = result.Body.Close()
 	require.NoError(s.T(), err)
+
+	// после ошибки хранилища ответ не дописывается
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).Return(shortenerErrors.ErrNoDBConnection).Times(1)
+	request = httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://yandex.ru"}`))
+	w = httptest.NewRecorder()
+
+	s.svc.APICreateShortURLHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusInternalServerError, w.Result().StatusCode)
+	assert.Equal(s.T(), shortenerErrors.ErrNoDBConnection.Error()+"\n", w.Body.String())
+}
+
+// TestAPICreateShortURLWithOptionsHandler описание и срок сохраняются вместе со ссылкой
+func (s *HandlersTestSuite) TestAPICreateShortURLWithOptionsHandler() {
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, url *types.URL) error {
+		assert.Equal(s.T(), "Яндекс", url.Title)
+		assert.Equal(s.T(), "поиск", url.Notes)
+		assert.Equal(s.T(), types.Tags{"search", "ru"}, url.Tags)
+		assert.True(s.T(), url.ExpiresAt.Valid)
+		return nil
+	}).Times(1)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/shorten",
+		strings.NewReader(`{"url":"http://yandex.ru","title":" Яндекс ","notes":"поиск","tags":["search"," ru","search",""],"expires_at":"`+expiresAt+`"}`),
+	)
+	w := httptest.NewRecorder()
+
+	s.svc.APICreateShortURLHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusCreated, w.Result().StatusCode)
+
+	many := make([]string, maxTags+1)
+	for i := range many {
+		many[i] = strconv.Itoa(i)
+	}
+	tags, _ := json.Marshal(many)
+	for _, body := range []string{
+		`{"url":"http://yandex.ru","expires_at":"2000-01-01T00:00:00Z"}`,
+		`{"url":"http://yandex.ru","title":"` + strings.Repeat("x", maxTitleLength+1) + `"}`,
+		`{"url":"http://yandex.ru","tags":["` + strings.Repeat("x", maxTagLength+1) + `"]}`,
+		`{"url":"http://yandex.ru","tags":` + string(tags) + `}`,
+	} {
+		request = httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		w = httptest.NewRecorder()
+
+		s.svc.APICreateShortURLHTTPHandler(w, request)
+		assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode, body)
+	}
 }
 
 // TestAPICreateShortURLBatchHandler Api для создания короткого урла
 func (s *HandlersTestSuite) TestAPICreateShortURLBatchHandler() {
-	s.storage.EXPECT().SaveBatch(gomock.Any()).Return(nil).Times(1)
+	s.storage.EXPECT().SaveBatch(gomock.Any(), gomock.Any()).Return(nil).Times(1)
 
 	request := httptest.NewRequest(
 		http.MethodPost,
@@ -121,7 +180,7 @@ func (s *HandlersTestSuite) TestAPICreateShortURLBatchHandler() {
 
 	w := httptest.NewRecorder()
 
-	APICreateShortURLBatchHTTPHandler(w, request)
+	s.svc.APICreateShortURLBatchHTTPHandler(w, request)
 
 	result := w.Result()
 
@@ -131,11 +190,130 @@ func (s *HandlersTestSuite) TestAPICreateShortURLBatchHandler() {
 
 	err = result.Body.Close()
 	require.NoError(s.T(), err)
+
+	// хеш длиннее колонки в бд не пишется вовсе
+	request = httptest.NewRequest(
+		http.MethodPost,
+		"/api/shorten/batch",
+		strings.NewReader(`[{"correlation_id" : "`+strings.Repeat("x", maxHashLength+1)+`", "original_url" : "http://yandex.ru"}]`),
+	)
+	w = httptest.NewRecorder()
+
+	s.svc.APICreateShortURLBatchHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode)
+
+	// ошибка записи пачки не выдается за успех
+	s.storage.EXPECT().SaveBatch(gomock.Any(), gomock.Any()).Return(shortenerErrors.ErrURLConflict).Times(1)
+	s.storage.EXPECT().SaveBatch(gomock.Any(), gomock.Any()).Return(shortenerErrors.ErrCircuitOpen).Times(1)
+	for _, status := range []int{http.StatusConflict, http.StatusInternalServerError} {
+		request = httptest.NewRequest(
+			http.MethodPost,
+			"/api/shorten/batch",
+			strings.NewReader(`[{"correlation_id" : "hash-1", "original_url" : "http://yandex.ru"}]`),
+		)
+		w = httptest.NewRecorder()
+
+		s.svc.APICreateShortURLBatchHTTPHandler(w, request)
+		assert.Equal(s.T(), status, w.Result().StatusCode)
+		assert.NotContains(s.T(), w.Body.String(), "short_url")
+	}
+}
+
+// TestAPIImportHandler импорт CSV пачками с битыми строками и конфликтами
+func (s *HandlersTestSuite) TestAPIImportHandler() {
+	s.svc.cfg.ImportBatchSize = 2
+
+	var batches [][]*types.URL
+	s.storage.EXPECT().Import(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, urls []*types.URL) (int, error) {
+		batch := make([]*types.URL, len(urls))
+		copy(batch, urls)
+		batches = append(batches, batch)
+		// первая ссылка каждой пачки уже есть в хранилище
+		return len(urls) - 1, nil
+	}).Times(2)
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/shorten/import",
+		strings.NewReader("original_url,correlation_id\nhttp://yandex.ru?x=1,legacy-1\nnot a url,\nhttp://yandex.ru?x=2,\nbro\"ken,\nhttp://yandex.ru?x=3,\n"),
+	)
+	request.Header.Set("Content-Type", "text/csv")
+
+	w := httptest.NewRecorder()
+
+	s.svc.APIImportHTTPHandler(w, request)
+
+	result := w.Result()
+	defer result.Body.Close()
+
+	var summary types.ImportResult
+	require.NoError(s.T(), json.NewDecoder(result.Body).Decode(&summary))
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.Equal(s.T(), 1, summary.Created)
+	assert.Equal(s.T(), 2, summary.Conflicts)
+	assert.Equal(s.T(), 2, summary.Invalid)
+	require.Len(s.T(), summary.Errors, 2)
+	assert.Equal(s.T(), 3, summary.Errors[0].Line)
+
+	require.Len(s.T(), batches, 2)
+	assert.Equal(s.T(), "legacy-1", batches[0][0].Hash)
+	assert.Equal(s.T(), "/legacy-1", batches[0][0].ShortURL)
+	assert.Len(s.T(), batches[1], 1)
+}
+
+// TestGetUserURLSExportHandler выгрузка ссылок пользователя в csv
+func (s *HandlersTestSuite) TestGetUserURLSExportHandler() {
+	createdAt := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	s.storage.EXPECT().Export(gomock.Any(), "uuid", gomock.Any()).DoAndReturn(func(_ context.Context, _ string, fn func(url *types.URL) error) error {
+		return fn(&types.URL{
+			UUID:      "uuid",
+			Hash:      "hash-1",
+			URL:       "http://yandex.ru?x=1,2",
+			ShortURL:  "http://localhost/hash-1",
+			CreatedAt: sql.NullTime{Time: createdAt, Valid: true},
+		})
+	}).Times(1)
+
+	// без пользователя выгружать нечего
+	request := httptest.NewRequest(http.MethodGet, "/api/user/urls/export?format=csv", nil)
+	w := httptest.NewRecorder()
+
+	s.svc.GetUserURLSExportHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.Result().StatusCode)
+
+	request = httptest.NewRequest(http.MethodGet, "/api/user/urls/export?format=csv", nil)
+	request = request.WithContext(middlewares.WithUUID(request.Context(), "uuid"))
+	w = httptest.NewRecorder()
+
+	s.svc.GetUserURLSExportHTTPHandler(w, request)
+
+	result := w.Result()
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.Equal(s.T(), "text/csv; charset=utf-8", result.Header.Get("Content-Type"))
+	assert.Equal(s.T(), "hash,original_url,short_url,uuid,created_at,deleted_at\n"+
+		"hash-1,\"http://yandex.ru?x=1,2\",http://localhost/hash-1,uuid,2022-05-01T10:00:00Z,\n", string(body))
+
+	request = httptest.NewRequest(http.MethodGet, "/api/user/urls/export?format=xml", nil)
+	request = request.WithContext(middlewares.WithUUID(request.Context(), "uuid"))
+	w = httptest.NewRecorder()
+
+	s.svc.GetUserURLSExportHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode)
 }
 
 // TestGetUserURLSHandler возвращает все сокращенные урлы пользователя
 func (s *HandlersTestSuite) TestGetUserURLSHandler() {
-	s.storage.EXPECT().FindByUUID(gomock.Any()).Return(nil, nil).Times(1)
+	s.storage.EXPECT().ListURLs(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, q types.URLQuery) (types.URLPage, error) {
+		// удаленные по умолчанию скрыты
+		require.NotNil(s.T(), q.Deleted)
+		assert.False(s.T(), *q.Deleted)
+		return types.URLPage{}, nil
+	}).Times(1)
 
 	request := httptest.NewRequest(
 		http.MethodGet,
@@ -145,18 +323,707 @@ func (s *HandlersTestSuite) TestGetUserURLSHandler() {
 
 	w := httptest.NewRecorder()
 
-	GetUserURLSHTTPHandler(w, request)
+	s.svc.GetUserURLSHTTPHandler(w, request)
 
 	result := w.Result()
 
 	_, err := ioutil.ReadAll(result.Body)
 	require.NoError(s.T(), err)
 	assert.Equal(s.T(), http.StatusNoContent, result.StatusCode)
+	assert.Equal(s.T(), "0", result.Header.Get("X-Total-Count"))
 
 	err = result.Body.Close()
 	require.NoError(s.T(), err)
 }
 
+// TestGetUserURLSPageHandler параметры выборки и заголовки страницы
+func (s *HandlersTestSuite) TestGetUserURLSPageHandler() {
+	createdAt := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	s.storage.EXPECT().ListURLs(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, q types.URLQuery) (types.URLPage, error) {
+		assert.Equal(s.T(), types.SortClicks, q.Sort)
+		assert.True(s.T(), q.Asc)
+		require.NotNil(s.T(), q.Deleted)
+		assert.False(s.T(), *q.Deleted)
+		assert.Nil(s.T(), q.Expired)
+		assert.Equal(s.T(), "ya.ru", q.Domain)
+		assert.Equal(s.T(), "news", q.Search)
+		assert.Equal(s.T(), "abc", q.Cursor)
+		assert.Equal(s.T(), 1, q.Limit)
+
+		return types.URLPage{
+			URLs: []*types.URL{{
+				Hash:      "hash-1",
+				URL:       "https://ya.ru/news",
+				ShortURL:  "http://localhost/hash-1",
+				Clicks:    3,
+				CreatedAt: sql.NullTime{Time: createdAt, Valid: true},
+			}},
+			Total:      2,
+			NextCursor: "next",
+		}, nil
+	}).Times(1)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/user/urls?sort=clicks&order=asc&deleted=false&domain=ya.ru&search=news&cursor=abc&limit=1", nil)
+	w := httptest.NewRecorder()
+
+	s.svc.GetUserURLSHTTPHandler(w, request)
+
+	result := w.Result()
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.Equal(s.T(), "2", result.Header.Get("X-Total-Count"))
+	assert.Equal(s.T(), "next", result.Header.Get("X-Next-Cursor"))
+	assert.JSONEq(s.T(), `[{"short_url":"http://localhost/hash-1","original_url":"https://ya.ru/news","clicks":3,"created_at":"2022-05-01T10:00:00Z"}]`, string(body))
+
+	for _, query := range []string{"sort=name", "order=up", "expired=maybe", "limit=0", "limit=1001"} {
+		request = httptest.NewRequest(http.MethodGet, "/api/user/urls?"+query, nil)
+		w = httptest.NewRecorder()
+
+		s.svc.GetUserURLSHTTPHandler(w, request)
+		assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode, query)
+	}
+}
+
+// TestGetUserURLSIncludeDeletedHandler include_deleted показывает и удаленные ссылки
+func (s *HandlersTestSuite) TestGetUserURLSIncludeDeletedHandler() {
+	deletedAt := time.Date(2022, 5, 2, 0, 0, 0, 0, time.UTC)
+
+	s.storage.EXPECT().ListURLs(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, q types.URLQuery) (types.URLPage, error) {
+		assert.Nil(s.T(), q.Deleted)
+		return types.URLPage{
+			URLs: []*types.URL{{
+				Hash:      "hash-1",
+				URL:       "https://ya.ru",
+				ShortURL:  "http://localhost/hash-1",
+				DeletedAt: sql.NullTime{Time: deletedAt, Valid: true},
+			}},
+			Total: 1,
+		}, nil
+	}).Times(1)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/user/urls?include_deleted=true", nil)
+	w := httptest.NewRecorder()
+
+	s.svc.GetUserURLSHTTPHandler(w, request)
+
+	result := w.Result()
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.JSONEq(s.T(), `[{"short_url":"http://localhost/hash-1","original_url":"https://ya.ru","clicks":0,"deleted_at":"2022-05-02T00:00:00Z"}]`, string(body))
+}
+
+// TestRestoreUserURLSHandler восстановление удаленных ссылок
+func (s *HandlersTestSuite) TestRestoreUserURLSHandler() {
+	s.storage.EXPECT().RestoreByHash(gomock.Any(), gomock.Any(), []string{"hash-1", "hash-2"}).
+		Return(types.RestoreResult{Restored: []string{"hash-1"}, Expired: []string{"hash-2"}}, nil).Times(1)
+	s.storage.EXPECT().RestoreByHash(gomock.Any(), gomock.Any(), []string{"hash-3"}).
+		Return(types.RestoreResult{}, shortenerErrors.ErrCircuitOpen).Times(1)
+	s.storage.EXPECT().RestoreByHash(gomock.Any(), gomock.Any(), []string{"hash-4"}).
+		Return(types.RestoreResult{}, shortenerErrors.ErrPendingWrites).Times(1)
+
+	restore := func(body string) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/api/user/urls/restore", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		s.svc.RestoreUserURLSHTTPHandler(w, request)
+
+		return w.Result()
+	}
+
+	result := restore(`["hash-1","hash-2"]`)
+	defer result.Body.Close()
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.JSONEq(s.T(), `{"restored":["hash-1"],"expired":["hash-2"]}`, string(body))
+
+	assert.Equal(s.T(), http.StatusServiceUnavailable, restore(`["hash-3"]`).StatusCode)
+	assert.Equal(s.T(), http.StatusConflict, restore(`["hash-4"]`).StatusCode)
+	assert.Equal(s.T(), http.StatusBadRequest, restore(`[]`).StatusCode)
+}
+
+// TestGetExpiredShortURLHandler истекшая ссылка не редиректит и не считает переход
+func (s *HandlersTestSuite) TestGetExpiredShortURLHandler() {
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-1").Return(true, &types.URL{
+		Hash:      "hash-1",
+		URL:       "https://ya.ru",
+		ExpiresAt: sql.NullTime{Time: time.Now().Add(-time.Minute), Valid: true},
+	}, nil).Times(1)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("hash", "hash-1")
+
+	request := httptest.NewRequest(http.MethodGet, "/hash-1", nil)
+	request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+
+	s.svc.GetShortURLHTTPHandler(w, request)
+
+	assert.Equal(s.T(), http.StatusGone, w.Result().StatusCode)
+}
+
+// TestGetNotActiveShortURLHandler до начала действия - страница со временем
+// начала или 404, qr-код уже отдается
+func (s *HandlersTestSuite) TestGetNotActiveShortURLHandler() {
+	activeFrom := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-1").Return(true, &types.URL{
+		Hash:       "hash-1",
+		URL:        "https://ya.ru",
+		ActiveFrom: sql.NullTime{Time: activeFrom, Valid: true},
+	}, nil).AnyTimes()
+
+	get := func(svc *Service) *http.Response {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", "hash-1")
+
+		request := httptest.NewRequest(http.MethodGet, "/hash-1", nil)
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		svc.GetShortURLHTTPHandler(w, request)
+
+		return w.Result()
+	}
+
+	result := get(NewService(&types.Config{NotActivePage: true}, s.storage))
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.Contains(s.T(), string(body), activeFrom.Format(time.RFC3339))
+	assert.NotContains(s.T(), string(body), "ya.ru")
+	assert.Empty(s.T(), result.Header.Get("Location"))
+
+	assert.Equal(s.T(), http.StatusNotFound, get(s.svc).StatusCode)
+
+	_, err = s.svc.PreviewHandler(context.Background(), "hash-1")
+	assert.ErrorIs(s.T(), err, shortenerErrors.ErrURLNotActive)
+
+	_, err = s.svc.QRCodeHandler(context.Background(), "hash-1", qr.M)
+	assert.NoError(s.T(), err)
+
+	_, err = s.svc.APICreateShortURLWithOptionsHandler(context.Background(), "https://ya.ru", "", types.LinkOptions{
+		ActiveFrom: activeFrom,
+		ExpiresAt:  activeFrom.Add(-time.Minute),
+	})
+	assert.ErrorIs(s.T(), err, shortenerErrors.ErrInvalidLink)
+}
+
+// TestRedirectLocation перенос параметров запроса в полный урл
+func (s *HandlersTestSuite) TestRedirectLocation() {
+	tests := []struct {
+		name        string
+		destination string
+		mode        string
+		query       string
+		want        string
+	}{
+		{"не переносятся", "https://ya.ru/?a=1", "", "utm_source=mail", "https://ya.ru/?a=1"},
+		{"нечего переносить", "https://ya.ru/?a=1", types.QueryPassthroughAppend, "", "https://ya.ru/?a=1"},
+		{"append", "https://ya.ru/p?a=1", types.QueryPassthroughAppend, "utm_source=mail", "https://ya.ru/p?a=1&utm_source=mail"},
+		{"append оставляет оба значения", "https://ya.ru/?a=1&b=2", types.QueryPassthroughAppend, "a=3", "https://ya.ru/?a=1&b=2&a=3"},
+		{"merge заменяет", "https://ya.ru/?a=1&b=2&a=4", types.QueryPassthroughMerge, "a=3", "https://ya.ru/?b=2&a=3"},
+		{"merge по раскодированному ключу", "https://ya.ru/?utm%5Fsource=x&c=1", types.QueryPassthroughMerge, "utm_source=mail", "https://ya.ru/?c=1&utm_source=mail"},
+		{"без параметров", "https://ya.ru/p#top", types.QueryPassthroughMerge, "q=a b&x=%26", "https://ya.ru/p?q=a+b&x=%26#top"},
+		{"кодирование полного урла не меняется", "https://ya.ru/?q=%D1%8F", types.QueryPassthroughAppend, "r=я", "https://ya.ru/?q=%D1%8F&r=%D1%8F"},
+		{"битые пары отбрасываются", "https://ya.ru/", types.QueryPassthroughAppend, "a=%zz&b=1", "https://ya.ru/?b=1"},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			url := &types.URL{URL: tt.destination, QueryPassthrough: tt.mode}
+			assert.Equal(t, tt.want, redirectLocation(url, tt.query))
+		})
+	}
+}
+
+// TestRedirectCode код редиректа ссылки и перенос параметров при переходе
+func (s *HandlersTestSuite) TestRedirectCode() {
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-1").Return(true, &types.URL{
+		Hash:             "hash-1",
+		URL:              "https://ya.ru/?from=short",
+		RedirectCode:     http.StatusMovedPermanently,
+		QueryPassthrough: types.QueryPassthroughMerge,
+	}, nil).Times(1)
+	s.storage.EXPECT().Click("hash-1").Times(1)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("hash", "hash-1")
+
+	request := httptest.NewRequest(http.MethodGet, "/hash-1?from=newsletter", nil)
+	request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+
+	s.svc.GetShortURLHTTPHandler(w, request)
+
+	result := w.Result()
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), http.StatusMovedPermanently, result.StatusCode)
+	assert.Equal(s.T(), "https://ya.ru/?from=newsletter", result.Header.Get("Location"))
+	assert.Equal(s.T(), "max-age=3600", result.Header.Get("Cache-Control"))
+
+	for _, body := range []string{`{"url":"https://ya.ru","redirect_code":303}`, `{"url":"https://ya.ru","query_passthrough":"replace"}`} {
+		request = httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		w = httptest.NewRecorder()
+		s.svc.APICreateShortURLHTTPHandler(w, request)
+		assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode, body)
+	}
+}
+
+// TestUTMBuilder метки из шаблона и запроса дописываются к урлу до хеширования
+func (s *HandlersTestSuite) TestUTMBuilder() {
+	s.storage.EXPECT().UTMTemplates(gomock.Any(), "user-1").Return([]types.UTMTemplate{
+		{UUID: "user-1", Name: "mail", UTM: types.UTM{Source: "newsletter", Medium: "email"}},
+	}, nil).AnyTimes()
+
+	shorten := func(body string) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		request = request.WithContext(middlewares.WithUUID(request.Context(), "user-1"))
+		w := httptest.NewRecorder()
+
+		s.svc.APICreateShortURLHTTPHandler(w, request)
+
+		return w.Result()
+	}
+
+	var saved *types.URL
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, url *types.URL) error {
+		saved = url
+		return nil
+	}).Times(1)
+
+	result := shorten(`{"url":"https://ya.ru/p?utm_source=old&a=1#top","utm_template":"mail","utm":{"campaign":"весна 2022"}}`)
+	require.NoError(s.T(), result.Body.Close())
+	require.Equal(s.T(), http.StatusCreated, result.StatusCode)
+	require.NotNil(s.T(), saved)
+	destination := "https://ya.ru/p?a=1&utm_source=newsletter&utm_medium=email&utm_campaign=%D0%B2%D0%B5%D1%81%D0%BD%D0%B0+2022#top"
+	assert.Equal(s.T(), destination, saved.URL)
+	hash, _ := s.svc.shortURL(destination, "user-1")
+	assert.Equal(s.T(), hash, saved.Hash)
+
+	// до хранилища не доходят
+	assert.Equal(s.T(), http.StatusBadRequest, shorten(`{"url":"https://ya.ru","utm_template":"mail"}`).StatusCode)
+	assert.Equal(s.T(), http.StatusBadRequest, shorten(`{"url":"https://ya.ru","utm_template":"ads","utm":{"campaign":"x"}}`).StatusCode)
+	assert.Equal(s.T(), http.StatusBadRequest, shorten(`{"url":"not a url","utm":{"source":"a","medium":"b","campaign":"c"}}`).StatusCode)
+
+	// в пачке ошибка одной ссылки отменяет всю пачку
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(`[
+		{"correlation_id":"a","original_url":"https://ya.ru","utm_template":"mail","utm":{"campaign":"x"}},
+		{"correlation_id":"b","original_url":"https://ya.ru","utm":{"source":"x"}}
+	]`))
+	request = request.WithContext(middlewares.WithUUID(request.Context(), "user-1"))
+	w := httptest.NewRecorder()
+	s.svc.APICreateShortURLBatchHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode)
+	assert.Contains(s.T(), w.Body.String(), "b: ")
+
+	s.storage.EXPECT().SaveBatch(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, urls []*types.URL) error {
+		require.Len(s.T(), urls, 1)
+		assert.Equal(s.T(), "https://ya.ru?utm_source=newsletter&utm_medium=email&utm_campaign=x", urls[0].URL)
+		return nil
+	}).Times(1)
+	request = httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(`[
+		{"correlation_id":"a","original_url":"https://ya.ru","utm_template":"mail","utm":{"campaign":"x"}}
+	]`))
+	request = request.WithContext(middlewares.WithUUID(request.Context(), "user-1"))
+	w = httptest.NewRecorder()
+	s.svc.APICreateShortURLBatchHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusCreated, w.Result().StatusCode)
+}
+
+// TestUTMTemplatesHandler сохранение и удаление шаблонов utm текущего пользователя
+func (s *HandlersTestSuite) TestUTMTemplatesHandler() {
+	call := func(method string, name string, body string, handler http.HandlerFunc) *http.Response {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+
+		request := httptest.NewRequest(method, "/api/user/utm-templates/"+name, strings.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		request = request.WithContext(middlewares.WithUUID(request.Context(), "user-1"))
+		w := httptest.NewRecorder()
+
+		handler(w, request)
+
+		return w.Result()
+	}
+
+	s.storage.EXPECT().UTMTemplates(gomock.Any(), "user-1").Return(nil, nil).Times(1)
+	s.storage.EXPECT().SaveUTMTemplate(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, template *types.UTMTemplate) error {
+		assert.Equal(s.T(), "user-1", template.UUID)
+		assert.Equal(s.T(), "mail", template.Name)
+		assert.Equal(s.T(), types.UTM{Source: "newsletter", Medium: "email"}, template.UTM)
+		return nil
+	}).Times(1)
+
+	result := call(http.MethodPut, "mail", `{"source":" newsletter ","medium":"email"}`, s.svc.SaveUTMTemplateHTTPHandler)
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+
+	assert.Equal(s.T(), http.StatusBadRequest, call(http.MethodPut, "mail", `{}`, s.svc.SaveUTMTemplateHTTPHandler).StatusCode)
+	assert.Equal(s.T(), http.StatusBadRequest, call(http.MethodPut, "mail", `{"source":"a\nb"}`, s.svc.SaveUTMTemplateHTTPHandler).StatusCode)
+
+	s.storage.EXPECT().DeleteUTMTemplate(gomock.Any(), "user-1", "ads").Return(shortenerErrors.ErrTemplateNotFound).Times(1)
+	assert.Equal(s.T(), http.StatusNotFound, call(http.MethodDelete, "ads", "", s.svc.DeleteUTMTemplateHTTPHandler).StatusCode)
+}
+
+// TestQRCodeHandler картинка qr-кода ссылки, ошибки параметров и удаленные ссылки
+func (s *HandlersTestSuite) TestQRCodeHandler() {
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-1").Return(true, &types.URL{Hash: "hash-1", URL: "https://ya.ru"}, nil).Times(2)
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-2").Return(true, &types.URL{
+		Hash:      "hash-2",
+		URL:       "https://ya.ru",
+		DeletedAt: sql.NullTime{Time: time.Now(), Valid: true},
+	}, nil).Times(1)
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-3").Return(false, nil, nil).Times(1)
+
+	get := func(hash string, query string) *http.Response {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", hash)
+
+		request := httptest.NewRequest(http.MethodGet, "/"+hash+"/qr?"+query, nil)
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		s.svc.QRCodeHTTPHandler(w, request)
+
+		return w.Result()
+	}
+
+	result := get("hash-1", "size=128&margin=2&level=H")
+	img, err := png.Decode(result.Body)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), "image/png", result.Header.Get("Content-Type"))
+	assert.Equal(s.T(), 128, img.Bounds().Dx())
+
+	result = get("hash-1", "format=svg")
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), "image/svg+xml", result.Header.Get("Content-Type"))
+	assert.True(s.T(), strings.HasPrefix(string(body), "<svg"))
+
+	assert.Equal(s.T(), http.StatusGone, get("hash-2", "").StatusCode)
+	assert.Equal(s.T(), http.StatusNotFound, get("hash-3", "").StatusCode)
+
+	// до хранилища не доходят
+	for _, query := range []string{"format=gif", "size=0", "size=100000", "margin=-1", "level=X"} {
+		assert.Equal(s.T(), http.StatusBadRequest, get("hash-4", query).StatusCode, query)
+	}
+}
+
+// TestPreviewHandler предпросмотр не редиректит, не считает переход
+// и экранирует данные пользователя
+func (s *HandlersTestSuite) TestPreviewHandler() {
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-1").Return(true, &types.URL{
+		Hash:      "hash-1",
+		URL:       "https://ya.ru/?q=<script>",
+		Title:     "<b>Яндекс</b>",
+		Notes:     "секрет",
+		Clicks:    7,
+		CreatedAt: sql.NullTime{Time: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC), Valid: true},
+	}, nil).Times(2)
+	s.storage.EXPECT().FindByHash(gomock.Any(), "hash-2").Return(true, &types.URL{
+		Hash:      "hash-2",
+		ExpiresAt: sql.NullTime{Time: time.Now().Add(-time.Minute), Valid: true},
+	}, nil).Times(1)
+	s.storage.EXPECT().Click(gomock.Any()).Times(0)
+
+	get := func(handler http.HandlerFunc, hash string) (*http.Response, string) {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", hash)
+
+		request := httptest.NewRequest(http.MethodGet, "/"+hash+"+", nil)
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		handler(w, request)
+
+		result := w.Result()
+		body, err := ioutil.ReadAll(result.Body)
+		require.NoError(s.T(), err)
+		require.NoError(s.T(), result.Body.Close())
+
+		return result, string(body)
+	}
+
+	result, body := get(s.svc.PreviewHTTPHandler, "hash-1")
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.Contains(s.T(), body, "&lt;b&gt;Яндекс&lt;/b&gt;")
+	assert.Contains(s.T(), body, "https://ya.ru/?q=&lt;script&gt;")
+	assert.Contains(s.T(), body, `href="/hash-1"`)
+	assert.NotContains(s.T(), body, "секрет")
+
+	result, body = get(s.svc.APIPreviewHTTPHandler, "hash-1")
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.JSONEq(s.T(), `{"short_url":"/hash-1","original_url":"https://ya.ru/?q=<script>","title":"<b>Яндекс</b>","created_at":"2022-05-01T10:00:00Z","clicks":7}`, body)
+
+	result, _ = get(s.svc.PreviewHTTPHandler, "hash-2")
+	assert.Equal(s.T(), http.StatusGone, result.StatusCode)
+}
+
+// TestPasswordProtectedURL ссылка с паролем отдает форму, редиректит только
+// после верного пароля и блокирует подбор
+func (s *HandlersTestSuite) TestPasswordProtectedURL() {
+	svc := NewService(&types.Config{PasswordMaxAttempts: 2, PasswordMaxLinkAttempts: 3, PasswordLockout: types.Duration{Duration: time.Minute}}, s.storage)
+
+	var saved *types.URL
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, url *types.URL) error {
+		saved = url
+		return nil
+	}).Times(1)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","password":"secret"}`))
+	w := httptest.NewRecorder()
+	svc.APICreateShortURLHTTPHandler(w, request)
+	require.Equal(s.T(), http.StatusCreated, w.Result().StatusCode)
+	require.NotNil(s.T(), saved)
+	assert.NotContains(s.T(), saved.PasswordHash, "secret")
+	assert.True(s.T(), saved.Protected())
+
+	s.storage.EXPECT().FindByHash(gomock.Any(), saved.Hash).Return(true, saved, nil).AnyTimes()
+	s.storage.EXPECT().Click(saved.Hash).Times(1)
+
+	do := func(method string, remoteAddr string, password string) *http.Response {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", saved.Hash)
+
+		form := neturl.Values{"password": {password}}
+		request := httptest.NewRequest(method, "/"+saved.Hash, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.RemoteAddr = remoteAddr
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		if method == http.MethodGet {
+			svc.GetShortURLHTTPHandler(w, request)
+		} else {
+			svc.UnlockShortURLHTTPHandler(w, request)
+		}
+
+		return w.Result()
+	}
+
+	result := do(http.MethodGet, "10.0.0.1:1000", "")
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.Contains(s.T(), string(body), `name="password"`)
+	assert.NotContains(s.T(), string(body), "ya.ru")
+	assert.Empty(s.T(), result.Header.Get("Location"))
+
+	assert.Equal(s.T(), http.StatusUnauthorized, do(http.MethodPost, "10.0.0.1:1000", "wrong").StatusCode)
+	assert.Equal(s.T(), http.StatusUnauthorized, do(http.MethodPost, "10.0.0.1:1001", "wrong").StatusCode)
+
+	// две ошибки - даже верный пароль с этого адреса не принимается
+	result = do(http.MethodPost, "10.0.0.1:1002", "secret")
+	assert.Equal(s.T(), http.StatusTooManyRequests, result.StatusCode)
+	assert.Equal(s.T(), "60", result.Header.Get("Retry-After"))
+
+	result = do(http.MethodPost, "10.0.0.2:1000", "secret")
+	assert.Equal(s.T(), http.StatusSeeOther, result.StatusCode)
+	assert.Equal(s.T(), "https://ya.ru", result.Header.Get("Location"))
+
+	// третья ошибка с нового адреса закрывает ссылку для всех адресов
+	assert.Equal(s.T(), http.StatusUnauthorized, do(http.MethodPost, "10.0.0.3:1000", "wrong").StatusCode)
+	assert.Equal(s.T(), http.StatusTooManyRequests, do(http.MethodPost, "10.0.0.4:1000", "secret").StatusCode)
+
+	_, err = svc.PreviewHandler(context.Background(), saved.Hash)
+	assert.ErrorIs(s.T(), err, shortenerErrors.ErrPasswordRequired)
+}
+
+// TestMaxClicksURL одноразовая ссылка: переход засчитывается атомарно,
+// дальше - 410, в списке ссылок виден остаток
+func (s *HandlersTestSuite) TestMaxClicksURL() {
+	var saved *types.URL
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, url *types.URL) error {
+		saved = url
+		return nil
+	}).Times(1)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","max_clicks":1}`))
+	w := httptest.NewRecorder()
+	s.svc.APICreateShortURLHTTPHandler(w, request)
+	require.Equal(s.T(), http.StatusCreated, w.Result().StatusCode)
+	require.NotNil(s.T(), saved)
+	assert.EqualValues(s.T(), 1, saved.MaxClicks)
+
+	get := func() *http.Response {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", saved.Hash)
+
+		request := httptest.NewRequest(http.MethodGet, "/"+saved.Hash, nil)
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		s.svc.GetShortURLHTTPHandler(w, request)
+
+		return w.Result()
+	}
+
+	// переход мимо общего счетчика Click
+	s.storage.EXPECT().FindByHash(gomock.Any(), saved.Hash).Return(true, saved, nil).Times(1)
+	s.storage.EXPECT().ConsumeClick(gomock.Any(), saved.Hash).Return(int64(1), nil).Times(1)
+	assert.Equal(s.T(), http.StatusTemporaryRedirect, get().StatusCode)
+
+	// кэш еще не знает о переходе - лимит проверит хранилище
+	s.storage.EXPECT().FindByHash(gomock.Any(), saved.Hash).Return(true, &types.URL{Hash: saved.Hash, URL: saved.URL, MaxClicks: 1}, nil).Times(1)
+	s.storage.EXPECT().ConsumeClick(gomock.Any(), saved.Hash).Return(int64(0), shortenerErrors.ErrURLExhausted).Times(1)
+	assert.Equal(s.T(), http.StatusGone, get().StatusCode)
+
+	s.storage.EXPECT().FindByHash(gomock.Any(), saved.Hash).Return(true, &types.URL{Hash: saved.Hash, URL: saved.URL, MaxClicks: 1, Clicks: 1}, nil).Times(1)
+	assert.Equal(s.T(), http.StatusGone, get().StatusCode)
+
+	body, _ := json.Marshal(newUserURL(&types.URL{ShortURL: "http://localhost/hash-1", URL: "https://ya.ru", MaxClicks: 3, Clicks: 1}))
+	assert.JSONEq(s.T(), `{"short_url":"http://localhost/hash-1","original_url":"https://ya.ru","clicks":1,"max_clicks":3,"remaining_clicks":2}`, string(body))
+
+	_, err := s.svc.APICreateShortURLWithOptionsHandler(context.Background(), "https://ya.ru", "", types.LinkOptions{MaxClicks: -1})
+	assert.ErrorIs(s.T(), err, shortenerErrors.ErrInvalidLink)
+}
+
+// TestAPICreateShortURLWithQRHandler qr-код в ответе /api/shorten по запросу
+func (s *HandlersTestSuite) TestAPICreateShortURLWithQRHandler() {
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://yandex.ru","qr":"svg"}`))
+	w := httptest.NewRecorder()
+
+	s.svc.APICreateShortURLHTTPHandler(w, request)
+
+	result := w.Result()
+	var resp response
+	require.NoError(s.T(), json.NewDecoder(result.Body).Decode(&resp))
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), http.StatusCreated, result.StatusCode)
+	assert.True(s.T(), strings.HasPrefix(resp.QR, "data:image/svg+xml;base64,"))
+
+	request = httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://yandex.ru","qr":"gif"}`))
+	w = httptest.NewRecorder()
+
+	s.svc.APICreateShortURLHTTPHandler(w, request)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Result().StatusCode)
+}
+
+// TestUpdateUserURLHandler изменение ссылки и ответы на ошибки хранилища
+func (s *HandlersTestSuite) TestUpdateUserURLHandler() {
+	patch := func(hash string, body string) *http.Response {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", hash)
+
+		request := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+hash, strings.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		s.svc.UpdateUserURLHTTPHandler(w, request)
+
+		return w.Result()
+	}
+
+	s.storage.EXPECT().UpdateURL(gomock.Any(), gomock.Any(), "hash-1", gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, hash string, update types.URLUpdate) (*types.URL, error) {
+			require.NotNil(s.T(), update.URL)
+			assert.Equal(s.T(), "https://ya.ru", *update.URL)
+			assert.Nil(s.T(), update.Title)
+			return &types.URL{Hash: hash, URL: *update.URL, ShortURL: "http://localhost/hash-1"}, nil
+		}).Times(1)
+	s.storage.EXPECT().UpdateURL(gomock.Any(), gomock.Any(), "hash-2", gomock.Any()).
+		Return(nil, shortenerErrors.ErrURLForbidden).Times(1)
+	s.storage.EXPECT().UpdateURL(gomock.Any(), gomock.Any(), "hash-3", gomock.Any()).
+		Return(nil, shortenerErrors.ErrURLNotFound).Times(1)
+
+	result := patch("hash-1", `{"url":" https://ya.ru "}`)
+	defer result.Body.Close()
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, result.StatusCode)
+	assert.JSONEq(s.T(), `{"short_url":"http://localhost/hash-1","original_url":"https://ya.ru","clicks":0}`, string(body))
+
+	assert.Equal(s.T(), http.StatusForbidden, patch("hash-2", `{"title":"x"}`).StatusCode)
+	assert.Equal(s.T(), http.StatusNotFound, patch("hash-3", `{"title":"x"}`).StatusCode)
+
+	// до хранилища не доходят
+	assert.Equal(s.T(), http.StatusBadRequest, patch("hash-4", `{}`).StatusCode)
+	assert.Equal(s.T(), http.StatusBadRequest, patch("hash-4", `{"url":"not a url"}`).StatusCode)
+}
+
+// TestIndependentServices сервисы с разными конфигами и хранилищами не влияют друг на друга
+func (s *HandlersTestSuite) TestIndependentServices() {
+	other := mocksStorage.NewMockStore(s.ctrl)
+	otherSvc := NewService(&types.Config{BaseURL: "http://other.host"}, other)
+
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	other.EXPECT().Save(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	url, err := s.svc.CreateShortURLHandler(context.Background(), "http://yandex.ru", "uuid")
+	require.NoError(s.T(), err)
+	otherURL, err := otherSvc.CreateShortURLHandler(context.Background(), "http://yandex.ru", "uuid")
+	require.NoError(s.T(), err)
+
+	assert.Equal(s.T(), url.Hash, otherURL.Hash)
+	assert.Equal(s.T(), "/"+url.Hash, url.ShortURL)
+	assert.Equal(s.T(), "http://other.host/"+url.Hash, otherURL.ShortURL)
+}
+
+// TestOwnershipMode в режиме user одинаковые урлы разных пользователей
+// получают разные хеши, в режиме global - один
+func (s *HandlersTestSuite) TestOwnershipMode() {
+	userSvc := NewService(&types.Config{OwnershipMode: types.OwnershipUser}, s.storage)
+
+	s.storage.EXPECT().Save(gomock.Any(), gomock.Any()).Return(nil).Times(5)
+
+	create := func(svc *Service, uuid string) string {
+		url, err := svc.CreateShortURLHandler(context.Background(), "http://yandex.ru", uuid)
+		require.NoError(s.T(), err)
+		assert.Equal(s.T(), uuid, url.UUID)
+		return url.Hash
+	}
+
+	assert.Equal(s.T(), create(s.svc, "user-1"), create(s.svc, "user-2"))
+
+	hash := create(userSvc, "user-1")
+	assert.Equal(s.T(), hash, create(userSvc, "user-1"))
+	assert.NotEqual(s.T(), hash, create(userSvc, "user-2"))
+}
+
+// TestAPIDeleteShortURLBatchHandler удаляются только ссылки пользователя из куки
+func (s *HandlersTestSuite) TestAPIDeleteShortURLBatchHandler() {
+	deleted := make(chan string, 1)
+	s.storage.EXPECT().DeleteByHash(gomock.Any(), "user-1", []string{"hash-1", "hash-2"}).
+		DoAndReturn(func(ctx context.Context, uuid string, hashes []string) error {
+			deleted <- uuid
+			return nil
+		}).Times(1)
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["hash-1","hash-2"]`))
+	request = request.WithContext(middlewares.WithUUID(request.Context(), "user-1"))
+	w := httptest.NewRecorder()
+
+	s.svc.APIDeleteShortURLBatchHTTPHandler(w, request)
+
+	result := w.Result()
+	require.NoError(s.T(), result.Body.Close())
+	assert.Equal(s.T(), http.StatusAccepted, result.StatusCode)
+
+	select {
+	case uuid := <-deleted:
+		assert.Equal(s.T(), "user-1", uuid)
+	case <-time.After(time.Second):
+		s.T().Fatal("удаление не запущено")
+	}
+
+	// без пользователя не удаляется ничего, DeleteByHash больше не вызывается
+	s.svc.APIDeleteShortURLBatchHandler("", []string{"hash-1"})
+	APIDeleteShortURLBatchHandler("", []string{"hash-1"})
+}
+
 func TestHandlersSuite(t *testing.T) {
 	suite.Run(t, new(HandlersTestSuite))
 }
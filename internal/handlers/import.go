@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Форматы импорта
+const (
+	ImportFormatNDJSON = "ndjson"
+	ImportFormatCSV    = "csv"
+)
+
+// maxImportErrors сколько ошибок в строках возвращаем клиенту
+const maxImportErrors = 100
+
+// importReader читает строки импорта по одной. В конце возвращает io.EOF,
+// ошибка в самой строке возвращается как *lineError и чтение можно продолжать
+type importReader interface {
+	Next() (line int, row batchURL, err error)
+}
+
+// lineError ошибка разбора одной строки
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("строка %d: %s", e.line, e.err)
+}
+
+// newImportReader читатель для формата format
+func newImportReader(body io.Reader, format string) (importReader, error) {
+	switch format {
+	case ImportFormatNDJSON:
+		return &ndjsonReader{reader: bufio.NewReader(body)}, nil
+	case ImportFormatCSV:
+		r := csv.NewReader(body)
+		r.FieldsPerRecord = -1
+		r.ReuseRecord = true
+		r.TrimLeadingSpace = true
+		return &csvReader{reader: r}, nil
+	}
+
+	return nil, fmt.Errorf("неизвестный формат импорта %q", format)
+}
+
+// ndjsonReader строки вида {"correlation_id": "...", "original_url": "..."}
+type ndjsonReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (r *ndjsonReader) Next() (int, batchURL, error) {
+	for {
+		data, err := r.reader.ReadBytes('\n')
+		if len(data) == 0 && err != nil {
+			return r.line, batchURL{}, err
+		}
+		r.line++
+
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		row := batchURL{}
+		if e := json.Unmarshal(data, &row); e != nil {
+			return r.line, row, &lineError{line: r.line, err: e}
+		}
+
+		return r.line, row, nil
+	}
+}
+
+// csvReader строки вида correlation_id,original_url или только original_url.
+// Если первая строка - заголовок с original_url, колонки берутся по именам
+type csvReader struct {
+	reader *csv.Reader
+	// индексы колонок. -1 - колонки нет
+	hashCol int
+	urlCol  int
+	started bool
+}
+
+func (r *csvReader) Next() (int, batchURL, error) {
+	for {
+		record, err := r.reader.Read()
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return parseErr.StartLine, batchURL{}, &lineError{line: parseErr.StartLine, err: parseErr.Err}
+		}
+		if err != nil {
+			return 0, batchURL{}, err
+		}
+
+		line, _ := r.reader.FieldPos(0)
+
+		if !r.started {
+			r.started = true
+			if r.header(record) {
+				continue
+			}
+		}
+
+		row := batchURL{}
+		switch {
+		case r.urlCol >= 0:
+			if r.urlCol < len(record) {
+				row.OriginalURL = record[r.urlCol]
+			}
+			if r.hashCol >= 0 && r.hashCol < len(record) {
+				row.CorrelationID = record[r.hashCol]
+			}
+		case len(record) == 1:
+			row.OriginalURL = record[0]
+		case len(record) == 2:
+			row.CorrelationID, row.OriginalURL = record[0], record[1]
+		default:
+			return line, row, &lineError{line: line, err: fmt.Errorf("ожидалось 1 или 2 поля, получено %d", len(record))}
+		}
+
+		return line, row, nil
+	}
+}
+
+// header разбирает заголовок. false - первая строка не заголовок, а данные
+func (r *csvReader) header(record []string) bool {
+	r.hashCol, r.urlCol = -1, -1
+
+	for i, name := range record {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "original_url":
+			r.urlCol = i
+		case "correlation_id":
+			r.hashCol = i
+		}
+	}
+
+	if r.urlCol < 0 {
+		r.hashCol = -1
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// Ограничения описания ссылки
+const (
+	maxTitleLength = 256
+	maxNotesLength = 4096
+	maxTags        = 20
+	maxTagLength   = 64
+	// maxPasswordLength длина пароля ссылки в байтах
+	maxPasswordLength = 128
+	// maxHashLength длина хеша в байтах, как у колонки hash в бд
+	maxHashLength = 256
+)
+
+// normalizeLinkOptions проверяет параметры новой ссылки. Метки очищаются
+// от пробелов, пустые и повторы отбрасываются
+func normalizeLinkOptions(opts types.LinkOptions, now time.Time) (types.LinkOptions, error) {
+	if !opts.ExpiresAt.IsZero() && !opts.ExpiresAt.After(now) {
+		return opts, fmt.Errorf("%w: expires_at должен быть в будущем", shortenerErrors.ErrInvalidLink)
+	}
+
+	if !opts.ActiveFrom.IsZero() && !opts.ExpiresAt.IsZero() && !opts.ActiveFrom.Before(opts.ExpiresAt) {
+		return opts, fmt.Errorf("%w: active_from должен быть раньше expires_at", shortenerErrors.ErrInvalidLink)
+	}
+
+	opts.Title = strings.TrimSpace(opts.Title)
+	if utf8.RuneCountInString(opts.Title) > maxTitleLength {
+		return opts, fmt.Errorf("%w: title длиннее %d символов", shortenerErrors.ErrInvalidLink, maxTitleLength)
+	}
+
+	if utf8.RuneCountInString(opts.Notes) > maxNotesLength {
+		return opts, fmt.Errorf("%w: notes длиннее %d символов", shortenerErrors.ErrInvalidLink, maxNotesLength)
+	}
+
+	tags, err := normalizeTags(opts.Tags)
+	if err != nil {
+		return opts, err
+	}
+	opts.Tags = tags
+
+	if len(opts.Password) > maxPasswordLength {
+		return opts, fmt.Errorf("%w: password длиннее %d байт", shortenerErrors.ErrInvalidLink, maxPasswordLength)
+	}
+
+	if opts.MaxClicks < 0 {
+		return opts, fmt.Errorf("%w: max_clicks не может быть отрицательным", shortenerErrors.ErrInvalidLink)
+	}
+
+	if !types.ValidRedirectCode(opts.RedirectCode) {
+		return opts, fmt.Errorf("%w: redirect_code: 301, 302, 307 или 308", shortenerErrors.ErrInvalidLink)
+	}
+
+	if !types.ValidQueryPassthrough(opts.QueryPassthrough) {
+		return opts, fmt.Errorf("%w: query_passthrough: append или merge", shortenerErrors.ErrInvalidLink)
+	}
+
+	return opts, nil
+}
+
+// normalizeUpdate проверяет изменение ссылки. Пустое изменение - ошибка
+func normalizeUpdate(update types.URLUpdate) (types.URLUpdate, error) {
+	if update.URL == nil && update.Title == nil && update.Notes == nil && update.Tags == nil &&
+		update.Password == nil && update.MaxClicks == nil && update.RedirectCode == nil && update.QueryPassthrough == nil {
+		return update, fmt.Errorf("%w: нечего менять", shortenerErrors.ErrInvalidLink)
+	}
+
+	if update.URL != nil {
+		destination := strings.TrimSpace(*update.URL)
+		if !validURL(destination) {
+			return update, fmt.Errorf("%w: некорректный url %q", shortenerErrors.ErrInvalidLink, destination)
+		}
+		update.URL = &destination
+	}
+
+	if update.Title != nil {
+		title := strings.TrimSpace(*update.Title)
+		if utf8.RuneCountInString(title) > maxTitleLength {
+			return update, fmt.Errorf("%w: title длиннее %d символов", shortenerErrors.ErrInvalidLink, maxTitleLength)
+		}
+		update.Title = &title
+	}
+
+	if update.Notes != nil && utf8.RuneCountInString(*update.Notes) > maxNotesLength {
+		return update, fmt.Errorf("%w: notes длиннее %d символов", shortenerErrors.ErrInvalidLink, maxNotesLength)
+	}
+
+	if update.Tags != nil {
+		tags, err := normalizeTags(*update.Tags)
+		if err != nil {
+			return update, err
+		}
+		update.Tags = &tags
+	}
+
+	if update.Password != nil && len(*update.Password) > maxPasswordLength {
+		return update, fmt.Errorf("%w: password длиннее %d байт", shortenerErrors.ErrInvalidLink, maxPasswordLength)
+	}
+
+	if update.MaxClicks != nil && *update.MaxClicks < 0 {
+		return update, fmt.Errorf("%w: max_clicks не может быть отрицательным", shortenerErrors.ErrInvalidLink)
+	}
+
+	if update.RedirectCode != nil && !types.ValidRedirectCode(*update.RedirectCode) {
+		return update, fmt.Errorf("%w: redirect_code: 301, 302, 307 или 308", shortenerErrors.ErrInvalidLink)
+	}
+
+	if update.QueryPassthrough != nil && !types.ValidQueryPassthrough(*update.QueryPassthrough) {
+		return update, fmt.Errorf("%w: query_passthrough: append или merge", shortenerErrors.ErrInvalidLink)
+	}
+
+	return update, nil
+}
+
+// checkHash проверяет хеш, заданный клиентом. Слишком длинный хеш бд
+// не примет, и запись застрянет в outbox
+func checkHash(hash string) error {
+	if len(hash) > maxHashLength {
+		return fmt.Errorf("%w: correlation_id длиннее %d байт", shortenerErrors.ErrInvalidLink, maxHashLength)
+	}
+
+	return nil
+}
+
+// validURL абсолютный урл с хостом
+func validURL(raw string) bool {
+	u, err := neturl.ParseRequestURI(raw)
+
+	return err == nil && u.Host != ""
+}
+
+// normalizeTags очищает метки и проверяет их число и длину
+func normalizeTags(tags []string) ([]string, error) {
+	var result []string
+	seen := map[string]bool{}
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("%w: метка длиннее %d символов", shortenerErrors.ErrInvalidLink, maxTagLength)
+		}
+
+		seen[tag] = true
+		result = append(result, tag)
+	}
+
+	if len(result) > maxTags {
+		return nil, fmt.Errorf("%w: больше %d меток", shortenerErrors.ErrInvalidLink, maxTags)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/utils"
+)
+
+// attemptsError отказ из-за подбора пароля. retryAfter - когда можно снова
+type attemptsError struct {
+	retryAfter time.Duration
+}
+
+func (e *attemptsError) Error() string {
+	return shortenerErrors.ErrTooManyAttempts.Error()
+}
+
+func (e *attemptsError) Unwrap() error {
+	return shortenerErrors.ErrTooManyAttempts
+}
+
+// UnlockShortURLHandler — возвращает полный урл ссылки с паролем.
+// client - откуда пришел запрос: неверные пароли считаются по клиенту
+// и ссылке, после PasswordMaxAttempts ошибок - ErrTooManyAttempts. Еще
+// они считаются по ссылке со всех клиентов, после PasswordMaxLinkAttempts
+// ошибок ссылка закрыта для всех до конца окна
+func (s *Service) UnlockShortURLHandler(ctx context.Context, hash string, password string, client string) (*types.URL, error) {
+	url, err := s.activeURL(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !url.Protected() {
+		if err = s.click(ctx, url); err != nil {
+			return nil, err
+		}
+		return url, nil
+	}
+
+	key := client + "|" + hash
+	now := time.Now()
+
+	if ok, retryAfter := s.attempts.Allow(key, now); !ok {
+		return nil, &attemptsError{retryAfter: retryAfter}
+	}
+	if ok, retryAfter := s.linkAttempts.Allow(hash, now); !ok {
+		return nil, &attemptsError{retryAfter: retryAfter}
+	}
+
+	if !utils.CheckPassword(url.PasswordHash, password) {
+		s.attempts.Fail(key, now)
+		// счетчик ссылки верный пароль не сбрасывает, иначе подбор
+		// продолжится после входа владельца
+		s.linkAttempts.Fail(hash, now)
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrWrongPassword)
+	}
+
+	s.attempts.Reset(key)
+	if err = s.click(ctx, url); err != nil {
+		return nil, err
+	}
+
+	return url, nil
+}
+
+// passwordTemplate форма пароля. Отправляется POST на тот же адрес
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Ссылка защищена паролем</title>
+</head>
+<body>
+<h1>Ссылка защищена паролем</h1>
+{{if .}}<p role="alert">{{.}}</p>{{end}}
+<form method="post">
+<input type="password" name="password" autocomplete="current-password" autofocus required>
+<button type="submit">Перейти</button>
+</form>
+</body>
+</html>
+`))
+
+// passwordForm отдает форму пароля со статусом status и сообщением message
+func passwordForm(w http.ResponseWriter, status int, message string) {
+	var buf bytes.Buffer
+	if err := passwordTemplate.Execute(&buf, message); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// UnlockShortURLHTTPHandler проверяет пароль из формы и редиректит на
+// полный урл. Неверный пароль - форма заново, подбор - 429 с Retry-After
+func (s *Service) UnlockShortURLHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	url, err := s.UnlockShortURLHandler(r.Context(), chi.URLParam(r, "hash"), r.PostForm.Get("password"), clientIP(r))
+
+	var attemptsErr *attemptsError
+	switch {
+	case errors.As(err, &attemptsErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(attemptsErr.retryAfter.Seconds()))))
+		passwordForm(w, http.StatusTooManyRequests, "Слишком много попыток, попробуйте позже")
+		return
+	case errors.Is(err, shortenerErrors.ErrWrongPassword):
+		passwordForm(w, http.StatusUnauthorized, "Неверный пароль")
+		return
+	case err != nil:
+		status := userURLErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// 303: браузер перейдет по адресу GET-запросом, а не повторит POST
+	redirect(w, r, url, http.StatusSeeOther)
+}
+
+// clientIP адрес клиента без порта. Заголовкам X-Real-IP и X-Forwarded-For
+// RealIP верит только от доверенных прокси, подставить их клиент не может
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+)
+
+// notActiveError ссылка еще не действует. activeFrom - с какого времени
+type notActiveError struct {
+	activeFrom time.Time
+}
+
+func (e *notActiveError) Error() string {
+	return shortenerErrors.ErrURLNotActive.Error()
+}
+
+func (e *notActiveError) Unwrap() error {
+	return shortenerErrors.ErrURLNotActive
+}
+
+// notActiveTemplate страница ссылки до начала действия. Куда ведет
+// ссылка, не показываем
+var notActiveTemplate = template.Must(template.New("not-active").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Ссылка еще не действует</title>
+</head>
+<body>
+<h1>Ссылка еще не действует</h1>
+<p>Переход будет доступен с <time datetime="{{.}}">{{.}}</time></p>
+</body>
+</html>
+`))
+
+// notActivePage отдает страницу ссылки, которая начнет действовать в activeFrom
+func notActivePage(w http.ResponseWriter, activeFrom time.Time) {
+	var buf bytes.Buffer
+	if err := notActiveTemplate.Execute(&buf, activeFrom.UTC().Format(time.RFC3339)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// ответ поменяется в activeFrom, запоминать его нельзя
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// preview данные страницы предпросмотра ссылки
+type preview struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+	Title       string `json:"title,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	Clicks      int64  `json:"clicks"`
+}
+
+// previewTemplate страница предпросмотра. Ссылка "перейти" ведет через
+// короткий адрес, чтобы переход засчитался
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}{{.OriginalURL}}{{end}}</title>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}Куда ведет ссылка{{end}}</h1>
+<p>{{.ShortURL}} ведет на <code>{{.OriginalURL}}</code></p>
+<dl>
+{{if .CreatedAt}}<dt>Создана</dt><dd><time datetime="{{.CreatedAt}}">{{.CreatedAt}}</time></dd>{{end}}
+<dt>Переходов</dt><dd>{{.Clicks}}</dd>
+</dl>
+<p><a href="{{.ShortURL}}" rel="nofollow noopener">Перейти</a></p>
+</body>
+</html>
+`))
+
+// newPreview данные предпросмотра ссылки url. Заметки, метки и владелец
+// видны только владельцу и сюда не попадают
+func (s *Service) newPreview(url *types.URL) preview {
+	return preview{
+		ShortURL:    fmt.Sprintf("%s/%s", s.cfg.BaseURL, url.Hash),
+		OriginalURL: url.URL,
+		Title:       url.Title,
+		CreatedAt:   formatTime(url.CreatedAt),
+		Clicks:      url.Clicks,
+	}
+}
+
+// PreviewHTTPHandler страница предпросмотра /{hash}+ вместо редиректа
+func (s *Service) PreviewHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	url, err := s.PreviewHandler(r.Context(), chi.URLParam(r, "hash"))
+	if err != nil {
+		status := userURLErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err = previewTemplate.Execute(&buf, s.newPreview(url)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// APIPreviewHTTPHandler предпросмотр ссылки в json
+func (s *Service) APIPreviewHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	url, err := s.PreviewHandler(r.Context(), chi.URLParam(r, "hash"))
+	if err != nil {
+		status := userURLErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	resp, _ := json.Marshal(s.newPreview(url))
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
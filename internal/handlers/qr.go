@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/qr"
+)
+
+// Форматы картинки QR-кода
+const (
+	qrFormatPNG = "png"
+	qrFormatSVG = "svg"
+)
+
+// Параметры QR-кода по умолчанию и ограничения
+const (
+	defaultQRSize   = 256
+	maxQRSize       = 2048
+	defaultQRMargin = 4
+	maxQRMargin     = 32
+)
+
+// qrOptions как рисовать QR-код
+type qrOptions struct {
+	format string
+	size   int
+	margin int
+	level  qr.Level
+}
+
+// defaultQROptions png 256x256 с полями 4 модуля и коррекцией M
+func defaultQROptions() qrOptions {
+	return qrOptions{
+		format: qrFormatPNG,
+		size:   defaultQRSize,
+		margin: defaultQRMargin,
+		level:  qr.M,
+	}
+}
+
+// parseQROptions параметры ?format=png|svg&size=&margin=&level=L|M|Q|H
+func parseQROptions(params neturl.Values) (opts qrOptions, err error) {
+	opts = defaultQROptions()
+
+	switch format := params.Get("format"); format {
+	case "":
+	case qrFormatPNG, qrFormatSVG:
+		opts.format = format
+	default:
+		return opts, fmt.Errorf("format: png или svg")
+	}
+
+	if value := params.Get("size"); value != "" {
+		opts.size, err = strconv.Atoi(value)
+		if err != nil || opts.size <= 0 || opts.size > maxQRSize {
+			return opts, fmt.Errorf("size: число от 1 до %d", maxQRSize)
+		}
+	}
+
+	if value := params.Get("margin"); value != "" {
+		opts.margin, err = strconv.Atoi(value)
+		if err != nil || opts.margin < 0 || opts.margin > maxQRMargin {
+			return opts, fmt.Errorf("margin: число от 0 до %d", maxQRMargin)
+		}
+	}
+
+	if value := params.Get("level"); value != "" {
+		if opts.level, err = qr.ParseLevel(value); err != nil {
+			return opts, fmt.Errorf("level: L, M, Q или H")
+		}
+	}
+
+	return opts, nil
+}
+
+// shortenQR QR-код короткой ссылки shortURL для ответа /api/shorten.
+// format - png или svg, остальные параметры по умолчанию
+func shortenQR(shortURL string, format string) (string, error) {
+	opts := defaultQROptions()
+	opts.format = format
+
+	code, err := qr.Encode([]byte(shortURL), opts.level)
+	if err != nil {
+		return "", err
+	}
+
+	return opts.dataURI(code)
+}
+
+// contentType тип картинки для заголовка ответа
+func (o qrOptions) contentType() string {
+	if o.format == qrFormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// render пишет код в w в формате из опций
+func (o qrOptions) render(w io.Writer, code *qr.Code) error {
+	if o.format == qrFormatSVG {
+		return code.SVG(w, o.size, o.margin)
+	}
+	return code.PNG(w, o.size, o.margin)
+}
+
+// dataURI картинка кода строкой data: для вставки в json
+func (o qrOptions) dataURI(code *qr.Code) (string, error) {
+	var buf bytes.Buffer
+	if err := o.render(&buf, code); err != nil {
+		return "", err
+	}
+
+	return "data:" + o.contentType() + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// QRCodeHandler QR-код короткой ссылки hash с уровнем коррекции level.
+// Переходы не засчитываются, недоступные ссылки - ошибки activeURL.
+// Код еще не начавшей действовать ссылки отдается: его печатают заранее
+func (s *Service) QRCodeHandler(ctx context.Context, hash string, level qr.Level) (*qr.Code, error) {
+	if _, err := s.activeURL(ctx, hash); err != nil && !errors.Is(err, shortenerErrors.ErrURLNotActive) {
+		return nil, err
+	}
+
+	return qr.Encode([]byte(fmt.Sprintf("%s/%s", s.cfg.BaseURL, hash)), level)
+}
+
+// QRCodeHTTPHandler картинка QR-кода короткой ссылки,
+// ?format=png|svg&size=&margin=&level=L|M|Q|H
+func (s *Service) QRCodeHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseQROptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, err := s.QRCodeHandler(r.Context(), chi.URLParam(r, "hash"), opts.level)
+
+	switch {
+	case errors.Is(err, shortenerErrors.ErrURLNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, shortenerErrors.ErrURLDeleted), errors.Is(err, shortenerErrors.ErrURLExpired),
+		errors.Is(err, shortenerErrors.ErrURLExhausted):
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("gone"))
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// картинку собираем заранее: размер может оказаться мал для кода
+	var buf bytes.Buffer
+	if err = opts.render(&buf, code); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", opts.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
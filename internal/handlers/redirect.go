@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// permanentRedirectMaxAge сколько браузер хранит постоянный переход.
+// Без явного срока 301 и 308 кешируются навсегда, и после смены урла
+// ссылки браузер продолжит вести по старому адресу
+const permanentRedirectMaxAge = time.Hour
+
+// redirectStatus код ответа на переход по ссылке
+func redirectStatus(url *types.URL) int {
+	if url.RedirectCode == 0 {
+		return http.StatusTemporaryRedirect
+	}
+
+	return url.RedirectCode
+}
+
+// redirectLocation куда вести переход по ссылке. rawQuery - параметры
+// запроса к короткой ссылке, переносятся по url.QueryPassthrough.
+// Параметры полного урла остаются как есть и в том же порядке,
+// перенесенные кодируются заново
+func redirectLocation(url *types.URL, rawQuery string) string {
+	if url.QueryPassthrough == "" || rawQuery == "" {
+		return url.URL
+	}
+
+	// битые пары отбрасываются, остальные переносятся
+	incoming, _ := neturl.ParseQuery(rawQuery)
+	if len(incoming) == 0 {
+		return url.URL
+	}
+
+	destination, err := neturl.Parse(url.URL)
+	if err != nil {
+		return url.URL
+	}
+
+	replace := func(key string) bool {
+		return url.QueryPassthrough == types.QueryPassthroughMerge && incoming[key] != nil
+	}
+	destination.RawQuery = joinQuery(destination.RawQuery, replace, incoming.Encode())
+
+	return destination.String()
+}
+
+// joinQuery дописывает к параметрам rawQuery уже закодированные пары
+// pairs. Пары rawQuery, для ключей которых replace вернул true,
+// убираются, остальные остаются как есть и в том же порядке
+func joinQuery(rawQuery string, replace func(key string) bool, pairs ...string) string {
+	var joined []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key := pair
+		if i := strings.IndexByte(key, '='); i >= 0 {
+			key = key[:i]
+		}
+		if key, err := neturl.QueryUnescape(key); err == nil && replace(key) {
+			continue
+		}
+		joined = append(joined, pair)
+	}
+
+	return strings.Join(append(joined, pairs...), "&")
+}
+
+// redirect отвечает переходом по ссылке на запрос r
+func redirect(w http.ResponseWriter, r *http.Request, url *types.URL, status int) {
+	location := redirectLocation(url, r.URL.RawQuery)
+
+	// у ссылки с лимитом или сроком переход не должен оседать в кеше
+	// браузера, даже постоянный
+	if url.MaxClicks > 0 || url.ExpiresAt.Valid {
+		w.Header().Set("Cache-Control", "no-store")
+	} else if status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(permanentRedirectMaxAge.Seconds())))
+	}
+
+	w.Header().Add("Location", location)
+	w.WriteHeader(status)
+	w.Write([]byte(location))
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/middlewares"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// Ограничения utm-меток и шаблонов
+const (
+	maxUTMLength          = 256
+	maxUTMTemplateName    = 64
+	maxUTMTemplatesByUser = 100
+)
+
+// utmField utm-метка: имя параметра и значение
+type utmField struct {
+	param string
+	value *string
+}
+
+// utmFields метки utm в порядке, в котором они дописываются к урлу
+func utmFields(utm *types.UTM) []utmField {
+	return []utmField{
+		{"utm_source", &utm.Source},
+		{"utm_medium", &utm.Medium},
+		{"utm_campaign", &utm.Campaign},
+		{"utm_term", &utm.Term},
+		{"utm_content", &utm.Content},
+	}
+}
+
+// normalizeUTM очищает метки от пробелов и проверяет длину и символы
+func normalizeUTM(utm types.UTM) (types.UTM, error) {
+	for _, field := range utmFields(&utm) {
+		*field.value = strings.TrimSpace(*field.value)
+		if utf8.RuneCountInString(*field.value) > maxUTMLength {
+			return utm, fmt.Errorf("%w: %s длиннее %d символов", shortenerErrors.ErrInvalidLink, field.param, maxUTMLength)
+		}
+		if strings.IndexFunc(*field.value, unicode.IsControl) >= 0 {
+			return utm, fmt.Errorf("%w: %s содержит управляющие символы", shortenerErrors.ErrInvalidLink, field.param)
+		}
+	}
+
+	return utm, nil
+}
+
+// normalizeUTMTemplateName имя шаблона без пробелов по краям
+func normalizeUTMTemplateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxUTMTemplateName {
+		return name, fmt.Errorf("%w: имя шаблона utm от 1 до %d символов", shortenerErrors.ErrInvalidLink, maxUTMTemplateName)
+	}
+
+	return name, nil
+}
+
+// utmTemplate шаблон пользователя uuid по имени. Нет шаблона - ErrTemplateNotFound
+func (s *Service) utmTemplate(ctx context.Context, uuid string, name string) (*types.UTMTemplate, error) {
+	templates, err := s.storage.UTMTemplates(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range templates {
+		if templates[i].Name == name {
+			return &templates[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w", shortenerErrors.ErrTemplateNotFound)
+}
+
+// composeUTM дописывает к урлу destination utm-метки из шаблона
+// пользователя templateName и поверх - из utm. Метки урла с теми же
+// именами заменяются, остальные параметры остаются как есть.
+// Без меток урл не меняется. Источник, канал и кампания обязательны
+func (s *Service) composeUTM(ctx context.Context, uuid string, destination string, utm *types.UTM, templateName string) (string, error) {
+	if utm == nil && templateName == "" {
+		return destination, nil
+	}
+
+	var composed types.UTM
+	if templateName != "" {
+		template, err := s.utmTemplate(ctx, uuid, templateName)
+		if err != nil {
+			if errors.Is(err, shortenerErrors.ErrTemplateNotFound) {
+				return "", fmt.Errorf("%w: шаблон utm %q не найден", shortenerErrors.ErrInvalidLink, templateName)
+			}
+			return "", err
+		}
+		composed = template.UTM
+	}
+	if utm != nil {
+		overrides := utmFields(utm)
+		for i, field := range utmFields(&composed) {
+			if value := *overrides[i].value; value != "" {
+				*field.value = value
+			}
+		}
+	}
+
+	composed, err := normalizeUTM(composed)
+	if err != nil {
+		return "", err
+	}
+	if composed.Source == "" || composed.Medium == "" || composed.Campaign == "" {
+		return "", fmt.Errorf("%w: нужны utm source, medium и campaign", shortenerErrors.ErrInvalidLink)
+	}
+
+	destination = strings.TrimSpace(destination)
+	if !validURL(destination) {
+		return "", fmt.Errorf("%w: некорректный url %q", shortenerErrors.ErrInvalidLink, destination)
+	}
+	u, err := neturl.Parse(destination)
+	if err != nil {
+		return "", fmt.Errorf("%w: некорректный url %q", shortenerErrors.ErrInvalidLink, destination)
+	}
+
+	var pairs []string
+	params := map[string]bool{}
+	for _, field := range utmFields(&composed) {
+		params[field.param] = true
+		if *field.value != "" {
+			pairs = append(pairs, field.param+"="+neturl.QueryEscape(*field.value))
+		}
+	}
+	u.RawQuery = joinQuery(u.RawQuery, func(key string) bool { return params[key] }, pairs...)
+
+	return u.String(), nil
+}
+
+// UTMTemplatesHandler шаблоны utm-меток пользователя uuid
+func (s *Service) UTMTemplatesHandler(ctx context.Context, uuid string) ([]types.UTMTemplate, error) {
+	return s.storage.UTMTemplates(ctx, uuid)
+}
+
+// SaveUTMTemplateHandler сохраняет шаблон utm-меток пользователя uuid.
+// Шаблон может задавать не все метки, остальные указываются при сокращении
+func (s *Service) SaveUTMTemplateHandler(ctx context.Context, uuid string, name string, utm types.UTM) (*types.UTMTemplate, error) {
+	name, err := normalizeUTMTemplateName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	utm, err = normalizeUTM(utm)
+	if err != nil {
+		return nil, err
+	}
+	if utm == (types.UTM{}) {
+		return nil, fmt.Errorf("%w: шаблон utm без меток", shortenerErrors.ErrInvalidLink)
+	}
+
+	templates, err := s.storage.UTMTemplates(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	exists := false
+	for _, template := range templates {
+		exists = exists || template.Name == name
+	}
+	if !exists && len(templates) >= maxUTMTemplatesByUser {
+		return nil, fmt.Errorf("%w: не больше %d шаблонов utm", shortenerErrors.ErrInvalidLink, maxUTMTemplatesByUser)
+	}
+
+	template := &types.UTMTemplate{
+		UUID:      uuid,
+		Name:      name,
+		UTM:       utm,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if err = s.storage.SaveUTMTemplate(ctx, template); err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// DeleteUTMTemplateHandler удаляет шаблон utm-меток пользователя uuid
+func (s *Service) DeleteUTMTemplateHandler(ctx context.Context, uuid string, name string) error {
+	return s.storage.DeleteUTMTemplate(ctx, uuid, strings.TrimSpace(name))
+}
+
+// UTMTemplatesHTTPHandler шаблоны utm-меток текущего пользователя
+func (s *Service) UTMTemplatesHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := s.UTMTemplatesHandler(r.Context(), middlewares.UUIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), userURLErrorStatus(err))
+		return
+	}
+
+	if templates == nil {
+		templates = []types.UTMTemplate{}
+	}
+	resp, _ := json.Marshal(templates)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// SaveUTMTemplateHTTPHandler создает или заменяет шаблон utm-меток
+// текущего пользователя. Тело - метки: source, medium, campaign, term, content
+func (s *Service) SaveUTMTemplateHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	utm := types.UTM{}
+	if err := json.NewDecoder(r.Body).Decode(&utm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template, err := s.SaveUTMTemplateHandler(r.Context(), middlewares.UUIDFromContext(r.Context()), chi.URLParam(r, "name"), utm)
+	if err != nil {
+		http.Error(w, err.Error(), userURLErrorStatus(err))
+		return
+	}
+
+	resp, _ := json.Marshal(template)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// DeleteUTMTemplateHTTPHandler удаляет шаблон utm-меток текущего пользователя
+func (s *Service) DeleteUTMTemplateHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.DeleteUTMTemplateHandler(r.Context(), middlewares.UUIDFromContext(r.Context()), chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), userURLErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -17,8 +18,27 @@ const cookieMaxAge = 60 * 60 * 24 * 360
 const cookieSalt = "salt"
 const secret = "secret key"
 
+// UserSignedCookie кука последнего запроса. Оставлена для совместимости,
+// uuid пользователя нужно брать из контекста запроса через UUIDFromContext
 var UserSignedCookie SignedCookie
 
+// ctxKey тип ключей контекста пакета
+type ctxKey string
+
+// uuidCtxKey ключ, под которым в контексте запроса лежит uuid пользователя
+const uuidCtxKey ctxKey = "uuid"
+
+// UUIDFromContext возвращает uuid пользователя из контекста запроса
+func UUIDFromContext(ctx context.Context) string {
+	uuid, _ := ctx.Value(uuidCtxKey).(string)
+	return uuid
+}
+
+// WithUUID кладет uuid пользователя в контекст
+func WithUUID(ctx context.Context, uuid string) context.Context {
+	return context.WithValue(ctx, uuidCtxKey, uuid)
+}
+
 func UserCookie(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		currentCookie, err := r.Cookie(cookieName)
@@ -29,6 +49,7 @@ func UserCookie(next http.Handler) http.Handler {
 			sc.Sign() // подписываем
 			http.SetCookie(w, sc.Cookie)
 			UserSignedCookie = sc
+			r = r.WithContext(WithUUID(r.Context(), sc.UUID))
 		} else {
 			// cookie есть. проверим подпись
 			sc := SignedCookie{}
@@ -41,6 +62,7 @@ func UserCookie(next http.Handler) http.Handler {
 				http.SetCookie(w, sc.Cookie)
 			}
 			UserSignedCookie = sc
+			r = r.WithContext(WithUUID(r.Context(), sc.UUID))
 		}
 		next.ServeHTTP(w, r)
 	})
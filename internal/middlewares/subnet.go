@@ -0,0 +1,93 @@
+package middlewares
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseSubnets разбирает список подсетей CIDR через запятую. Пустая строка - пустой список
+func ParseSubnets(s string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("подсеть %q: %w", cidr, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+// contains входит ли адрес ip в одну из подсетей
+func contains(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteIP адрес из r.RemoteAddr. nil, если адрес не разобрать
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// RealIP заменяет r.RemoteAddr адресом клиента из X-Real-IP или
+// X-Forwarded-For, но только если запрос пришел от прокси из proxies.
+// Остальным заголовки не верим: иначе клиент сам выбирает себе адрес
+func RealIP(proxies []*net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := remoteIP(r); ip != nil && contains(proxies, ip) {
+				if realIP := forwardedIP(r); realIP != nil {
+					r.RemoteAddr = realIP.String()
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedIP адрес клиента, который передал прокси
+func forwardedIP(r *http.Request) net.IP {
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+
+	// последний адрес дописал ближайший к нам прокси
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+
+	return net.ParseIP(strings.TrimSpace(forwarded[len(forwarded)-1]))
+}
+
+// TrustedSubnet пропускает только запросы из подсетей subnets, остальным
+// отвечает 403. Пустой список - закрыто для всех
+func TrustedSubnet(subnets []*net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := remoteIP(r); ip == nil || !contains(subnets, ip) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
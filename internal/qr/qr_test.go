@@ -0,0 +1,223 @@
+package qr
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTables емкость версий и положение узоров совпадают со стандартом
+func TestTables(t *testing.T) {
+	assert.Equal(t, 19, dataCodewords(1, L))
+	assert.Equal(t, 9, dataCodewords(1, H))
+	assert.Equal(t, 216, dataCodewords(10, M))
+	assert.Equal(t, 2956, dataCodewords(40, L))
+	assert.Equal(t, 1276, dataCodewords(40, H))
+
+	assert.Nil(t, alignmentPositions(1))
+	assert.Equal(t, []int{6, 18}, alignmentPositions(2))
+	assert.Equal(t, []int{6, 22, 38}, alignmentPositions(7))
+	assert.Equal(t, []int{6, 34, 60, 86, 112, 138}, alignmentPositions(32))
+	assert.Equal(t, []int{6, 30, 58, 86, 114, 142, 170}, alignmentPositions(40))
+
+	assert.Equal(t, 0x77C4, formatBits(L, 0))
+	assert.Equal(t, 0x662F, formatBits(L, 4))
+	assert.Equal(t, 0x5412, formatBits(M, 0))
+	assert.Equal(t, 0x1689, formatBits(H, 0))
+
+	c := newCode(7, L)
+	c.drawVersion()
+	// 000111110010010100: младшие биты в верхнем левом углу блока
+	assert.False(t, c.modules[0][c.Size-11])
+	assert.False(t, c.modules[0][c.Size-10])
+	assert.True(t, c.modules[0][c.Size-9])
+	assert.True(t, c.modules[c.Size-9][0])
+}
+
+// TestEncode версия подбирается по длине данных
+func TestEncode(t *testing.T) {
+	c, err := Encode([]byte("http://localhost:8080/580c5ab5ef6a4f27b3da9956ae192f4f"), M)
+	require.NoError(t, err)
+	assert.Equal(t, 4, c.Version)
+	assert.Equal(t, 33, c.Size)
+
+	// поисковый узор и темный модуль
+	assert.True(t, c.Black(0, 0))
+	assert.False(t, c.Black(1, 1))
+	assert.True(t, c.Black(3, 3))
+	assert.True(t, c.Black(8, c.Size-8))
+	assert.False(t, c.Black(-1, 0))
+
+	c, err = Encode(make([]byte, 17), L)
+	require.NoError(t, err)
+	assert.Equal(t, 1, c.Version)
+
+	c, err = Encode(make([]byte, 18), L)
+	require.NoError(t, err)
+	assert.Equal(t, 2, c.Version)
+
+	c, err = Encode(make([]byte, 2953), L)
+	require.NoError(t, err)
+	assert.Equal(t, 40, c.Version)
+
+	_, err = Encode(make([]byte, 2954), L)
+	assert.ErrorIs(t, err, ErrTooLong)
+
+	_, err = ParseLevel("x")
+	assert.Error(t, err)
+	level, err := ParseLevel("q")
+	require.NoError(t, err)
+	assert.Equal(t, Q, level)
+}
+
+// TestGolden матрица целиком совпадает с эталонным кодировщиком
+// (github.com/skip2/go-qrcode) при тех же данных, версии, уровне и маске.
+// Маску задаем сами: правила штрафа у кодировщиков расходятся
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		data    string
+		version int
+		level   Level
+		mask    int
+		want    []string
+	}{
+		{
+			data:    "https://ya.ru",
+			version: 2,
+			level:   H,
+			mask:    7,
+			want: []string{
+				"#######.#...##.##.#######",
+				"#.....#.###..####.#.....#",
+				"#.###.#.....##.##.#.###.#",
+				"#.###.#.###.#.#.#.#.###.#",
+				"#.###.#.#.###.#.#.#.###.#",
+				"#.....#.#...#..#..#.....#",
+				"#######.#.#.#.#.#.#######",
+				"..........#..##.#........",
+				"...#..#....#...##..###.##",
+				"#..#.#.##..#..##.##.....#",
+				".##.###.#.####.##.#.#..##",
+				"#..#.#...#####..##.#.....",
+				"#..#.##...##.####.##.#.##",
+				".#.#...#...#####.###.##.#",
+				"#.##..#.###...###..##.#.#",
+				".#..##.####.....###.#..#.",
+				"##..#.#.##...##########..",
+				"........#..##.###...##..#",
+				"#######..##.#...#.#.##.##",
+				"#.....#..#..#####...###..",
+				"#.###.#..##.##..######...",
+				"#.###.#.#...###....#####.",
+				"#.###.#..##..#.#.#.##.#.#",
+				"#.....#.....#.#.#....#...",
+				"#######..#....###..#...##",
+			},
+		},
+		{
+			// с 7 версии в код пишется номер версии, блоки разной длины
+			data:    "http://localhost:8080/580c5ab5ef6a4f27b3da9956ae192f4f?utm_source=mail&utm_campaign=q1",
+			version: 7,
+			level:   Q,
+			mask:    2,
+			want: []string{
+				"#######.#...#...#.#.#.#....#.#####..#.#######",
+				"#.....#....##....#...#....#.#..##..#..#.....#",
+				"#.###.#..###......#.#.......###.##.#..#.###.#",
+				"#.###.#........######.#.##...###.#.##.#.###.#",
+				"#.###.#.#.##.###.#..#####...#.##..###.#.###.#",
+				"#.....#.###.##.#...##...###.##..#.....#.....#",
+				"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+				"..........##..#..####...##.##.#.##.##........",
+				".#######..#..#.#.##.#####......#.##....##...#",
+				"#####....#....#...#..#####..#.##...###.#....#",
+				"#.#####...#..#.##.#..####.##.#.####..##..###.",
+				"#....#.#..#.##.###..#.#..#..###.#.###.###.##.",
+				"#.#..##.#..##.###..##....#.#...#...#..#..#...",
+				"#..#...#..#.#.#.#....##.##..#.#.#...#...##.##",
+				"##.####..##...##....##.#####.#....#.###.####.",
+				"###.##..#.#.##....#..###.#.###.##.#.##.######",
+				"...##.###.#####...###.#.#.#..##...#..#...####",
+				".#.##.......#####.#.#....#.#.##.##..##..###.#",
+				".#...####.#...#.#.#.##.#.##.#..#.##...##..##.",
+				".###...###.#####.#.##...#...#######..#..###.#",
+				"#.#.#####..##...#.#.######...#...#..#####..#.",
+				"#...#...###.##....#.#...#....#####.##...#..##",
+				".##.#.#.##.##.....###.#.#...#..##.###.#.#.##.",
+				"#.#.#...###.#.#####.#...#..##.#.##..#...####.",
+				"#...#########.##.##.#####.#..#.#...#######.#.",
+				"######.....##.###........#...##..#..#.##..#.#",
+				"#..#..###...#..#...##.##..###..##.#..#...#.#.",
+				"##...#...###..#..#.##.#.###.#...##.#..#..##..",
+				"##....#..#.###.#...###....##..##.....#####.#.",
+				"#.##.#..#.###.###..#...#.####.##.#...##...###",
+				"#..#.###.....##...##.........#....#.##.......",
+				"...##....#..####..#.........######.#.##...##.",
+				".#.#.######.........#.#...##.#....#.....##...",
+				".#.##..#.#...##.##.#..#....#####....####....#",
+				"....#.#..#.####.....##.##.##...#.##..#.#.###.",
+				".####...#..##.#.##..#...##.#######.##.#...##.",
+				"#..##.#..#..##.##..######.#...#..#..######.#.",
+				"........###.#.#....##...#.##.###....#...##..#",
+				"#######.#.##...#.#.##.#.##.#....#####.#.##.#.",
+				"#.....#.#...#.##...##...#..##.#.#.###...###..",
+				"#.###.#.#..##.###..######.#..###..#.######..#",
+				"#.###.#.#.#..##..###....#.#..##....#....##.#.",
+				"#.###.#.#...#..#.###.#.....#...#.##.#....###.",
+				"#.....#.#..###.#.#.###.#.#..##..##..#..#.##..",
+				"#######..##.##..##.#.##.####.....#...##..###.",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		c := build([]byte(tt.data), tt.version, tt.level)
+		c.applyMask(tt.mask)
+		c.drawFormatBits(tt.mask)
+
+		got := make([]string, c.Size)
+		for y := range got {
+			var row strings.Builder
+			for x := 0; x < c.Size; x++ {
+				if c.Black(x, y) {
+					row.WriteByte('#')
+				} else {
+					row.WriteByte('.')
+				}
+			}
+			got[y] = row.String()
+		}
+
+		assert.Equal(t, tt.want, got, tt.data)
+	}
+}
+
+// TestRender картинки нужного размера, слишком маленький размер - ошибка
+func TestRender(t *testing.T) {
+	c, err := Encode([]byte("http://localhost/hash"), M)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.PNG(&buf, 100, 4))
+	img, err := png.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 100, img.Bounds().Dx())
+
+	// версия 2: 25 модулей и поля по 4, модуль 3px, лишний пиксель справа
+	r, _, _, _ := img.At(12, 12).RGBA()
+	assert.Equal(t, uint32(0), r)
+	r, _, _, _ = img.At(11, 11).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+
+	buf.Reset()
+	require.NoError(t, c.SVG(&buf, 100, 4))
+	assert.True(t, strings.HasPrefix(buf.String(), "<svg"))
+	assert.Contains(t, buf.String(), `viewBox="0 0 33 33"`)
+
+	assert.ErrorIs(t, c.PNG(&buf, 32, 4), ErrTooSmall)
+	assert.ErrorIs(t, c.SVG(&buf, 32, 4), ErrTooSmall)
+}
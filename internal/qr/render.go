@@ -0,0 +1,78 @@
+package qr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// ErrTooSmall в картинку заданного размера код не помещается
+var ErrTooSmall = errors.New("размер картинки меньше размера qr-кода")
+
+// Image картинка size x size пикселей с полями margin модулей.
+// Модуль - целое число пикселей, остаток размера уходит в поля
+func (c *Code) Image(size int, margin int) (image.Image, error) {
+	total := c.Size + 2*margin
+	scale := size / total
+	if scale < 1 || margin < 0 {
+		return nil, ErrTooSmall
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	offset := (size-scale*total)/2 + margin*scale
+
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				row := img.Pix[(offset+y*scale+dy)*img.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					row[offset+x*scale+dx] = 1
+				}
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// PNG пишет код в w картинкой png, см. Image
+func (c *Code) PNG(w io.Writer, size int, margin int) error {
+	img, err := c.Image(size, margin)
+	if err != nil {
+		return err
+	}
+
+	return png.Encode(w, img)
+}
+
+// SVG пишет код в w векторной картинкой size x size с полями margin модулей
+func (c *Code) SVG(w io.Writer, size int, margin int) error {
+	total := c.Size + 2*margin
+	if size < total || margin < 0 {
+		return ErrTooSmall
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, total, total)
+	fmt.Fprintf(bw, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, total, total)
+
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(bw, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+
+	bw.WriteString(`"/></svg>`)
+
+	return bw.Flush()
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// BloomFilter фильтр Блума по хешам ссылок. Отвечает "точно нет" или
+// "возможно есть" с долей ложных срабатываний, заданной при создании.
+//
+// Фильтр знает только ссылки, сохраненные через этот процесс, и те,
+// что были в хранилище при сборке. Если в ту же бд пишут другие
+// экземпляры сервиса, фильтр нужно выключить.
+type BloomFilter struct {
+	mx    sync.RWMutex
+	bits  []uint64
+	m     uint64
+	k     uint64
+	ready bool
+	// rejected сколько запросов отсечено фильтром
+	rejected int64
+}
+
+// NewBloomFilter фильтр на expectedItems элементов с долей ложных срабатываний falsePositiveRate.
+// Возвращает nil (фильтр выключен), если параметры не заданы
+func NewBloomFilter(expectedItems int, falsePositiveRate float64) *BloomFilter {
+	if expectedItems <= 0 || falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil
+	}
+
+	n := float64(expectedItems)
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+
+	return &BloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		m:    uint64(m),
+		k:    uint64(k),
+	}
+}
+
+// Add добавляет хеш в фильтр
+func (f *BloomFilter) Add(hash string) {
+	if f == nil {
+		return
+	}
+
+	h1, h2 := f.hashes(hash)
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain false - хеша точно нет. Пока фильтр не собран
+// или выключен, всегда отвечает true
+func (f *BloomFilter) MayContain(hash string) bool {
+	if f == nil {
+		return true
+	}
+
+	h1, h2 := f.hashes(hash)
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if !f.ready {
+		return true
+	}
+
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			f.rejected++
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetReady фильтр собран по всему хранилищу, ему можно верить
+func (f *BloomFilter) SetReady() {
+	if f == nil {
+		return
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.ready = true
+}
+
+// Rejected сколько запросов отсечено фильтром
+func (f *BloomFilter) Rejected() int64 {
+	if f == nil {
+		return 0
+	}
+
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+
+	return f.rejected
+}
+
+// hashes два независимых хеша для двойного хеширования
+func (f *BloomFilter) hashes(hash string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(hash))
+	h1 := h.Sum64()
+
+	h = fnv.New64()
+	h.Write([]byte(hash))
+	// нечетный шаг, чтобы обойти все биты
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
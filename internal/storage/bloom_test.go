@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBloomFilter нет ложноотрицательных ответов, ложноположительных - в пределах заданной доли
+func TestBloomFilter(t *testing.T) {
+	const items = 10000
+
+	filter := NewBloomFilter(items, 0.01)
+
+	for i := 0; i < items; i++ {
+		filter.Add(fmt.Sprintf("known-%d", i))
+	}
+
+	// пока фильтр не собран, он ничего не отсекает
+	assert.True(t, filter.MayContain("unknown"))
+	filter.SetReady()
+
+	for i := 0; i < items; i++ {
+		assert.True(t, filter.MayContain(fmt.Sprintf("known-%d", i)))
+	}
+
+	falsePositives := 0
+	for i := 0; i < items; i++ {
+		if filter.MayContain(fmt.Sprintf("unknown-%d", i)) {
+			falsePositives++
+		}
+	}
+
+	assert.Less(t, float64(falsePositives)/items, 0.02)
+	assert.Equal(t, int64(items-falsePositives), filter.Rejected())
+}
+
+// TestBloomFilterDisabled выключенный фильтр пропускает все
+func TestBloomFilterDisabled(t *testing.T) {
+	filter := NewBloomFilter(0, 0.01)
+
+	assert.Nil(t, filter)
+	filter.Add("hash")
+	filter.SetReady()
+	assert.True(t, filter.MayContain("unknown"))
+}
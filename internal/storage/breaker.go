@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+)
+
+// Состояния предохранителя
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker предохранитель для бд. После threshold ошибок подряд
+// размыкается и сразу отказывает, не дожидаясь таймаута соединения.
+// Через openTimeout пропускает halfOpenRequests пробных запросов:
+// если они прошли - замыкается, если нет - снова размыкается.
+type CircuitBreaker struct {
+	mx       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// пробные запросы в полуоткрытом состоянии
+	probes    int
+	successes int
+
+	threshold        int
+	openTimeout      time.Duration
+	halfOpenRequests int
+
+	now func() time.Time
+}
+
+// NewCircuitBreaker конструктор предохранителя. threshold <= 0 - предохранитель не размыкается
+func NewCircuitBreaker(threshold int, openTimeout time.Duration, halfOpenRequests int) *CircuitBreaker {
+	if halfOpenRequests < 1 {
+		halfOpenRequests = 1
+	}
+
+	return &CircuitBreaker{
+		state:            BreakerClosed,
+		threshold:        threshold,
+		openTimeout:      openTimeout,
+		halfOpenRequests: halfOpenRequests,
+		now:              time.Now,
+	}
+}
+
+// Allow разрешает запрос или возвращает ErrCircuitOpen
+func (b *CircuitBreaker) Allow() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return fmt.Errorf("%w", shortenerErrors.ErrCircuitOpen)
+	case BreakerHalfOpen:
+		if b.probes >= b.halfOpenRequests {
+			return fmt.Errorf("%w", shortenerErrors.ErrCircuitOpen)
+		}
+		b.probes++
+	}
+
+	return nil
+}
+
+// Done учитывает результат разрешенного запроса
+func (b *CircuitBreaker) Done(failed bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.threshold > 0 && b.failures >= b.threshold {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.halfOpenRequests {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+	}
+}
+
+// State текущее состояние предохранителя
+func (b *CircuitBreaker) State() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	// открытый предохранитель с истекшим таймаутом пропустит следующий запрос
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+// open размыкает предохранитель. Вызывается под b.mx
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+	b.failures = 0
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCircuitBreaker closed -> open -> half-open -> closed/open
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute, 1)
+	breaker.now = func() time.Time { return now }
+
+	require.NoError(t, breaker.Allow())
+	breaker.Done(true)
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	require.NoError(t, breaker.Allow())
+	breaker.Done(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	err := breaker.Allow()
+	assert.True(t, errors.Is(err, shortenerErrors.ErrCircuitOpen))
+
+	// таймаут прошел - пропускаем один пробный запрос
+	now = now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	require.NoError(t, breaker.Allow())
+	assert.True(t, errors.Is(breaker.Allow(), shortenerErrors.ErrCircuitOpen))
+
+	// пробный запрос упал - снова размыкаемся
+	breaker.Done(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.Allow())
+	breaker.Done(false)
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
+
+// TestDBRepositoryBreaker недоступная бд размыкает предохранитель
+func TestDBRepositoryBreaker(t *testing.T) {
+	repo := newTestSQLiteRepository(t)
+	repo.breaker = NewCircuitBreaker(2, time.Minute, 1)
+	ctx := context.Background()
+
+	require.NoError(t, repo.DB.Close())
+
+	for i := 0; i < 2; i++ {
+		_, _, err := repo.FindByHash(ctx, "hash")
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, shortenerErrors.ErrCircuitOpen))
+	}
+
+	assert.Equal(t, BreakerOpen, repo.BreakerState())
+
+	err := repo.Ping(ctx)
+	assert.True(t, errors.Is(err, shortenerErrors.ErrCircuitOpen))
+}
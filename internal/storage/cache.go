@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// urlCache LRU кеш ссылок по хешу с ограниченным временем жизни записей
+type urlCache struct {
+	mx       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	items    map[string]*list.Element
+	order    *list.List
+
+	hits   int64
+	misses int64
+
+	// generation растет на каждой инвалидации. Поиск, начатый до нее,
+	// мог прочитать старое значение - такое в кеш не кладем
+	generation uint64
+
+	now func() time.Time
+}
+
+// cacheEntry запись кеша. Храним копию, чтобы вызывающие не меняли кеш
+type cacheEntry struct {
+	hash      string
+	url       types.URL
+	expiresAt time.Time
+}
+
+// newURLCache конструктор кеша. capacity <= 0 - кеш выключен
+func newURLCache(capacity int, ttl time.Duration) *urlCache {
+	return &urlCache{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get возвращает ссылку из кеша
+func (c *urlCache) Get(hash string) (*types.URL, bool) {
+	if c.capacity <= 0 {
+		return nil, false
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	el, ok := c.items[hash]
+	if ok && c.ttl > 0 && c.now().After(el.Value.(*cacheEntry).expiresAt) {
+		c.removeElement(el)
+		ok = false
+	}
+
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(el)
+	url := el.Value.(*cacheEntry).url
+
+	return &url, true
+}
+
+// Generation текущее поколение кеша. Читается до поиска ссылки в хранилище
+func (c *urlCache) Generation() uint64 {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.generation
+}
+
+// Add кладет ссылку в кеш, вытесняя самую давно использованную. Ссылка,
+// найденная в поколении generation, не кладется, если с тех пор была инвалидация
+func (c *urlCache) Add(url *types.URL, generation uint64) {
+	if c.capacity <= 0 || url == nil {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	entry := &cacheEntry{
+		hash:      url.Hash,
+		url:       *url,
+		expiresAt: c.now().Add(c.ttl),
+	}
+
+	if el, ok := c.items[url.Hash]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[url.Hash] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Remove убирает ссылки из кеша
+func (c *urlCache) Remove(hashes ...string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.generation++
+	for _, hash := range hashes {
+		if el, ok := c.items[hash]; ok {
+			c.removeElement(el)
+		}
+	}
+}
+
+// Purge очищает кеш
+func (c *urlCache) Purge() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.generation++
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// Stats счетчики попаданий и промахов
+func (c *urlCache) Stats() (hits int64, misses int64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.hits, c.misses
+}
+
+// removeElement вызывается под c.mx
+func (c *urlCache) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).hash)
+}
+
+// flightGroup объединяет одновременные запросы одной ссылки:
+// в хранилище уходит один запрос, остальные ждут его результат
+type flightGroup struct {
+	mx    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall запрос, который выполняется прямо сейчас
+type flightCall struct {
+	wg    sync.WaitGroup
+	exist bool
+	url   *types.URL
+	err   error
+}
+
+// Do выполняет fn для hash, если такой запрос еще не выполняется,
+// иначе дожидается результата уже запущенного. shared - результат чужой
+func (g *flightGroup) Do(hash string, fn func() (bool, *types.URL, error)) (exist bool, url *types.URL, shared bool, err error) {
+	g.mx.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+
+	if call, ok := g.calls[hash]; ok {
+		g.mx.Unlock()
+		call.wg.Wait()
+		return call.exist, call.url, true, call.err
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[hash] = call
+	g.mx.Unlock()
+
+	call.exist, call.url, call.err = fn()
+	call.wg.Done()
+
+	g.mx.Lock()
+	delete(g.calls, hash)
+	g.mx.Unlock()
+
+	return call.exist, call.url, false, call.err
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestURLCache вытеснение, время жизни, инвалидация и счетчики
+func TestURLCache(t *testing.T) {
+	now := time.Now()
+	cache := newURLCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.Add(&types.URL{Hash: "hash-1", URL: "http://yandex.ru/1"}, cache.Generation())
+	cache.Add(&types.URL{Hash: "hash-2", URL: "http://yandex.ru/2"}, cache.Generation())
+
+	url, ok := cache.Get("hash-1")
+	require.True(t, ok)
+	assert.Equal(t, "http://yandex.ru/1", url.URL)
+
+	// hash-2 давно не использовали - вытесняется
+	cache.Add(&types.URL{Hash: "hash-3", URL: "http://yandex.ru/3"}, cache.Generation())
+	_, ok = cache.Get("hash-2")
+	assert.False(t, ok)
+
+	// найденное до инвалидации в кеш не попадает
+	generation := cache.Generation()
+	cache.Remove("hash-3")
+	cache.Add(&types.URL{Hash: "hash-3", URL: "http://yandex.ru/3"}, generation)
+	_, ok = cache.Get("hash-3")
+	assert.False(t, ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.Get("hash-1")
+	assert.False(t, ok)
+
+	hits, misses := cache.Stats()
+	assert.Equal(t, int64(1), hits)
+	assert.Equal(t, int64(3), misses)
+}
+
+// TestFlightGroup одновременные запросы одного хеша выполняются один раз
+func TestFlightGroup(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exist, url, _, err := group.Do("hash", func() (bool, *types.URL, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return true, &types.URL{Hash: "hash"}, nil
+			})
+			assert.NoError(t, err)
+			assert.True(t, exist)
+			assert.Equal(t, "hash", url.Hash)
+		}()
+	}
+
+	// ждем, пока первый запрос не начнется, и даем остальным к нему присоединиться
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// TestFindByHashConcurrentUpdate поиск, который прочитал ссылку до ее
+// изменения, не оставляет в кеше старый адрес
+func TestFindByHashConcurrentUpdate(t *testing.T) {
+	st, err := NewStorage(&types.Config{
+		DBPath:    filepath.Join(t.TempDir(), "db"),
+		CacheSize: 10,
+		CacheTTL:  types.Duration{Duration: time.Hour},
+	})
+	require.NoError(t, err)
+	defer st.Close()
+	s := st.(*storage)
+	ctx := context.Background()
+
+	require.NoError(t, s.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru/old"}))
+
+	// поиск прочитал ссылку и ждет, пока ее изменят
+	read := make(chan struct{})
+	release := make(chan struct{})
+	s.find = func(ctx context.Context, hash string) (bool, *types.URL, error) {
+		exist, url, err := s.findByHash(ctx, hash)
+		close(read)
+		<-release
+		return exist, url, err
+	}
+
+	done := make(chan *types.URL)
+	go func() {
+		_, url, err := s.FindByHash(ctx, "hash-1")
+		assert.NoError(t, err)
+		done <- url
+	}()
+
+	<-read
+	destination := "http://yandex.ru/new"
+	_, err = s.UpdateURL(ctx, "user-1", "hash-1", types.URLUpdate{URL: &destination})
+	require.NoError(t, err)
+	close(release)
+
+	// ответ поиска, начатого до изменения, - старый, но в кеш он не попал
+	assert.Equal(t, "http://yandex.ru/old", (<-done).URL)
+	s.find = s.findByHash
+
+	_, url, err := s.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.Equal(t, destination, url.URL)
+}
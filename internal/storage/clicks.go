@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// clickCounter копит переходы по ссылкам и пачкой пишет их в бд,
+// чтобы редирект не ждал записи
+type clickCounter struct {
+	mx      sync.Mutex
+	pending map[string]int64
+	db      *DBRepository
+}
+
+func newClickCounter(db *DBRepository) *clickCounter {
+	return &clickCounter{
+		pending: map[string]int64{},
+		db:      db,
+	}
+}
+
+// Add учитывает переход по ссылке hash
+func (c *clickCounter) Add(hash string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.pending[hash]++
+}
+
+// Flush пишет накопленные переходы в бд. Если запись не прошла,
+// переходы возвращаются в очередь до следующей попытки
+func (c *clickCounter) Flush(ctx context.Context) error {
+	c.mx.Lock()
+	pending := c.pending
+	c.pending = map[string]int64{}
+	c.mx.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := c.db.AddClicks(ctx, pending)
+	if err == nil {
+		return nil
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for hash, clicks := range pending {
+		c.pending[hash] += clicks
+	}
+
+	return err
+}
+
+// Run сбрасывает переходы в бд раз в interval, пока не отменен ctx
+func (c *clickCounter) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Printf("Не удалось записать переходы по ссылкам. %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// Слои хранилища
+const (
+	TierMemory = "memory"
+	TierFile   = "file"
+	TierDB     = "db"
+)
+
+// Виды расхождений
+const (
+	ProblemMissing     = "missing"
+	ProblemConflicting = "conflicting"
+	ProblemDiffering   = "differing"
+)
+
+// maxConsistencyRecords сколько расхождений попадает в отчет
+const maxConsistencyRecords = 100
+
+// tierSnapshot ссылки слоя по хешу. Из повторов хеша берется первый, как в FindByHash
+type tierSnapshot map[string]*types.URL
+
+// CheckConsistency сверяет слои хранилища по хешам. В памяти лежат только
+// ссылки, созданные после запуска, поэтому ее отсутствие расхождением не
+// считается, а сверяются только те ссылки, что в ней есть.
+//
+// Удаление хранится только в бд, поэтому ссылка, удаленная только в бд,
+// расхождением не считается.
+//
+// repair - исправить расхождения по слою source: недостающие ссылки
+// дописываются в слои, у остальных по эталону переписываются только
+// владелец, урл и удаление. Если в эталоне хеша нет, эталоном служит
+// первый слой, где он есть, в порядке бд, файл, память. Ссылки не
+// удаляются ни из одного слоя, удаление в бд не отменяется
+func (s *storage) CheckConsistency(ctx context.Context, source string, repair bool) (report types.ConsistencyReport, err error) {
+	report.Missing = map[string]int{}
+
+	tiers := []string{TierFile, TierMemory}
+	if s.dbEnabled() {
+		tiers = []string{TierDB, TierFile, TierMemory}
+	}
+
+	if repair {
+		if !containsTier(tiers, source) {
+			return report, fmt.Errorf("неизвестный или выключенный слой %q", source)
+		}
+		report.Source = source
+	}
+
+	snapshots, err := s.snapshot(ctx, tiers)
+	if err != nil {
+		return report, err
+	}
+
+	hashes := map[string]bool{}
+	for _, snapshot := range snapshots {
+		for hash := range snapshot {
+			hashes[hash] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(hashes))
+	for hash := range hashes {
+		sorted = append(sorted, hash)
+	}
+	sort.Strings(sorted)
+
+	fileFixes := map[string]*types.URL{}
+	var dbFixes []*types.URL
+	var repaired []string
+
+	for _, hash := range sorted {
+		report.Checked++
+
+		record := types.ConsistencyRecord{Hash: hash, Tiers: map[string]types.ConsistencyState{}}
+		var present []*types.URL
+
+		for _, tier := range tiers {
+			url, ok := snapshots[tier][hash]
+			if !ok {
+				if tier != TierMemory {
+					report.Missing[tier]++
+					record.Problems = appendProblem(record.Problems, ProblemMissing)
+				}
+				continue
+			}
+
+			state := types.ConsistencyState{UUID: url.UUID, URL: url.URL}
+			if url.DeletedAt.Valid {
+				state.DeletedAt = url.DeletedAt.Time.UTC().Format(time.RFC3339)
+			}
+			record.Tiers[tier] = state
+			present = append(present, url)
+		}
+
+		dbURL, inDB := snapshots[TierDB][hash]
+		for _, url := range present[1:] {
+			if url.UUID != present[0].UUID || url.URL != present[0].URL {
+				record.Problems = appendProblem(record.Problems, ProblemConflicting)
+			}
+			// удаленная только в бд ссылка - обычное состояние
+			if inDB && dbURL.DeletedAt.Valid && !url.DeletedAt.Valid {
+				continue
+			}
+			if url.DeletedAt.Valid != present[0].DeletedAt.Valid {
+				record.Problems = appendProblem(record.Problems, ProblemDiffering)
+			}
+		}
+
+		if len(record.Problems) == 0 {
+			continue
+		}
+
+		for _, problem := range record.Problems {
+			switch problem {
+			case ProblemConflicting:
+				report.Conflicting++
+			case ProblemDiffering:
+				report.Differing++
+			}
+		}
+		if len(report.Records) < maxConsistencyRecords {
+			report.Records = append(report.Records, record)
+		}
+
+		if !repair {
+			continue
+		}
+
+		truth, ok := snapshots[source][hash]
+		if !ok {
+			truth = present[0]
+		}
+
+		fixed := false
+		for _, tier := range tiers {
+			url, ok := snapshots[tier][hash]
+
+			// память не дополняем, только исправляем
+			if !ok && tier == TierMemory {
+				continue
+			}
+
+			fix := repairedURL(tier, url, truth)
+			if fix == nil {
+				continue
+			}
+
+			switch tier {
+			case TierDB:
+				dbFixes = append(dbFixes, fix)
+			case TierFile:
+				fileFixes[hash] = fix
+			case TierMemory:
+				s.repositories.memory.Put(fix)
+			}
+			fixed = true
+		}
+
+		if fixed {
+			repaired = append(repaired, hash)
+		}
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	defer s.cache.Remove(repaired...)
+
+	if len(fileFixes) > 0 {
+		if err = s.repositories.file.Rewrite(ctx, fileFixes); err != nil {
+			return report, err
+		}
+	}
+
+	if len(dbFixes) > 0 {
+		if err = s.repositories.db.Repair(ctx, dbFixes); err != nil {
+			return report, err
+		}
+	}
+
+	report.Repaired = len(repaired)
+
+	return report, nil
+}
+
+// snapshot читает слои целиком
+func (s *storage) snapshot(ctx context.Context, tiers []string) (map[string]tierSnapshot, error) {
+	snapshots := map[string]tierSnapshot{}
+
+	for _, tier := range tiers {
+		snapshot := tierSnapshot{}
+		collect := func(url *types.URL) error {
+			if _, ok := snapshot[url.Hash]; !ok {
+				snapshot[url.Hash] = url
+			}
+			return nil
+		}
+
+		var err error
+		switch tier {
+		case TierDB:
+			err = s.repositories.db.Export(ctx, "", collect)
+		case TierFile:
+			err = s.repositories.file.Export(ctx, "", collect)
+		case TierMemory:
+			err = s.repositories.memory.Walk(ctx, func(url *types.URL) error {
+				u := *url
+				return collect(&u)
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("слой %s: %w", tier, err)
+		}
+
+		snapshots[tier] = snapshot
+	}
+
+	return snapshots, nil
+}
+
+// repairedURL ссылка url слоя tier, исправленная по эталону truth.
+// Меняются только владелец, урл и удаление, счетчики и описание
+// остаются как в слое. url nil - в слое ссылки нет, берется эталон
+// целиком. nil - исправлять нечего
+func repairedURL(tier string, url *types.URL, truth *types.URL) *types.URL {
+	if url == nil {
+		fix := *truth
+		return &fix
+	}
+
+	fix := *url
+	fix.UUID = truth.UUID
+	fix.URL = truth.URL
+	// удаление в бд не отменяем: в других слоях его нет
+	if tier != TierDB || !url.DeletedAt.Valid {
+		fix.DeletedAt = truth.DeletedAt
+	}
+
+	if sameURL(&fix, url) {
+		return nil
+	}
+
+	return &fix
+}
+
+// sameURL совпадают ли владелец, урл и удаление
+func sameURL(a *types.URL, b *types.URL) bool {
+	return a.UUID == b.UUID && a.URL == b.URL && a.DeletedAt.Valid == b.DeletedAt.Valid
+}
+
+func containsTier(tiers []string, tier string) bool {
+	for _, t := range tiers {
+		if t == tier {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendProblem(problems []string, problem string) []string {
+	for _, p := range problems {
+		if p == problem {
+			return problems
+		}
+	}
+
+	return append(problems, problem)
+}
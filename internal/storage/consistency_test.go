@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckConsistency расхождения файла и бд находятся и исправляются по файлу
+func TestCheckConsistency(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewStorage(&types.Config{
+		DBPath:      filepath.Join(dir, "db"),
+		DatabaseDsn: sqliteScheme + filepath.Join(dir, "shortener.db"),
+		OutboxPath:  filepath.Join(dir, "outbox"),
+	})
+	require.NoError(t, err)
+	defer st.Close()
+
+	s := st.(*storage)
+	ctx := context.Background()
+
+	// во всех слоях, потом удалена - удаление дошло только до бд
+	require.NoError(t, s.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"}))
+	require.NoError(t, s.DeleteByHash(ctx, "user-1", []string{"hash-1"}))
+
+	// только в файле
+	require.NoError(t, s.repositories.file.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-2", URL: "http://yandex.ru?x=2"}))
+
+	// разные владельцы
+	require.NoError(t, s.repositories.file.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-3", URL: "http://yandex.ru?x=3"}))
+	_, err = s.repositories.db.Import(ctx, []*types.URL{{UUID: "user-2", Hash: "hash-3", URL: "http://yandex.ru?x=3", Title: "title", Clicks: 5}})
+	require.NoError(t, err)
+
+	// удалена в файле, но не в бд
+	require.NoError(t, s.repositories.file.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-4", URL: "http://yandex.ru?x=4",
+		DeletedAt: sql.NullTime{Time: time.Now(), Valid: true}}))
+	_, err = s.repositories.db.Import(ctx, []*types.URL{{UUID: "user-1", Hash: "hash-4", URL: "http://yandex.ru?x=4"}})
+	require.NoError(t, err)
+
+	report, err := s.CheckConsistency(ctx, "", false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Checked)
+	assert.Equal(t, 1, report.Missing[TierDB])
+	assert.Equal(t, 0, report.Missing[TierFile])
+	assert.Equal(t, 1, report.Conflicting)
+	assert.Equal(t, 1, report.Differing)
+	require.Len(t, report.Records, 3)
+	assert.Equal(t, "hash-2", report.Records[0].Hash)
+	assert.Equal(t, []string{ProblemDiffering}, report.Records[2].Problems)
+	assert.Equal(t, 0, report.Repaired)
+
+	_, err = s.CheckConsistency(ctx, "cache", true)
+	require.Error(t, err)
+
+	report, err = s.CheckConsistency(ctx, TierFile, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Repaired)
+
+	report, err = s.CheckConsistency(ctx, "", false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Records)
+
+	// удаление в бд не отменилось
+	_, url, err := s.repositories.db.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.True(t, url.DeletedAt.Valid)
+
+	// поменялся только владелец
+	_, url, err = s.repositories.db.FindByHash(ctx, "hash-3")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", url.UUID)
+	assert.Equal(t, "title", url.Title)
+	assert.Equal(t, int64(5), url.Clicks)
+
+	_, url, err = s.repositories.db.FindByHash(ctx, "hash-4")
+	require.NoError(t, err)
+	assert.True(t, url.DeletedAt.Valid)
+
+	exist, _, err := s.repositories.db.FindByHash(ctx, "hash-2")
+	require.NoError(t, err)
+	assert.True(t, exist)
+}
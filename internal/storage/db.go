@@ -2,33 +2,72 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"log"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	//_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 )
 
+// urlColumns колонки таблицы urls, которые читаем в types.URL
+const urlColumns = "hash, uuid, url, short_url, created_at, updated_at, deleted_at, expires_at, active_from, clicks, max_clicks, title, notes, tags, password_hash, redirect_code, query_passthrough"
+
+// insertColumns колонки, которые пишутся при вставке ссылки, в порядке insertValues
+var insertColumns = []string{"hash", "uuid", "url", "short_url", "domain", "created_at", "updated_at",
+	"deleted_at", "expires_at", "active_from", "clicks", "max_clicks", "title", "notes", "tags", "password_hash",
+	"redirect_code", "query_passthrough"}
+
+// insertValues значения ссылки в порядке insertColumns
+func insertValues(url *types.URL) []interface{} {
+	return []interface{}{url.Hash, url.UUID, url.URL, url.ShortURL, url.Domain, url.CreatedAt, url.UpdatedAt,
+		url.DeletedAt, url.ExpiresAt, url.ActiveFrom, url.Clicks, url.MaxClicks, url.Title, url.Notes, url.Tags,
+		url.PasswordHash, url.RedirectCode, url.QueryPassthrough}
+}
+
+// insertURL вставка ссылки со всеми полями
+var insertURL = "INSERT INTO urls (" + strings.Join(insertColumns, ", ") + ") VALUES (:" + strings.Join(insertColumns, ", :") + ")"
+
 type DBRepository struct {
 	DB  *sqlx.DB
 	cfg *types.Config
+	// driver имя драйвера database/sql: postgres или sqlite3
+	driver string
+	// breaker размыкается, когда бд перестает отвечать
+	breaker *CircuitBreaker
+	// replicas реплики для чтения. Пусто - читаем из основной бд
+	replicas []*replica
+	// next номер реплики для следующего чтения
+	next uint32
+}
+
+// replica реплика бд только для чтения со своим предохранителем
+type replica struct {
+	db      *sqlx.DB
+	breaker *CircuitBreaker
 }
 
 func NewDBRepository(cfg *types.Config) *DBRepository {
-	repo := &DBRepository{
-		cfg: cfg,
-		DB:  nil,
+	// sqlite:///path/db - встроенная база
+	if isSQLiteDsn(cfg.DatabaseDsn) {
+		return NewSQLiteRepository(cfg, sqlitePath(cfg.DatabaseDsn))
 	}
 
+	repo := newDBRepository(cfg, "postgres")
+
 	if cfg.DatabaseDsn != "" {
-		db, err := sqlx.Open("postgres", cfg.DatabaseDsn) // mysql || postgres
+		db, err := sqlx.Open(repo.driver, cfg.DatabaseDsn) // mysql || postgres
 		if err == nil {
+			configurePool(db, cfg)
 			repo.DB = db
 			repo.migrate()
 		} else {
@@ -36,193 +75,1324 @@ func NewDBRepository(cfg *types.Config) *DBRepository {
 		}
 	}
 
+	// Реплики имеют смысл только при основной бд
+	for _, dsn := range cfg.DatabaseReplicaDsns {
+		if repo.DB == nil || dsn == "" {
+			break
+		}
+
+		db, err := sqlx.Open(repo.driver, dsn)
+		if err != nil {
+			log.Printf("Не удалось подключить реплику. %s", err)
+			continue
+		}
+		configurePool(db, cfg)
+		repo.addReplica(db)
+	}
+
 	return repo
 }
 
-func (r *DBRepository) Save(url *types.URL) (err error) {
+// configurePool применяет настройки пула соединений из конфига.
+// Незаданные (нулевые) настройки оставляем по умолчанию database/sql
+func configurePool(db *sqlx.DB, cfg *types.Config) {
+	if cfg.DBMaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	}
+	if cfg.DBMaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	}
+	if cfg.DBConnMaxLifetime.Duration > 0 {
+		db.SetConnMaxLifetime(cfg.DBConnMaxLifetime.Duration)
+	}
+	if cfg.DBConnMaxIdleTime.Duration > 0 {
+		db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime.Duration)
+	}
+}
+
+// addReplica добавляет реплику для чтения
+func (r *DBRepository) addReplica(db *sqlx.DB) {
+	r.replicas = append(r.replicas, &replica{
+		db:      db,
+		breaker: NewCircuitBreaker(r.cfg.DBBreakerThreshold, r.cfg.DBBreakerOpenTimeout.Duration, r.cfg.DBBreakerHalfOpenRequests),
+	})
+}
+
+// newDBRepository репозиторий без подключения к бд
+func newDBRepository(cfg *types.Config, driver string) *DBRepository {
+	return &DBRepository{
+		cfg:     cfg,
+		DB:      nil,
+		driver:  driver,
+		breaker: NewCircuitBreaker(cfg.DBBreakerThreshold, cfg.DBBreakerOpenTimeout.Duration, cfg.DBBreakerHalfOpenRequests),
+	}
+}
+
+func (r *DBRepository) Save(ctx context.Context, url *types.URL) (err error) {
 	if r.DB == nil {
 		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
 	}
 
-	rows, err := r.DB.NamedQuery(
-		"SELECT * FROM urls u WHERE u.hash = :hash LIMIT 1",
-		map[string]interface{}{"hash": url.Hash},
-	)
-	defer func(rows *sqlx.Rows) {
-		err := rows.Close()
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	return r.do(ctx, func(ctx context.Context) error {
+		// только что сохраненная ссылка могла еще не доехать до реплик - проверяем в основной бд
+		exist, _, err := r.findByHash(ctx, r.DB, url.Hash)
 		if err != nil {
 			log.Println(err)
+			return err
 		}
-	}(rows)
 
-	if rows.Err() != nil {
-		fmt.Println(err)
-		return err
-	}
+		if exist { // такой url есть - дубль
+			return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
+		}
 
-	u := types.URL{}
-	if rows.Next() && rows.StructScan(&u) == nil { // такой url есть - дубль
-		return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
-	}
+		// Новый url - сохраняем
+		withDomain(url)
+		_, err = r.DB.NamedExecContext(ctx, insertURL, url)
 
-	// Новый url - сохраняем
-	_, err = r.DB.NamedExec(`INSERT INTO urls (hash, uuid, url, short_url)
-		VALUES (:hash, :uuid, :url, :short_url)`, url)
+		// параллельный запрос успел сохранить такой же url
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
+		}
 
-	return err
+		return err
+	})
 }
 
-func (r *DBRepository) SaveBatch(url []*types.URL) (err error) {
+func (r *DBRepository) SaveBatch(ctx context.Context, url []*types.URL) (err error) {
 	if r.DB == nil {
 		err = errors.New("нет подключения к бд")
 		return
 	}
 
-	_, err = r.DB.NamedExec(`INSERT INTO urls (hash, uuid, url, short_url)
-	  VALUES (:hash, :uuid, :url, :short_url)`, url)
+	if len(url) == 0 {
+		return nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
 
-	return err
-}
+	withDomain(url...)
 
-func (r *DBRepository) FindByHash(hash string) (exist bool, url *types.URL, err error) {
+	return r.do(ctx, func(ctx context.Context) error {
+		_, err := r.DB.NamedExecContext(ctx, insertURL, url)
 
+		// один из хешей уже занят - пачка не записана
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
+		}
+
+		return err
+	})
+}
+
+// Import вставляет пачку ссылок одной транзакцией, пропуская хеши, которые
+// уже есть в бд. Время создания и удаления переносятся как есть. В postgres пачка заливается через COPY во временную таблицу,
+// в sqlite - подготовленным запросом. Возвращает число вставленных ссылок
+func (r *DBRepository) Import(ctx context.Context, urls []*types.URL) (int, error) {
 	if r.DB == nil {
-		exist = false
-		url = nil
-		err = errors.New("нет подключения к бд")
-		return
+		return 0, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
 	}
 
-	rows, err := r.DB.NamedQuery(
-		"SELECT * FROM urls u WHERE u.hash = :hash LIMIT 1",
-		map[string]interface{}{"hash": hash},
-	)
-	defer func(rows *sqlx.Rows) {
-		err := rows.Close()
+	if len(urls) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	withDomain(urls...)
+	created := 0
+	err := r.do(ctx, func(ctx context.Context) error {
+		tx, err := r.DB.BeginTxx(ctx, nil)
 		if err != nil {
-			log.Println(err)
+			return err
 		}
-	}(rows)
+		defer tx.Rollback()
 
-	if rows.Err() != nil {
-		exist = false
-		return
+		if r.driver == "postgres" {
+			created, err = r.copyIn(ctx, tx, urls)
+		} else {
+			created, err = r.insertMissing(ctx, tx, urls)
+		}
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return created, nil
+}
+
+// copyIn заливает ссылки через COPY во временную таблицу и переносит в urls те,
+// хешей которых еще нет. Повторы внутри пачки схлопываются до первого:
+// line - номер ссылки в пачке, по нему DISTINCT ON выбирает строку
+func (r *DBRepository) copyIn(ctx context.Context, tx *sqlx.Tx, urls []*types.URL) (int, error) {
+	_, err := tx.ExecContext(ctx, `CREATE TEMP TABLE urls_import (LIKE urls INCLUDING DEFAULTS, line bigint not null) ON COMMIT DROP`)
+	if err != nil {
+		return 0, err
+	}
+
+	copyColumns := append(append([]string{}, insertColumns...), "line")
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("urls_import", copyColumns...))
+	if err != nil {
+		return 0, err
+	}
+
+	for line, url := range urls {
+		if _, err = stmt.ExecContext(ctx, append(insertValues(url), line)...); err != nil {
+			stmt.Close()
+			return 0, err
+		}
+	}
+
+	// пустой Exec дописывает буфер COPY
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	if err = stmt.Close(); err != nil {
+		return 0, err
+	}
+
+	columns := strings.Join(insertColumns, ", ")
+	res, err := tx.ExecContext(ctx, `INSERT INTO urls (`+columns+`)
+		SELECT DISTINCT ON (hash) `+columns+` FROM urls_import i
+		WHERE NOT EXISTS (SELECT 1 FROM urls u WHERE u.hash = i.hash)
+		ORDER BY hash, line
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return 0, err
 	}
 
-	if rows.Next() {
-		url = &types.URL{}
-		err = rows.StructScan(url)
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// insertMissing вставляет ссылки по одной, пропуская уже существующие хеши
+func (r *DBRepository) insertMissing(ctx context.Context, tx *sqlx.Tx, urls []*types.URL) (int, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(insertColumns)), ", ")
+	stmt, err := tx.PreparexContext(ctx, tx.Rebind(`INSERT INTO urls (`+strings.Join(insertColumns, ", ")+`)
+		SELECT `+placeholders+` WHERE NOT EXISTS (SELECT 1 FROM urls WHERE hash = ?)`))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	created := 0
+	for _, url := range urls {
+		res, err := stmt.ExecContext(ctx, append(insertValues(url), url.Hash)...)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := res.RowsAffected()
 		if err != nil {
-			exist = false
+			return 0, err
 		}
-		exist = true
+		created += int(n)
 	}
 
-	return
+	return created, nil
 }
 
-func (r *DBRepository) FindByUUID(uuid string) (exist bool, urls map[string]*types.URL, err error) {
+// Replace записывает ссылки вместо всех строк с теми же хешами
+func (r *DBRepository) Replace(ctx context.Context, urls []*types.URL) error {
 	if r.DB == nil {
-		exist = false
-		urls = nil
-		err = errors.New("нет подключения к бд")
-		return
+		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
 	}
 
-	rows, err := r.DB.NamedQuery(
-		"SELECT hash, uuid, url, short_url FROM urls u where u.`uuid` = :uuid",
-		map[string]interface{}{"uuid": uuid},
-	)
-	defer func(rows *sqlx.Rows) {
-		err := rows.Close()
+	if len(urls) == 0 {
+		return nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	withDomain(urls...)
+
+	return r.do(ctx, func(ctx context.Context) error {
+		tx, err := r.DB.BeginTxx(ctx, nil)
 		if err != nil {
-			log.Println(err)
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, url := range urls {
+			if _, err = tx.ExecContext(ctx, tx.Rebind("DELETE FROM urls WHERE hash = ?"), url.Hash); err != nil {
+				return err
+			}
+
+			if _, err = tx.NamedExecContext(ctx, insertURL, url); err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
+}
+
+// Repair исправляет у ссылок владельца, урл и удаление. Остальные поля
+// строки не меняются. Ссылки, которых в бд нет, вставляются целиком
+func (r *DBRepository) Repair(ctx context.Context, urls []*types.URL) error {
+	if r.DB == nil {
+		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	withDomain(urls...)
+
+	return r.do(ctx, func(ctx context.Context) error {
+		tx, err := r.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, url := range urls {
+			result, err := tx.ExecContext(ctx, tx.Rebind("UPDATE urls SET uuid = ?, url = ?, domain = ?, deleted_at = ? WHERE hash = ?"),
+				url.UUID, url.URL, url.Domain, url.DeletedAt, url.Hash)
+			if err != nil {
+				return err
+			}
+
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if updated > 0 {
+				continue
+			}
+
+			if _, err = tx.NamedExecContext(ctx, insertURL, url); err != nil {
+				return err
+			}
 		}
-	}(rows)
 
-	if rows.Err() != nil {
+		return tx.Commit()
+	})
+}
+
+func (r *DBRepository) FindByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error) {
+
+	if r.DB == nil {
 		exist = false
+		url = nil
+		err = errors.New("нет подключения к бд")
 		return
 	}
 
-	urls = map[string]*types.URL{}
-	err = rows.StructScan(&urls)
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBReadTimeout)
+	defer cancel()
 
-	return
+	err = r.read(ctx, func(ctx context.Context, db *sqlx.DB) (err error) {
+		exist, url, err = r.findByHash(ctx, db, hash)
+		return err
+	})
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	return exist, url, nil
+}
+
+// findByHash запрос ссылки по хешу в db без предохранителя
+func (r *DBRepository) findByHash(ctx context.Context, db *sqlx.DB, hash string) (exist bool, url *types.URL, err error) {
+	url = &types.URL{}
+	err = db.GetContext(ctx, url, db.Rebind("SELECT "+urlColumns+" FROM urls u WHERE u.hash = ? LIMIT 1"), hash)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil, nil
+	}
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, url, nil
 }
 
-func (r *DBRepository) DeleteByHash(hashes []string) (err error) {
+func (r *DBRepository) FindByUUID(ctx context.Context, uuid string) (exist bool, urls map[string]*types.URL, err error) {
 	if r.DB == nil {
+		exist = false
+		urls = nil
 		err = errors.New("нет подключения к бд")
 		return
 	}
 
-	sql := fmt.Sprintf(
-		"UPDATE urls SET deleted_at = NOW() WHERE hash IN ('%s')",
-		strings.Join(hashes, "','"),
-	)
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBReadTimeout)
+	defer cancel()
 
-	_, err = r.DB.Exec(sql)
+	var items []*types.URL
+	err = r.read(ctx, func(ctx context.Context, db *sqlx.DB) error {
+		items = nil
+		return db.SelectContext(ctx, &items, db.Rebind("SELECT "+urlColumns+" FROM urls u WHERE u.uuid = ?"), uuid)
+	})
+	if err != nil {
+		return false, nil, err
+	}
 
-	fmt.Println(err)
+	urls = map[string]*types.URL{}
+	for _, item := range items {
+		urls[item.Hash] = item
+	}
 
-	return
+	return len(urls) > 0, urls, nil
 }
 
-func (r *DBRepository) UsersCount() int {
+// Walk вызывает fn для каждой ссылки в бд
+func (r *DBRepository) Walk(ctx context.Context, fn func(url *types.URL) error) error {
 	if r.DB == nil {
-		return 0
+		return errors.New("нет подключения к бд")
 	}
 
-	var cnt int
-	err := r.DB.Get(&cnt, "select count(DISTINCT(uuid)) as cnt from urls")
+	return r.do(ctx, func(ctx context.Context) error {
+		rows, err := r.DB.QueryxContext(ctx, "SELECT "+urlColumns+" FROM urls")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			url := &types.URL{}
+			if err = rows.StructScan(url); err != nil {
+				return err
+			}
+			if err = fn(url); err != nil {
+				return err
+			}
+		}
+
+		return rows.Err()
+	})
+}
+
+// Export вызывает fn для каждой ссылки пользователя uuid, а при пустом uuid -
+// для всех ссылок. Читаем из основной бд: выгрузка сразу после импорта
+// не должна зависеть от отставания реплик. Выгрузка может быть долгой,
+// поэтому таймаут чтения не применяется. Ошибка fn (клиент ушел) не
+// считается отказом бд
+func (r *DBRepository) Export(ctx context.Context, uuid string, fn func(url *types.URL) error) error {
+	if r.DB == nil {
+		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	query, args := "SELECT "+urlColumns+" FROM urls", []interface{}{}
+	if uuid != "" {
+		query, args = query+" WHERE uuid = ?", append(args, uuid)
+	}
+
+	var fnErr error
+	err := r.do(ctx, func(ctx context.Context) error {
+		rows, err := r.DB.QueryxContext(ctx, r.DB.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
+		for rows.Next() {
+			url := &types.URL{}
+			if err = rows.StructScan(url); err != nil {
+				return err
+			}
+			if fnErr = fn(url); fnErr != nil {
+				return nil
+			}
+		}
+
+		return rows.Err()
+	})
 	if err != nil {
-		log.Println(err)
-		return 0
+		return err
 	}
 
-	return cnt
+	return fnErr
 }
 
-func (r *DBRepository) UrlsCount() int {
+// ListURLs страница ссылок пользователя. Фильтры, сортировка и курсор
+// применяются в запросе, порядок - по ключу сортировки, затем по хешу
+func (r *DBRepository) ListURLs(ctx context.Context, q types.URLQuery) (page types.URLPage, err error) {
 	if r.DB == nil {
-		return 0
+		return page, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
 	}
 
-	var cnt int
-	err := r.DB.Get(&cnt, "select count(*) as cnt from urls")
+	cursor, err := decodeCursor(q)
+	if err != nil {
+		return page, err
+	}
+
+	where := []string{"uuid = ?"}
+	args := []interface{}{q.UUID}
+
+	if q.Deleted != nil {
+		if *q.Deleted {
+			where = append(where, "deleted_at IS NOT NULL")
+		} else {
+			where = append(where, "deleted_at IS NULL")
+		}
+	}
+	if q.Expired != nil {
+		if *q.Expired {
+			where = append(where, "expires_at IS NOT NULL AND expires_at <= ?")
+		} else {
+			where = append(where, "(expires_at IS NULL OR expires_at > ?)")
+		}
+		args = append(args, q.Now.UTC())
+	}
+	if q.Domain != "" {
+		where = append(where, `(domain = ? OR domain LIKE ? ESCAPE '\')`)
+		args = append(args, q.Domain, "%."+escapeLike(q.Domain))
+	}
+	if q.Search != "" {
+		where = append(where, `LOWER(url) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(strings.ToLower(q.Search))+"%")
+	}
 
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBReadTimeout)
+	defer cancel()
+
+	filter := strings.Join(where, " AND ")
+	err = r.read(ctx, func(ctx context.Context, db *sqlx.DB) error {
+		return db.GetContext(ctx, &page.Total, db.Rebind("SELECT COUNT(*) FROM urls WHERE "+filter), args...)
+	})
 	if err != nil {
-		log.Println(err)
-		return 0
+		return page, err
 	}
 
-	return cnt
+	key, order, cmp := r.createdKey(), "DESC", "<"
+	if q.Sort == types.SortClicks {
+		key = "clicks"
+	}
+	if q.Asc {
+		order, cmp = "ASC", ">"
+	}
+
+	if cursor != nil {
+		var last interface{} = cursor.Created
+		if q.Sort == types.SortClicks {
+			last = cursor.Clicks
+		}
+
+		filter += " AND (" + key + " " + cmp + " ? OR (" + key + " = ? AND hash " + cmp + " ?))"
+		args = append(args, last, last, cursor.Hash)
+	}
+
+	query := "SELECT " + urlColumns + " FROM urls WHERE " + filter + " ORDER BY " + key + " " + order + ", hash " + order
+	if q.Limit > 0 {
+		// лишняя строка - признак следующей страницы
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	var urls []*types.URL
+	err = r.read(ctx, func(ctx context.Context, db *sqlx.DB) error {
+		urls = nil
+		return db.SelectContext(ctx, &urls, db.Rebind(query), args...)
+	})
+	if err != nil {
+		return page, err
+	}
+
+	if q.Limit > 0 && len(urls) > q.Limit {
+		urls = urls[:q.Limit]
+		page.NextCursor = encodeCursor(q, urls[len(urls)-1])
+	}
+	page.URLs = urls
+
+	return page, nil
+}
+
+// createdKey ключ сортировки по времени создания. Ссылки без created_at
+// считаются созданными в epoch - так же, как в памяти и файле
+func (r *DBRepository) createdKey() string {
+	if r.driver == "postgres" {
+		return "COALESCE(created_at, TIMESTAMP '1970-01-01 00:00:00')"
+	}
+
+	// sqlite хранит время строкой в формате драйвера
+	return "COALESCE(created_at, '1970-01-01 00:00:00+00:00')"
 }
 
-func (r *DBRepository) Ping() (err error) {
+// AddClicks прибавляет переходы к счетчикам ссылок
+func (r *DBRepository) AddClicks(ctx context.Context, clicks map[string]int64) error {
 	if r.DB == nil {
-		return errors.New("нет подключения к бд")
+		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	// один порядок обновления во всех транзакциях - без взаимных блокировок
+	hashes := make([]string, 0, len(clicks))
+	for hash := range clicks {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	return r.do(ctx, func(ctx context.Context) error {
+		tx, err := r.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, hash := range hashes {
+			_, err = tx.ExecContext(ctx, tx.Rebind("UPDATE urls SET clicks = clicks + ? WHERE hash = ?"), clicks[hash], hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
+}
+
+// ConsumeClick засчитывает переход по ссылке с лимитом одним запросом:
+// счетчик растет, только пока не дошел до max_clicks. Исчерпан - ErrURLExhausted
+func (r *DBRepository) ConsumeClick(ctx context.Context, hash string) (clicks int64, err error) {
+	if r.DB == nil {
+		return 0, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
 	defer cancel()
-	return r.DB.PingContext(ctx)
+
+	err = r.do(ctx, func(ctx context.Context) error {
+		err := r.DB.GetContext(ctx, &clicks, r.DB.Rebind(`UPDATE urls SET clicks = clicks + 1
+			WHERE hash = ? AND max_clicks > 0 AND clicks < max_clicks RETURNING clicks`), hash)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		// не обновилось ни строки: лимит исчерпан или ссылки в бд еще нет
+		var rows int
+		if err = r.DB.GetContext(ctx, &rows, r.DB.Rebind("SELECT COUNT(*) FROM urls WHERE hash = ?"), hash); err != nil {
+			return err
+		}
+		if rows == 0 {
+			return fmt.Errorf("%w", shortenerErrors.ErrURLNotFound)
+		}
+		return fmt.Errorf("%w", shortenerErrors.ErrURLExhausted)
+	})
+
+	return clicks, err
 }
 
-func (r *DBRepository) migrate() {
-	_, err := r.DB.Exec(`CREATE TABLE IF NOT EXISTS urls
-		(
-			hash       varchar(256) not null,
-			uuid       varchar(256) not null,
-			url        text         not null,
-			short_url  varchar(256) not null,
-    		deleted_at date         null,
-			constraint uk
-				unique (hash, uuid)
-		)`,
-	)
+// withDomain заполняет хост урла для фильтра по домену
+func withDomain(urls ...*types.URL) {
+	for _, url := range urls {
+		url.Domain = urlDomain(url.URL)
+	}
+}
 
-	log.Println(err)
+// escapeLike экранирует спецсимволы LIKE
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// UpdateURL меняет ссылку пользователя uuid и пишет прежнее значение
+// в историю. Строка блокируется до конца транзакции, поэтому
+// одновременные изменения не теряют записи истории
+func (r *DBRepository) UpdateURL(ctx context.Context, uuid string, hash string, update types.URLUpdate, now time.Time) (url *types.URL, err error) {
+	if r.DB == nil {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	lock := ""
+	if r.driver == "postgres" {
+		lock = " FOR UPDATE"
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	err = r.do(ctx, func(ctx context.Context) error {
+		tx, err := r.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		found := &types.URL{}
+		err = tx.GetContext(ctx, found, tx.Rebind("SELECT "+urlColumns+" FROM urls WHERE hash = ? LIMIT 1"+lock), hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w", shortenerErrors.ErrURLNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = checkEditable(found, uuid); err != nil {
+			return err
+		}
+
+		revision := newRevision(found, now)
+		if !applyUpdate(found, update, now) {
+			url = found
+			return nil
+		}
+
+		_, err = tx.NamedExecContext(ctx, `INSERT INTO url_history (hash, url, title, notes, tags, changed_at)
+			VALUES (:hash, :url, :title, :notes, :tags, :changed_at)`, revision)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, tx.Rebind(`UPDATE urls SET url = ?, domain = ?, title = ?, notes = ?, tags = ?,
+			password_hash = ?, max_clicks = ?, redirect_code = ?, query_passthrough = ?, updated_at = ?
+			WHERE hash = ? AND uuid = ?`),
+			found.URL, urlDomain(found.URL), found.Title, found.Notes, found.Tags, found.PasswordHash, found.MaxClicks,
+			found.RedirectCode, found.QueryPassthrough, found.UpdatedAt, hash, uuid)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		url = found
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return url, nil
+}
+
+// History прежние значения ссылки, сначала последние
+func (r *DBRepository) History(ctx context.Context, hash string) (revisions []types.URLRevision, err error) {
+	if r.DB == nil {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBReadTimeout)
+	defer cancel()
+
+	err = r.read(ctx, func(ctx context.Context, db *sqlx.DB) error {
+		revisions = nil
+		return db.SelectContext(ctx, &revisions, db.Rebind(`SELECT hash, url, title, notes, tags, changed_at
+			FROM url_history WHERE hash = ? ORDER BY changed_at DESC`), hash)
+	})
+
+	return revisions, err
+}
+
+// RestoreByHash снимает удаление со ссылок пользователя uuid, удаленных
+// не раньше notBefore. Нулевое notBefore - без ограничения срока
+func (r *DBRepository) RestoreByHash(ctx context.Context, uuid string, hashes []string, notBefore time.Time) (result types.RestoreResult, err error) {
+	if r.DB == nil {
+		return result, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	result.Restored = []string{}
+	if len(hashes) == 0 {
+		return result, nil
+	}
+
+	query, args, err := sqlx.In("SELECT hash, deleted_at FROM urls WHERE uuid = ? AND deleted_at IS NOT NULL AND hash IN (?)", uuid, hashes)
+	if err != nil {
+		return result, err
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	err = r.do(ctx, func(ctx context.Context) error {
+		result = types.RestoreResult{Restored: []string{}}
+
+		tx, err := r.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var rows []struct {
+			Hash      string    `db:"hash"`
+			DeletedAt time.Time `db:"deleted_at"`
+		}
+		if err = tx.SelectContext(ctx, &rows, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+
+		deleted := map[string]time.Time{}
+		for _, row := range rows {
+			deleted[row.Hash] = row.DeletedAt
+		}
+
+		for _, hash := range hashes {
+			deletedAt, ok := deleted[hash]
+			switch {
+			case !ok:
+				result.NotFound = append(result.NotFound, hash)
+			case !notBefore.IsZero() && deletedAt.Before(notBefore):
+				result.Expired = append(result.Expired, hash)
+			default:
+				result.Restored = append(result.Restored, hash)
+			}
+		}
+
+		if len(result.Restored) == 0 {
+			return nil
+		}
+
+		update, updateArgs, err := sqlx.In("UPDATE urls SET deleted_at = NULL, updated_at = ? WHERE uuid = ? AND hash IN (?)",
+			time.Now().UTC(), uuid, result.Restored)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, tx.Rebind(update), updateArgs...); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+
+	return result, err
+}
+
+// Purge безвозвратно удаляет до limit ссылок, удаленных или истекших
+// раньше before, вместе с их историей. Возвращает удаленные ссылки
+func (r *DBRepository) Purge(ctx context.Context, before time.Time, limit int) (purged []*types.URL, err error) {
+	if r.DB == nil {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	before = before.UTC()
+	condition := "(deleted_at < ? OR expires_at < ?)"
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	err = r.do(ctx, func(ctx context.Context) error {
+		purged = nil
+
+		tx, err := r.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var urls []*types.URL
+		err = tx.SelectContext(ctx, &urls, tx.Rebind("SELECT "+urlColumns+" FROM urls WHERE "+condition+" ORDER BY hash LIMIT ?"), before, before, limit)
+		if err != nil || len(urls) == 0 {
+			return err
+		}
+
+		hashes := make([]string, 0, len(urls))
+		for _, url := range urls {
+			hashes = append(hashes, url.Hash)
+		}
+
+		query, args, err := sqlx.In("DELETE FROM urls WHERE hash IN (?) AND "+condition, hashes, before, before)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+
+		query, args, err = sqlx.In("DELETE FROM url_history WHERE hash IN (?)", hashes)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		purged = urls
+		return nil
+	})
+
+	return purged, err
+}
+
+func (r *DBRepository) DeleteByHash(ctx context.Context, uuid string, hashes []string) (err error) {
+	if r.DB == nil {
+		err = errors.New("нет подключения к бд")
+		return
+	}
+
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// время берем свое, а не бд: created_at и expires_at тоже пишутся в UTC из приложения
+	now := time.Now().UTC()
+	query, args, err := sqlx.In("UPDATE urls SET deleted_at = ?, updated_at = ? WHERE hash IN (?)", now, now, hashes)
+	if uuid != "" {
+		query, args, err = sqlx.In("UPDATE urls SET deleted_at = ?, updated_at = ? WHERE uuid = ? AND hash IN (?)", now, now, uuid, hashes)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	err = r.do(ctx, func(ctx context.Context) error {
+		_, err := r.DB.ExecContext(ctx, r.DB.Rebind(query), args...)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return
+}
+
+// SaveUTMTemplate сохраняет шаблон utm-меток, шаблон пользователя
+// с тем же именем заменяется
+func (r *DBRepository) SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) error {
+	if r.DB == nil {
+		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	return r.do(ctx, func(ctx context.Context) error {
+		_, err := r.DB.NamedExecContext(ctx, `INSERT INTO utm_templates
+			(uuid, name, source, medium, campaign, term, content, updated_at)
+			VALUES (:uuid, :name, :source, :medium, :campaign, :term, :content, :updated_at)
+			ON CONFLICT (uuid, name) DO UPDATE SET source = excluded.source, medium = excluded.medium,
+			campaign = excluded.campaign, term = excluded.term, content = excluded.content,
+			updated_at = excluded.updated_at`, template)
+		return err
+	})
+}
+
+// UTMTemplates шаблоны utm-меток пользователя uuid по имени
+func (r *DBRepository) UTMTemplates(ctx context.Context, uuid string) (templates []types.UTMTemplate, err error) {
+	if r.DB == nil {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBReadTimeout)
+	defer cancel()
+
+	err = r.read(ctx, func(ctx context.Context, db *sqlx.DB) error {
+		templates = nil
+		return db.SelectContext(ctx, &templates, db.Rebind(`SELECT uuid, name, source, medium, campaign, term, content, updated_at
+			FROM utm_templates WHERE uuid = ? ORDER BY name`), uuid)
+	})
+
+	return templates, err
+}
+
+// DeleteUTMTemplate удаляет шаблон utm-меток. Нет шаблона - ErrTemplateNotFound
+func (r *DBRepository) DeleteUTMTemplate(ctx context.Context, uuid string, name string) error {
+	if r.DB == nil {
+		return fmt.Errorf("%w", shortenerErrors.ErrNoDBConnection)
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBWriteTimeout)
+	defer cancel()
+
+	return r.do(ctx, func(ctx context.Context) error {
+		res, err := r.DB.ExecContext(ctx, r.DB.Rebind("DELETE FROM utm_templates WHERE uuid = ? AND name = ?"), uuid, name)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w", shortenerErrors.ErrTemplateNotFound)
+		}
+
+		return nil
+	})
+}
+
+func (r *DBRepository) UsersCount(ctx context.Context) int {
+	return r.count(ctx, "select count(DISTINCT(uuid)) as cnt from urls")
+}
+
+func (r *DBRepository) UrlsCount(ctx context.Context) int {
+	return r.count(ctx, "select count(*) as cnt from urls")
+}
+
+// count выполняет запрос, возвращающий одно число
+func (r *DBRepository) count(ctx context.Context, query string) int {
+	if r.DB == nil {
+		return 0
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBReadTimeout)
+	defer cancel()
+
+	var cnt int
+	err := r.read(ctx, func(ctx context.Context, db *sqlx.DB) error {
+		return db.GetContext(ctx, &cnt, query)
+	})
+
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+
+	return cnt
+}
+
+func (r *DBRepository) Ping(ctx context.Context) (err error) {
+	if r.DB == nil {
+		return errors.New("нет подключения к бд")
+	}
+
+	ctx, cancel := r.withTimeout(ctx, r.cfg.DBPingTimeout)
+	defer cancel()
+
+	return r.do(ctx, r.DB.PingContext)
+}
+
+// BreakerState состояние предохранителя бд
+func (r *DBRepository) BreakerState() string {
+	return r.breaker.State()
+}
+
+// Close закрывает соединения с бд и репликами
+func (r *DBRepository) Close() error {
+	for _, rep := range r.replicas {
+		if err := rep.db.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if r.DB == nil {
+		return nil
+	}
+
+	return r.DB.Close()
+}
+
+// read выполняет запрос на чтение на очередной реплике. Если реплики
+// нет или она недоступна - пробуем следующую, в конце - основную бд
+func (r *DBRepository) read(ctx context.Context, query func(ctx context.Context, db *sqlx.DB) error) (err error) {
+	if n := len(r.replicas); n > 0 {
+		start := int(atomic.AddUint32(&r.next, 1))
+
+		for i := 0; i < n; i++ {
+			rep := r.replicas[(start+i)%n]
+
+			err = r.doWith(ctx, rep.breaker, func(ctx context.Context) error {
+				return query(ctx, rep.db)
+			})
+			if !isDBFailure(err) || ctx.Err() != nil {
+				return err
+			}
+
+			log.Printf("Реплика недоступна, читаем дальше. %s", err)
+		}
+	}
+
+	return r.do(ctx, func(ctx context.Context) error {
+		return query(ctx, r.DB)
+	})
+}
+
+// do выполняет запрос к основной бд через ее предохранитель
+func (r *DBRepository) do(ctx context.Context, query func(ctx context.Context) error) error {
+	return r.doWith(ctx, r.breaker, query)
+}
+
+// doWith выполняет запрос через предохранитель breaker. Временные ошибки
+// (конфликт сериализации, блокировка) повторяются до DBRetryAttempts раз
+func (r *DBRepository) doWith(ctx context.Context, breaker *CircuitBreaker, query func(ctx context.Context) error) (err error) {
+	if err = breaker.Allow(); err != nil {
+		return err
+	}
+
+	attempts := r.cfg.DBRetryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = query(ctx)
+		if err == nil || !isTransient(err) || attempt >= attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(time.Duration(attempt) * r.cfg.DBRetryBackoff.Duration):
+			continue
+		}
+		break
+	}
+
+	breaker.Done(isDBFailure(err))
+
+	return err
+}
+
+// withTimeout ограничивает время операции с бд таймаутом из конфига.
+// Нулевой таймаут - ждем, пока не отменят родительский контекст
+func (r *DBRepository) withTimeout(ctx context.Context, timeout types.Duration) (context.Context, context.CancelFunc) {
+	if timeout.Duration <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout.Duration)
+}
+
+// isUniqueViolation проверяет, что запись нарушила уникальный ключ
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	return false
+}
+
+// isTransient ошибки, после которых запрос имеет смысл повторить
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure, deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	return false
+}
+
+// isRejected бд отвергла сами данные: значение не влезает в колонку,
+// нарушено ограничение. Повтор такой записи ничего не изменит
+func isRejected(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// data_exception, integrity_constraint_violation
+		return pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23"
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrConstraint || sqliteErr.Code == sqlite3.ErrTooBig ||
+			sqliteErr.Code == sqlite3.ErrMismatch || sqliteErr.Code == sqlite3.ErrRange
+	}
+
+	return false
+}
+
+// isDBFailure ошибка говорит о проблемах с бд, а не с запросом.
+// Такие ошибки размыкают предохранитель
+func isDBFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return !errors.Is(err, shortenerErrors.ErrURLConflict) &&
+		!errors.Is(err, shortenerErrors.ErrURLNotFound) &&
+		!errors.Is(err, shortenerErrors.ErrURLForbidden) &&
+		!errors.Is(err, shortenerErrors.ErrURLDeleted) &&
+		!errors.Is(err, shortenerErrors.ErrURLExhausted) &&
+		!errors.Is(err, shortenerErrors.ErrTemplateNotFound) &&
+		!isUniqueViolation(err) &&
+		!isRejected(err) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// migrate создает схему. Миграции общие для postgres и sqlite
+func (r *DBRepository) migrate() {
+	_, err := r.DB.Exec(`CREATE TABLE IF NOT EXISTS urls
+		(
+			hash              varchar(256) not null,
+			uuid              varchar(256) not null,
+			url               text         not null,
+			short_url         varchar(256) not null,
+			domain            varchar(256) null,
+			created_at        timestamp    null,
+			updated_at        timestamp    null,
+			deleted_at        timestamp    null,
+			expires_at        timestamp    null,
+			active_from       timestamp    null,
+			clicks            bigint       not null default 0,
+			max_clicks        bigint       not null default 0,
+			title             varchar(256) not null default '',
+			notes             text         not null default '',
+			tags              text         not null default '[]',
+			password_hash     varchar(256) not null default '',
+			redirect_code     integer      not null default 0,
+			query_passthrough varchar(16)  not null default '',
+			constraint uk
+				unique (hash, uuid)
+		)`,
+	)
+
+	if err != nil {
+		log.Println(err)
+	}
+
+	// колонки, добавленные после создания таблицы
+	r.addColumn("created_at", "timestamp null")
+	r.addColumn("expires_at", "timestamp null")
+	r.addColumn("clicks", "bigint not null default 0")
+	r.addColumn("domain", "varchar(256) null")
+	r.addColumn("updated_at", "timestamp null")
+	r.addColumn("title", "varchar(256) not null default ''")
+	r.addColumn("notes", "text not null default ''")
+	r.addColumn("tags", "text not null default '[]'")
+	r.addColumn("password_hash", "varchar(256) not null default ''")
+	r.addColumn("max_clicks", "bigint not null default 0")
+	r.addColumn("active_from", "timestamp null")
+	r.addColumn("redirect_code", "integer not null default 0")
+	r.addColumn("query_passthrough", "varchar(16) not null default ''")
+	r.backfillDomains()
+	r.migrateDeletedAt()
+
+	if _, err = r.DB.Exec("CREATE INDEX IF NOT EXISTS urls_uuid ON urls (uuid)"); err != nil {
+		log.Println(err)
+	}
+
+	// прежние значения измененных ссылок
+	_, err = r.DB.Exec(`CREATE TABLE IF NOT EXISTS url_history
+		(
+			hash       varchar(256) not null,
+			url        text         not null,
+			title      varchar(256) not null default '',
+			notes      text         not null default '',
+			tags       text         not null default '[]',
+			changed_at timestamp    not null
+		)`,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if _, err = r.DB.Exec("CREATE INDEX IF NOT EXISTS url_history_hash ON url_history (hash, changed_at)"); err != nil {
+		log.Println(err)
+	}
+
+	// сохраненные шаблоны utm-меток пользователей
+	_, err = r.DB.Exec(`CREATE TABLE IF NOT EXISTS utm_templates
+		(
+			uuid       varchar(256) not null,
+			name       varchar(64)  not null,
+			source     varchar(256) not null default '',
+			medium     varchar(256) not null default '',
+			campaign   varchar(256) not null default '',
+			term       varchar(256) not null default '',
+			content    varchar(256) not null default '',
+			updated_at timestamp    not null,
+			constraint utm_templates_uk
+				unique (uuid, name)
+		)`,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// migrateDeletedAt переводит deleted_at из даты во время. В sqlite тип
+// колонки ни на что не влияет, драйвер разбирает и дату, и время
+func (r *DBRepository) migrateDeletedAt() {
+	if r.driver != "postgres" {
+		return
+	}
+
+	var dataType string
+	err := r.DB.Get(&dataType, `SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'urls' AND column_name = 'deleted_at'`)
+	if err != nil || dataType != "date" {
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if _, err = r.DB.Exec("ALTER TABLE urls ALTER COLUMN deleted_at TYPE timestamp"); err != nil {
+		log.Println(err)
+	}
+}
+
+// backfillDomains заполняет domain у ссылок, сохраненных до его появления
+func (r *DBRepository) backfillDomains() {
+	var rows []struct {
+		Hash string `db:"hash"`
+		URL  string `db:"url"`
+	}
+
+	if err := r.DB.Select(&rows, "SELECT hash, url FROM urls WHERE domain IS NULL"); err != nil || len(rows) == 0 {
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	tx, err := r.DB.Beginx()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, row := range rows {
+		_, err = tx.Exec(tx.Rebind("UPDATE urls SET domain = ? WHERE hash = ? AND domain IS NULL"), urlDomain(row.URL), row.Hash)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println(err)
+	}
+}
+
+// addColumn добавляет колонку в urls, если ее еще нет.
+// sqlite не умеет ADD COLUMN IF NOT EXISTS, поэтому проверяем сами
+func (r *DBRepository) addColumn(name string, definition string) {
+	var err error
+
+	if r.driver == "postgres" {
+		_, err = r.DB.Exec("ALTER TABLE urls ADD COLUMN IF NOT EXISTS " + name + " " + definition)
+	} else {
+		var cnt int
+		err = r.DB.Get(&cnt, "SELECT COUNT(*) FROM pragma_table_info('urls') WHERE name = ?", name)
+		if err == nil && cnt == 0 {
+			_, err = r.DB.Exec("ALTER TABLE urls ADD COLUMN " + name + " " + definition)
+		}
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
 }
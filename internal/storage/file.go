@@ -1,11 +1,19 @@
 package storage
 
 import (
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 func newWriter(fileName string) (*writer, error) {
@@ -31,7 +39,11 @@ func newReader(fileName string) (*reader, error) {
 }
 
 func NewFileRepository(filename string) (r *FileRepository, err error) {
-	r = &FileRepository{}
+	r = &FileRepository{path: filename}
+	r.clicks, r.clickRecords, err = readClicks(r.clicksPath())
+	if err != nil {
+		return nil, err
+	}
 	r.storageReader, err = newReader(filename)
 	if err != nil {
 		return nil, err
@@ -69,17 +81,40 @@ func (c *reader) Read() (*types.URL, error) {
 	return item, nil
 }
 
+// Rewind переходит в начало файла. Декодер пересоздаем: он запоминает
+// io.EOF и буферизует прочитанное, поэтому после Seek дальше не читает
+func (c *reader) Rewind() error {
+	if _, err := c.file.Seek(0, 0); err != nil {
+		return err
+	}
+	c.decoder = json.NewDecoder(c.file)
+
+	return nil
+}
+
 func (c *reader) Close() error {
 	return c.file.Close()
 }
 
 type FileRepository struct {
 	mx            sync.Mutex
+	path          string
 	storageReader *reader
 	storageWriter *writer
+	// clicks переходы по ссылкам с лимитом из файла path.clicks, еще не
+	// перенесенные в основной файл. Перекрывают Clicks из основного файла
+	clicks map[string]int64
+	// clickRecords сколько записей в path.clicks
+	clickRecords int
+}
+
+// clickRecord запись файла переходов: сколько всего переходов у ссылки
+type clickRecord struct {
+	Hash   string `json:"hash"`
+	Clicks int64  `json:"clicks"`
 }
 
-func (r *FileRepository) Save(url *types.URL) error {
+func (r *FileRepository) Save(ctx context.Context, url *types.URL) error {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
@@ -91,16 +126,26 @@ func (r *FileRepository) Save(url *types.URL) error {
 	return nil
 }
 
-func (r *FileRepository) FindByHash(hash string) (exist bool, url *types.URL, err error) {
+func (r *FileRepository) FindByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
-	_, err = r.storageReader.file.Seek(0, 0)
+	return r.findByHash(ctx, hash)
+}
+
+// findByHash см. FindByHash. Вызывается под r.mx
+func (r *FileRepository) findByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error) {
+	err = r.storageReader.Rewind()
 	if err != nil {
 		return false, &types.URL{}, err
 	}
 
 	for {
+		// файл читаем целиком - клиент мог уже уйти
+		if err = ctx.Err(); err != nil {
+			return false, nil, err
+		}
+
 		item, err := r.storageReader.Read()
 
 		if err != nil {
@@ -108,23 +153,28 @@ func (r *FileRepository) FindByHash(hash string) (exist bool, url *types.URL, er
 		}
 
 		if item.Hash == hash {
+			r.withClicks(item)
 			return true, item, nil
 		}
 	}
 }
 
-func (r *FileRepository) FindByUUID(uuid string) (urls map[string]*types.URL, err error) {
+func (r *FileRepository) FindByUUID(ctx context.Context, uuid string) (urls map[string]*types.URL, err error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
 	urls = map[string]*types.URL{}
 
-	_, err = r.storageReader.file.Seek(0, 0)
+	err = r.storageReader.Rewind()
 	if err != nil {
 		return map[string]*types.URL{}, err
 	}
 
 	for {
+		if err = ctx.Err(); err != nil {
+			return map[string]*types.URL{}, err
+		}
+
 		item, err := r.storageReader.Read()
 
 		if err != nil {
@@ -132,9 +182,781 @@ func (r *FileRepository) FindByUUID(uuid string) (urls map[string]*types.URL, er
 		}
 
 		if item.UUID == uuid {
+			r.withClicks(item)
 			urls[item.Hash] = item
 		}
 	}
 
 	return urls, nil
 }
+
+// SaveBatch дописывает пачку в файл. Если хотя бы один хеш уже занят,
+// не пишется ничего - ErrURLConflict
+func (r *FileRepository) SaveBatch(ctx context.Context, urls []*types.URL) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	hashes := map[string]bool{}
+	for _, url := range urls {
+		if hashes[url.Hash] {
+			return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
+		}
+		hashes[url.Hash] = true
+	}
+
+	err := r.walk(ctx, func(url *types.URL) error {
+		if hashes[url.Hash] {
+			return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, url := range urls {
+		if err = r.storageWriter.Write(url); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import дописывает в файл ссылки, хешей которых еще нет. Файл читается
+// один раз на пачку, поэтому импортировать нужно пачками, а не по одной
+func (r *FileRepository) Import(ctx context.Context, urls []*types.URL) (created int, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	exist := map[string]bool{}
+	for _, url := range urls {
+		exist[url.Hash] = false
+	}
+
+	err = r.walk(ctx, func(url *types.URL) error {
+		if _, ok := exist[url.Hash]; ok {
+			exist[url.Hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, url := range urls {
+		if exist[url.Hash] {
+			continue
+		}
+
+		if err = r.storageWriter.Write(url); err != nil {
+			return created, err
+		}
+		exist[url.Hash] = true
+		created++
+	}
+
+	return created, nil
+}
+
+// Export вызывает fn для каждой ссылки пользователя uuid, а при пустом uuid -
+// для всех. Повторные записи хеша пропускаются, как и в FindByHash
+func (r *FileRepository) Export(ctx context.Context, uuid string, fn func(url *types.URL) error) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	seen := map[string]bool{}
+
+	return r.walk(ctx, func(url *types.URL) error {
+		if seen[url.Hash] {
+			return nil
+		}
+		seen[url.Hash] = true
+
+		if uuid != "" && url.UUID != uuid {
+			return nil
+		}
+
+		return fn(url)
+	})
+}
+
+// ListURLs страница ссылок пользователя. Файл читается целиком
+func (r *FileRepository) ListURLs(ctx context.Context, q types.URLQuery) (types.URLPage, error) {
+	urls := make([]*types.URL, 0)
+
+	err := r.Export(ctx, q.UUID, func(url *types.URL) error {
+		if matchURL(url, q) {
+			urls = append(urls, url)
+		}
+		return nil
+	})
+	if err != nil {
+		return types.URLPage{}, err
+	}
+
+	return pageURLs(urls, q)
+}
+
+// Walk вызывает fn для каждой записи файла
+func (r *FileRepository) Walk(ctx context.Context, fn func(url *types.URL) error) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return r.walk(ctx, fn)
+}
+
+// walk обходит файл. Вызывается под r.mx
+func (r *FileRepository) walk(ctx context.Context, fn func(url *types.URL) error) error {
+	err := r.storageReader.Rewind()
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		item, err := r.storageReader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.withClicks(item)
+
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// UpdateURL меняет ссылку пользователя uuid: прежнее значение дописывается
+// в файл истории рядом с хранилищем, а файл ссылок переписывается
+func (r *FileRepository) UpdateURL(ctx context.Context, uuid string, hash string, update types.URLUpdate, now time.Time) (*types.URL, error) {
+	// чтение, история и перезапись под одной блокировкой, иначе
+	// одновременные изменения затрут друг друга
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	exist, url, err := r.findByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrURLNotFound)
+	}
+
+	if err = checkEditable(url, uuid); err != nil {
+		return nil, err
+	}
+
+	revision := newRevision(url, now)
+	if !applyUpdate(url, update, now) {
+		return url, nil
+	}
+
+	if err = r.appendHistory(revision); err != nil {
+		return nil, err
+	}
+
+	if err = r.rewrite(ctx, map[string]*types.URL{hash: url}); err != nil {
+		return nil, err
+	}
+
+	return url, nil
+}
+
+// DeleteByHash помечает удаленными ссылки пользователя uuid, при пустом
+// uuid - любые. Возвращает помеченные ссылки
+func (r *FileRepository) DeleteByHash(ctx context.Context, uuid string, hashes []string, now time.Time) ([]*types.URL, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	wanted := map[string]bool{}
+	for _, hash := range hashes {
+		wanted[hash] = true
+	}
+
+	deleted := map[string]*types.URL{}
+	err := r.walk(ctx, func(url *types.URL) error {
+		// действует первая запись хеша, как и в FindByHash
+		if !wanted[url.Hash] {
+			return nil
+		}
+		wanted[url.Hash] = false
+
+		if (uuid == "" || url.UUID == uuid) && !url.DeletedAt.Valid {
+			url.DeletedAt = sql.NullTime{Time: now, Valid: true}
+			url.UpdatedAt = sql.NullTime{Time: now, Valid: true}
+			deleted[url.Hash] = url
+		}
+		return nil
+	})
+	if err != nil || len(deleted) == 0 {
+		return nil, err
+	}
+
+	if err = r.rewrite(ctx, deleted); err != nil {
+		return nil, err
+	}
+
+	urls := make([]*types.URL, 0, len(deleted))
+	for _, url := range deleted {
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// RestoreByHash снимает удаление со ссылок пользователя uuid, удаленных
+// не раньше notBefore, как и DBRepository.RestoreByHash. Возвращает итог
+// и восстановленные ссылки
+func (r *FileRepository) RestoreByHash(ctx context.Context, uuid string, hashes []string, notBefore time.Time, now time.Time) (types.RestoreResult, []*types.URL, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	result := types.RestoreResult{Restored: []string{}}
+
+	deleted := map[string]*types.URL{}
+	err := r.walk(ctx, func(url *types.URL) error {
+		if _, seen := deleted[url.Hash]; seen {
+			return nil
+		}
+		if url.UUID == uuid && url.DeletedAt.Valid {
+			deleted[url.Hash] = url
+		} else {
+			deleted[url.Hash] = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return result, nil, err
+	}
+
+	restored := map[string]*types.URL{}
+	for _, hash := range hashes {
+		url := deleted[hash]
+		switch {
+		case url == nil:
+			result.NotFound = append(result.NotFound, hash)
+		case !notBefore.IsZero() && url.DeletedAt.Time.Before(notBefore):
+			result.Expired = append(result.Expired, hash)
+		default:
+			url.DeletedAt = sql.NullTime{}
+			url.UpdatedAt = sql.NullTime{Time: now, Valid: true}
+			restored[hash] = url
+			result.Restored = append(result.Restored, hash)
+		}
+	}
+
+	if len(restored) == 0 {
+		return result, nil, nil
+	}
+
+	if err = r.rewrite(ctx, restored); err != nil {
+		return types.RestoreResult{Restored: []string{}}, nil, err
+	}
+
+	urls := make([]*types.URL, 0, len(restored))
+	for _, url := range restored {
+		urls = append(urls, url)
+	}
+
+	return result, urls, nil
+}
+
+// historyPath файл истории изменений ссылок
+func (r *FileRepository) historyPath() string {
+	return r.path + ".history"
+}
+
+// appendHistory дописывает прежнее значение ссылки в файл истории.
+// Вызывается под r.mx
+func (r *FileRepository) appendHistory(revision types.URLRevision) error {
+	file, err := os.OpenFile(r.historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = json.NewEncoder(file).Encode(revision); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// utmTemplatesPath файл шаблонов utm-меток
+func (r *FileRepository) utmTemplatesPath() string {
+	return r.path + ".utm"
+}
+
+// utmTemplates все шаблоны utm-меток из файла. Вызывается под r.mx
+func (r *FileRepository) utmTemplates(ctx context.Context) ([]types.UTMTemplate, error) {
+	file, err := os.Open(r.utmTemplatesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var templates []types.UTMTemplate
+	decoder := json.NewDecoder(file)
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		template := types.UTMTemplate{}
+		err = decoder.Decode(&template)
+		if errors.Is(err, io.EOF) {
+			return templates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		templates = append(templates, template)
+	}
+}
+
+// writeUTMTemplates переписывает файл шаблонов. Вызывается под r.mx
+func (r *FileRepository) writeUTMTemplates(templates []types.UTMTemplate) error {
+	return replaceFile(r.utmTemplatesPath(), func(encoder *json.Encoder) error {
+		for _, template := range templates {
+			if err := encoder.Encode(template); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveUTMTemplate сохраняет шаблон utm-меток, шаблон пользователя
+// с тем же именем заменяется
+func (r *FileRepository) SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	templates, err := r.utmTemplates(ctx)
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i := range templates {
+		if templates[i].UUID == template.UUID && templates[i].Name == template.Name {
+			templates[i], replaced = *template, true
+		}
+	}
+	if !replaced {
+		templates = append(templates, *template)
+	}
+
+	return r.writeUTMTemplates(templates)
+}
+
+// UTMTemplates шаблоны utm-меток пользователя uuid по имени
+func (r *FileRepository) UTMTemplates(ctx context.Context, uuid string) ([]types.UTMTemplate, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	templates, err := r.utmTemplates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var own []types.UTMTemplate
+	for _, template := range templates {
+		if template.UUID == uuid {
+			own = append(own, template)
+		}
+	}
+	sort.Slice(own, func(i, j int) bool {
+		return own[i].Name < own[j].Name
+	})
+
+	return own, nil
+}
+
+// DeleteUTMTemplate удаляет шаблон utm-меток. Нет шаблона - ErrTemplateNotFound
+func (r *FileRepository) DeleteUTMTemplate(ctx context.Context, uuid string, name string) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	templates, err := r.utmTemplates(ctx)
+	if err != nil {
+		return err
+	}
+
+	kept := templates[:0]
+	for _, template := range templates {
+		if template.UUID != uuid || template.Name != name {
+			kept = append(kept, template)
+		}
+	}
+	if len(kept) == len(templates) {
+		return fmt.Errorf("%w", shortenerErrors.ErrTemplateNotFound)
+	}
+
+	return r.writeUTMTemplates(kept)
+}
+
+// History прежние значения ссылки, сначала последние
+func (r *FileRepository) History(ctx context.Context, hash string) ([]types.URLRevision, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	file, err := os.Open(r.historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var revisions []types.URLRevision
+	decoder := json.NewDecoder(file)
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		revision := types.URLRevision{}
+		err = decoder.Decode(&revision)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if revision.Hash == hash {
+			revisions = append(revisions, revision)
+		}
+	}
+
+	// в файле записи идут по времени
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+
+	return revisions, nil
+}
+
+// Rewrite переписывает файл: записи с хешами из overrides заменяются,
+// недостающие дописываются в конец, повторы хешей убираются. Файл
+// перечитывается под блокировкой, поэтому параллельные записи не теряются.
+// Новый файл пишется рядом и подменяет старый целиком
+func (r *FileRepository) Rewrite(ctx context.Context, overrides map[string]*types.URL) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return r.rewrite(ctx, overrides)
+}
+
+// rewrite см. Rewrite. Вызывается под r.mx
+func (r *FileRepository) rewrite(ctx context.Context, overrides map[string]*types.URL) error {
+	err := replaceFile(r.path, func(encoder *json.Encoder) error {
+		seen := map[string]bool{}
+
+		write := func(url *types.URL) error {
+			if seen[url.Hash] {
+				return nil
+			}
+			seen[url.Hash] = true
+
+			if override, ok := overrides[url.Hash]; ok {
+				url = override
+			}
+
+			return encoder.Encode(url)
+		}
+
+		if err := r.walk(ctx, write); err != nil {
+			return err
+		}
+
+		for hash, url := range overrides {
+			if seen[hash] {
+				continue
+			}
+			if err := write(url); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = r.reopen(); err != nil {
+		return err
+	}
+
+	// переходы перенесены в основной файл
+	return r.resetClicks()
+}
+
+// ConsumeClick засчитывает переход по ссылке с лимитом. Проверка и запись
+// идут под одной блокировкой, поэтому параллельные переходы не превысят
+// лимит. Переход дописывается в path.clicks, основной файл не
+// переписывается. Исчерпан - ErrURLExhausted
+func (r *FileRepository) ConsumeClick(ctx context.Context, hash string) (*types.URL, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	exist, found, err := r.findByHash(ctx, hash)
+	if errors.Is(err, io.EOF) {
+		exist, err = false, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrURLNotFound)
+	}
+
+	if !consumeClick(found) {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrURLExhausted)
+	}
+
+	if err = r.appendClicks(hash, found.Clicks); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// clicksPath файл переходов по ссылкам с лимитом
+func (r *FileRepository) clicksPath() string {
+	return r.path + ".clicks"
+}
+
+// readClicks последние значения переходов по хешам из файла path и число записей в нем
+func readClicks(path string) (map[string]int64, int, error) {
+	clicks := map[string]int64{}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return clicks, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	records := 0
+	decoder := json.NewDecoder(file)
+	for {
+		record := clickRecord{}
+		err = decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return clicks, records, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		clicks[record.Hash] = record.Clicks
+		records++
+	}
+}
+
+// withClicks подставляет в url переходы из path.clicks. Вызывается под r.mx
+func (r *FileRepository) withClicks(url *types.URL) {
+	if clicks, ok := r.clicks[url.Hash]; ok {
+		url.Clicks = clicks
+	}
+}
+
+// appendClicks дописывает в path.clicks, что у ссылки hash всего clicks
+// переходов. Когда повторов накопится много, файл сжимается до последних
+// значений. Вызывается под r.mx
+func (r *FileRepository) appendClicks(hash string, clicks int64) error {
+	file, err := os.OpenFile(r.clicksPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = json.NewEncoder(file).Encode(clickRecord{Hash: hash, Clicks: clicks}); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	r.clicks[hash] = clicks
+	r.clickRecords++
+
+	if r.clickRecords < 2*len(r.clicks)+1024 {
+		return nil
+	}
+
+	err = replaceFile(r.clicksPath(), func(encoder *json.Encoder) error {
+		for hash, clicks := range r.clicks {
+			if err := encoder.Encode(clickRecord{Hash: hash, Clicks: clicks}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.clickRecords = len(r.clicks)
+
+	return nil
+}
+
+// resetClicks очищает path.clicks, когда переходы уже перенесены в
+// основной файл. Значения в нем полные, а не приращения, поэтому сбой
+// до очистки переходы не удвоит. Вызывается под r.mx
+func (r *FileRepository) resetClicks() error {
+	if err := os.Remove(r.clicksPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	r.clicks = map[string]int64{}
+	r.clickRecords = 0
+
+	return nil
+}
+
+// Purge убирает из файла ссылки, для которых drop вернул true, и их историю.
+// Возвращает убранные ссылки, по одной на хеш
+func (r *FileRepository) Purge(ctx context.Context, drop func(url *types.URL) bool) (purged []*types.URL, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	dropped := map[string]bool{}
+	err = r.walk(ctx, func(url *types.URL) error {
+		if !dropped[url.Hash] && drop(url) {
+			dropped[url.Hash] = true
+			purged = append(purged, url)
+		}
+		return nil
+	})
+	if err != nil || len(purged) == 0 {
+		return nil, err
+	}
+
+	err = replaceFile(r.path, func(encoder *json.Encoder) error {
+		return r.walk(ctx, func(url *types.URL) error {
+			if dropped[url.Hash] {
+				return nil
+			}
+			return encoder.Encode(url)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.reopen(); err != nil {
+		return nil, err
+	}
+
+	if err = r.resetClicks(); err != nil {
+		return nil, err
+	}
+
+	return purged, r.purgeHistory(dropped)
+}
+
+// purgeHistory убирает из файла истории записи хешей hashes. Вызывается под r.mx
+func (r *FileRepository) purgeHistory(hashes map[string]bool) error {
+	file, err := os.Open(r.historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return replaceFile(r.historyPath(), func(encoder *json.Encoder) error {
+		decoder := json.NewDecoder(file)
+		for {
+			revision := types.URLRevision{}
+			err := decoder.Decode(&revision)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if !hashes[revision.Hash] {
+				if err = encoder.Encode(revision); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// replaceFile пишет новое содержимое рядом с path и подменяет им файл целиком
+func replaceFile(path string, fill func(encoder *json.Encoder) error) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = fill(json.NewEncoder(file))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// reopen переоткрывает файл после подмены. Вызывается под r.mx
+func (r *FileRepository) reopen() error {
+	r.storageWriter.Close()
+	r.storageReader.Close()
+
+	reader, err := newReader(r.path)
+	if err != nil {
+		return err
+	}
+	writer, err := newWriter(r.path)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	r.storageReader, r.storageWriter = reader, writer
+
+	return nil
+}
+
+// Close закрывает файл
+func (r *FileRepository) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err := r.storageWriter.Close(); err != nil {
+		return err
+	}
+
+	return r.storageReader.Close()
+}
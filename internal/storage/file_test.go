@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileRepositoryImport файл перечитывается после дописывания
+func TestFileRepositoryImport(t *testing.T) {
+	repo, err := NewFileRepository(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, repo.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"}))
+
+	created, err := repo.Import(ctx, []*types.URL{
+		{UUID: "user-2", Hash: "hash-1", URL: "http://yandex.ru?x=1"},
+		{UUID: "user-2", Hash: "hash-2", URL: "http://yandex.ru?x=2"},
+		{UUID: "user-2", Hash: "hash-2", URL: "http://yandex.ru?x=2"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+
+	created, err = repo.Import(ctx, []*types.URL{
+		{UUID: "user-2", Hash: "hash-2", URL: "http://yandex.ru?x=2"},
+		{UUID: "user-2", Hash: "hash-3", URL: "http://yandex.ru?x=3"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+
+	exist, url, err := repo.FindByHash(ctx, "hash-3")
+	require.NoError(t, err)
+	require.True(t, exist)
+	assert.Equal(t, "user-2", url.UUID)
+
+	urls, err := repo.FindByUUID(ctx, "user-2")
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+}
+
+// TestFileRepositorySaveBatch пачка с занятым хешем не пишется целиком
+func TestFileRepositorySaveBatch(t *testing.T) {
+	repo, err := NewFileRepository(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, repo.SaveBatch(ctx, []*types.URL{
+		{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"},
+		{UUID: "user-1", Hash: "hash-2", URL: "http://yandex.ru?x=2"},
+	}))
+
+	for _, batch := range [][]*types.URL{
+		{{UUID: "user-2", Hash: "hash-3"}, {UUID: "user-2", Hash: "hash-1"}},
+		{{UUID: "user-2", Hash: "hash-3"}, {UUID: "user-2", Hash: "hash-3"}},
+	} {
+		err = repo.SaveBatch(ctx, batch)
+		assert.True(t, errors.Is(err, shortenerErrors.ErrURLConflict))
+	}
+
+	urls, err := repo.FindByUUID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+	exist, _, _ := repo.FindByHash(ctx, "hash-3")
+	assert.False(t, exist)
+
+	// без бд хранилище пишет пачку в файл и в память
+	st, err := NewStorage(&types.Config{DBPath: filepath.Join(t.TempDir(), "db")})
+	require.NoError(t, err)
+	defer st.Close()
+	s := st.(*storage)
+
+	require.NoError(t, s.SaveBatch(ctx, []*types.URL{{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"}}))
+	exist, _, _ = s.repositories.memory.FindByHash(ctx, "hash-1")
+	assert.True(t, exist)
+	exist, _, _ = s.repositories.file.FindByHash(ctx, "hash-1")
+	assert.True(t, exist)
+
+	err = s.SaveBatch(ctx, []*types.URL{{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"}})
+	assert.True(t, errors.Is(err, shortenerErrors.ErrURLConflict))
+}
+
+// TestFileRepositoryUpdateURL без бд история пишется в файл рядом с хранилищем
+func TestFileRepositoryUpdateURL(t *testing.T) {
+	repo, err := NewFileRepository(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer repo.Close()
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	require.NoError(t, repo.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru"}))
+	require.NoError(t, repo.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-2", URL: "http://google.com"}))
+
+	destination := "https://ya.ru"
+	_, err = repo.UpdateURL(ctx, "user-2", "hash-1", types.URLUpdate{URL: &destination}, now)
+	assert.True(t, errors.Is(err, shortenerErrors.ErrURLForbidden))
+
+	_, err = repo.UpdateURL(ctx, "user-1", "hash-1", types.URLUpdate{URL: &destination}, now)
+	require.NoError(t, err)
+
+	_, url, err := repo.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.Equal(t, destination, url.URL)
+
+	_, url, err = repo.FindByHash(ctx, "hash-2")
+	require.NoError(t, err)
+	assert.Equal(t, "http://google.com", url.URL)
+
+	revisions, err := repo.History(ctx, "hash-1")
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	assert.Equal(t, "http://yandex.ru", revisions[0].URL)
+	assert.True(t, revisions[0].ChangedAt.Equal(now))
+
+	revisions, err = repo.History(ctx, "hash-2")
+	require.NoError(t, err)
+	assert.Empty(t, revisions)
+
+	// одновременные изменения не теряют записи истории: каждое видит
+	// результат предыдущего
+	const updates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			title := fmt.Sprintf("title-%d", i)
+			_, err := repo.UpdateURL(ctx, "user-1", "hash-2", types.URLUpdate{Title: &title}, now)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	revisions, err = repo.History(ctx, "hash-2")
+	require.NoError(t, err)
+	require.Len(t, revisions, updates)
+	titles := map[string]bool{}
+	for _, revision := range revisions {
+		titles[revision.Title] = true
+	}
+	assert.Len(t, titles, updates)
+}
+
+// TestFileRepositoryConsumeClick без бд переходы с лимитом пишутся в файл
+func TestFileRepositoryConsumeClick(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	repo, err := NewFileRepository(path)
+	require.NoError(t, err)
+	defer repo.Close()
+	ctx := context.Background()
+
+	require.NoError(t, repo.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru", MaxClicks: 2}))
+	saved, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var consumed int64
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := repo.ConsumeClick(ctx, "hash-1"); err == nil {
+				atomic.AddInt64(&consumed, 1)
+			} else if !errors.Is(err, shortenerErrors.ErrURLExhausted) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, consumed)
+
+	_, url, err := repo.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, url.Clicks)
+
+	_, err = repo.ConsumeClick(ctx, "hash-2")
+	assert.True(t, errors.Is(err, shortenerErrors.ErrURLNotFound))
+
+	// переходы дописываются рядом, основной файл не переписывается
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, saved, data)
+
+	// и переживают перезапуск
+	require.NoError(t, repo.Close())
+	reopened, err := NewFileRepository(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	_, url, err = reopened.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, url.Clicks)
+
+	// при перезаписи файла переходы переносятся в него
+	maxClicks := int64(3)
+	_, err = reopened.UpdateURL(ctx, "user-1", "hash-1", types.URLUpdate{MaxClicks: &maxClicks}, time.Now())
+	require.NoError(t, err)
+	_, err = os.Stat(path + ".clicks")
+	assert.True(t, os.IsNotExist(err))
+
+	url, err = reopened.ConsumeClick(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, url.Clicks)
+	_, err = reopened.ConsumeClick(ctx, "hash-1")
+	assert.True(t, errors.Is(err, shortenerErrors.ErrURLExhausted))
+}
+
+// TestFileRepositoryDeleteByHash без бд удаление и восстановление хранятся в файле
+func TestFileRepositoryDeleteByHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	st, err := NewStorage(&types.Config{DBPath: path})
+	require.NoError(t, err)
+	defer st.Close()
+	s := st.(*storage)
+	ctx := context.Background()
+
+	for _, url := range []*types.URL{
+		{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"},
+		{UUID: "user-1", Hash: "hash-2", URL: "http://yandex.ru?x=2"},
+		{UUID: "user-2", Hash: "hash-3", URL: "http://yandex.ru?x=3"},
+	} {
+		require.NoError(t, s.Save(ctx, url))
+	}
+
+	// чужая ссылка не удаляется
+	require.NoError(t, s.DeleteByHash(ctx, "user-1", []string{"hash-1", "hash-3"}))
+	for hash, deleted := range map[string]bool{"hash-1": true, "hash-2": false, "hash-3": false} {
+		_, url, err := s.FindByHash(ctx, hash)
+		require.NoError(t, err)
+		assert.Equal(t, deleted, url.DeletedAt.Valid, hash)
+		_, url, _ = s.repositories.memory.FindByHash(ctx, hash)
+		assert.Equal(t, deleted, url.DeletedAt.Valid, hash)
+	}
+
+	// удаление переживает перезапуск
+	reopened, err := NewFileRepository(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	_, url, err := reopened.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.True(t, url.DeletedAt.Valid)
+
+	result, err := s.RestoreByHash(ctx, "user-1", []string{"hash-1", "hash-2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hash-1"}, result.Restored)
+	assert.Equal(t, []string{"hash-2"}, result.NotFound)
+	_, url, err = s.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.False(t, url.DeletedAt.Valid)
+
+	// удаленную слишком давно не восстановить
+	require.NoError(t, s.DeleteByHash(ctx, "user-1", []string{"hash-2"}))
+	s.cfg.RestoreGracePeriod.Duration = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	result, err = s.RestoreByHash(ctx, "user-1", []string{"hash-2"})
+	require.NoError(t, err)
+	assert.Empty(t, result.Restored)
+	assert.Equal(t, []string{"hash-2"}, result.Expired)
+}
+
+// TestFileRepositoryUTMTemplates без бд шаблоны пишутся в файл рядом с хранилищем
+func TestFileRepositoryUTMTemplates(t *testing.T) {
+	repo, err := NewFileRepository(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer repo.Close()
+	ctx := context.Background()
+
+	templates, err := repo.UTMTemplates(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Empty(t, templates)
+
+	require.NoError(t, repo.SaveUTMTemplate(ctx, &types.UTMTemplate{UUID: "user-1", Name: "mail", UTM: types.UTM{Source: "newsletter"}}))
+	require.NoError(t, repo.SaveUTMTemplate(ctx, &types.UTMTemplate{UUID: "user-1", Name: "ads", UTM: types.UTM{Source: "yandex"}}))
+	require.NoError(t, repo.SaveUTMTemplate(ctx, &types.UTMTemplate{UUID: "user-1", Name: "mail", UTM: types.UTM{Source: "digest"}}))
+	require.NoError(t, repo.SaveUTMTemplate(ctx, &types.UTMTemplate{UUID: "user-2", Name: "mail"}))
+
+	templates, err = repo.UTMTemplates(ctx, "user-1")
+	require.NoError(t, err)
+	require.Len(t, templates, 2)
+	assert.Equal(t, "ads", templates[0].Name)
+	assert.Equal(t, "digest", templates[1].Source)
+
+	require.NoError(t, repo.DeleteUTMTemplate(ctx, "user-1", "ads"))
+	err = repo.DeleteUTMTemplate(ctx, "user-1", "ads")
+	assert.True(t, errors.Is(err, shortenerErrors.ErrTemplateNotFound))
+
+	templates, err = repo.UTMTemplates(ctx, "user-2")
+	require.NoError(t, err)
+	assert.Len(t, templates, 1)
+}
@@ -1,14 +1,16 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
-	"github.com/nastradamus39/ya_practicum_go_advanced/internal/utils"
 )
 
 type MemoryRepository struct {
+	mx    sync.RWMutex
 	items map[string]*types.URL
 }
 
@@ -18,19 +20,91 @@ func NewMemoryRepository() *MemoryRepository {
 	}
 }
 
-func (r *MemoryRepository) Save(url *types.URL) error {
-	hash, _ := utils.GetShortURL(url.URL)
+func (r *MemoryRepository) Save(ctx context.Context, url *types.URL) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
 
 	// Дубли не храним
-	if _, exist := r.items[hash]; !exist {
-		r.items[hash] = url
+	if _, exist := r.items[url.Hash]; !exist {
+		r.items[url.Hash] = url
 		return nil
 	} else {
 		return fmt.Errorf("%w", errors.ErrURLConflict)
 	}
 }
 
-func (r *MemoryRepository) FindByHash(hash string) (exist bool, url *types.URL, err error) {
+// Put сохраняет ссылку, заменяя существующую с тем же хешем
+func (r *MemoryRepository) Put(url *types.URL) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.items[url.Hash] = url
+}
+
+// Update заменяет ссылку, если она есть в памяти
+func (r *MemoryRepository) Update(url *types.URL) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if _, ok := r.items[url.Hash]; ok {
+		u := *url
+		r.items[url.Hash] = &u
+	}
+}
+
+// Purge удаляет ссылки, для которых drop вернул true
+func (r *MemoryRepository) Purge(drop func(url *types.URL) bool) (purged []*types.URL) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for hash, item := range r.items {
+		if drop(item) {
+			u := *item
+			purged = append(purged, &u)
+			delete(r.items, hash)
+		}
+	}
+
+	return purged
+}
+
+// Click учитывает переход по ссылке
+func (r *MemoryRepository) Click(hash string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if item, ok := r.items[hash]; ok {
+		item.Clicks++
+	}
+}
+
+// ConsumeClick засчитывает переход по ссылке с лимитом под блокировкой.
+// false - ссылки нет или лимит исчерпан
+func (r *MemoryRepository) ConsumeClick(hash string) (*types.URL, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	item, ok := r.items[hash]
+	if !ok || !consumeClick(item) {
+		return nil, false
+	}
+
+	u := *item
+	return &u, true
+}
+
+// Clear удаляет все ссылки
+func (r *MemoryRepository) Clear() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.items = map[string]*types.URL{}
+}
+
+func (r *MemoryRepository) FindByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
 	exist = false
 	url = nil
 	err = nil
@@ -45,7 +119,40 @@ func (r *MemoryRepository) FindByHash(hash string) (exist bool, url *types.URL,
 	return
 }
 
-func (r *MemoryRepository) FindByUUID(uuid string) (urls map[string]*types.URL, err error) {
+// Walk вызывает fn для каждой ссылки
+func (r *MemoryRepository) Walk(ctx context.Context, fn func(url *types.URL) error) error {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	for _, item := range r.items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListURLs страница ссылок пользователя
+func (r *MemoryRepository) ListURLs(ctx context.Context, q types.URLQuery) (types.URLPage, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	urls := make([]*types.URL, 0)
+	for _, item := range r.items {
+		if matchURL(item, q) {
+			u := *item
+			urls = append(urls, &u)
+		}
+	}
+
+	return pageURLs(urls, q)
+}
+
+func (r *MemoryRepository) FindByUUID(ctx context.Context, uuid string) (urls map[string]*types.URL, err error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
 	urls = map[string]*types.URL{}
 	err = nil
 
@@ -5,6 +5,7 @@
 package storage
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -35,23 +36,37 @@ func (m *Mockrepository) EXPECT() *MockrepositoryMockRecorder {
 }
 
 // DeleteByHash mocks base method.
-func (m *Mockrepository) DeleteByHash(arg0 []string) error {
+func (m *Mockrepository) DeleteByHash(ctx context.Context, uuid string, hashes []string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteByHash", arg0)
+	ret := m.ctrl.Call(m, "DeleteByHash", ctx, uuid, hashes)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // DeleteByHash indicates an expected call of DeleteByHash.
-func (mr *MockrepositoryMockRecorder) DeleteByHash(arg0 interface{}) *gomock.Call {
+func (mr *MockrepositoryMockRecorder) DeleteByHash(ctx, uuid, hashes interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteByHash", reflect.TypeOf((*Mockrepository)(nil).DeleteByHash), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteByHash", reflect.TypeOf((*Mockrepository)(nil).DeleteByHash), ctx, uuid, hashes)
+}
+
+// DeleteUTMTemplate mocks base method.
+func (m *Mockrepository) DeleteUTMTemplate(ctx context.Context, uuid, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUTMTemplate", ctx, uuid, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUTMTemplate indicates an expected call of DeleteUTMTemplate.
+func (mr *MockrepositoryMockRecorder) DeleteUTMTemplate(ctx, uuid, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUTMTemplate", reflect.TypeOf((*Mockrepository)(nil).DeleteUTMTemplate), ctx, uuid, name)
 }
 
 // FindByHash mocks base method.
-func (m *Mockrepository) FindByHash(hash string) (bool, *types.URL, error) {
+func (m *Mockrepository) FindByHash(ctx context.Context, hash string) (bool, *types.URL, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindByHash", hash)
+	ret := m.ctrl.Call(m, "FindByHash", ctx, hash)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(*types.URL)
 	ret2, _ := ret[2].(error)
@@ -59,15 +74,15 @@ func (m *Mockrepository) FindByHash(hash string) (bool, *types.URL, error) {
 }
 
 // FindByHash indicates an expected call of FindByHash.
-func (mr *MockrepositoryMockRecorder) FindByHash(hash interface{}) *gomock.Call {
+func (mr *MockrepositoryMockRecorder) FindByHash(ctx, hash interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByHash", reflect.TypeOf((*Mockrepository)(nil).FindByHash), hash)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByHash", reflect.TypeOf((*Mockrepository)(nil).FindByHash), ctx, hash)
 }
 
 // FindByUUID mocks base method.
-func (m *Mockrepository) FindByUUID(uuid string) (bool, map[string]*types.URL, error) {
+func (m *Mockrepository) FindByUUID(ctx context.Context, uuid string) (bool, map[string]*types.URL, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindByUUID", uuid)
+	ret := m.ctrl.Call(m, "FindByUUID", ctx, uuid)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(map[string]*types.URL)
 	ret2, _ := ret[2].(error)
@@ -75,83 +90,205 @@ func (m *Mockrepository) FindByUUID(uuid string) (bool, map[string]*types.URL, e
 }
 
 // FindByUUID indicates an expected call of FindByUUID.
-func (mr *MockrepositoryMockRecorder) FindByUUID(uuid interface{}) *gomock.Call {
+func (mr *MockrepositoryMockRecorder) FindByUUID(ctx, uuid interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByUUID", reflect.TypeOf((*Mockrepository)(nil).FindByUUID), uuid)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByUUID", reflect.TypeOf((*Mockrepository)(nil).FindByUUID), ctx, uuid)
 }
 
 // Save mocks base method.
-func (m *Mockrepository) Save(url *types.URL) error {
+func (m *Mockrepository) Save(ctx context.Context, url *types.URL) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Save", url)
+	ret := m.ctrl.Call(m, "Save", ctx, url)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Save indicates an expected call of Save.
-func (mr *MockrepositoryMockRecorder) Save(url interface{}) *gomock.Call {
+func (mr *MockrepositoryMockRecorder) Save(ctx, url interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*Mockrepository)(nil).Save), url)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*Mockrepository)(nil).Save), ctx, url)
 }
 
-// Mockstore is a mock of store interface.
-type Mockstore struct {
-	ctrl     *gomock.Controller
-	recorder *MockstoreMockRecorder
+// SaveUTMTemplate mocks base method.
+func (m *Mockrepository) SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveUTMTemplate", ctx, template)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-func (m *Mockstore) Statistic() types.Statistic {
-	//TODO implement me
-	panic("implement me")
+// SaveUTMTemplate indicates an expected call of SaveUTMTemplate.
+func (mr *MockrepositoryMockRecorder) SaveUTMTemplate(ctx, template interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUTMTemplate", reflect.TypeOf((*Mockrepository)(nil).SaveUTMTemplate), ctx, template)
 }
 
-// MockstoreMockRecorder is the mock recorder for Mockstore.
-type MockstoreMockRecorder struct {
-	mock *Mockstore
+// UTMTemplates mocks base method.
+func (m *Mockrepository) UTMTemplates(ctx context.Context, uuid string) ([]types.UTMTemplate, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UTMTemplates", ctx, uuid)
+	ret0, _ := ret[0].([]types.UTMTemplate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UTMTemplates indicates an expected call of UTMTemplates.
+func (mr *MockrepositoryMockRecorder) UTMTemplates(ctx, uuid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UTMTemplates", reflect.TypeOf((*Mockrepository)(nil).UTMTemplates), ctx, uuid)
 }
 
-// NewMockstore creates a new mock instance.
-func NewMockstore(ctrl *gomock.Controller) *Mockstore {
-	mock := &Mockstore{ctrl: ctrl}
-	mock.recorder = &MockstoreMockRecorder{mock}
+// Walk mocks base method.
+func (m *Mockrepository) Walk(ctx context.Context, fn func(*types.URL) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Walk", ctx, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Walk indicates an expected call of Walk.
+func (mr *MockrepositoryMockRecorder) Walk(ctx, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Walk", reflect.TypeOf((*Mockrepository)(nil).Walk), ctx, fn)
+}
+
+// MockStore is a mock of Store interface.
+type MockStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockStoreMockRecorder
+}
+
+// MockStoreMockRecorder is the mock recorder for MockStore.
+type MockStoreMockRecorder struct {
+	mock *MockStore
+}
+
+// NewMockStore creates a new mock instance.
+func NewMockStore(ctrl *gomock.Controller) *MockStore {
+	mock := &MockStore{ctrl: ctrl}
+	mock.recorder = &MockStoreMockRecorder{mock}
 	return mock
 }
 
 // EXPECT returns an object that allows the caller to indicate expected use.
-func (m *Mockstore) EXPECT() *MockstoreMockRecorder {
+func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 	return m.recorder
 }
 
+// CheckConsistency mocks base method.
+func (m *MockStore) CheckConsistency(ctx context.Context, source string, repair bool) (types.ConsistencyReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckConsistency", ctx, source, repair)
+	ret0, _ := ret[0].(types.ConsistencyReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckConsistency indicates an expected call of CheckConsistency.
+func (mr *MockStoreMockRecorder) CheckConsistency(ctx, source, repair interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckConsistency", reflect.TypeOf((*MockStore)(nil).CheckConsistency), ctx, source, repair)
+}
+
+// Click mocks base method.
+func (m *MockStore) Click(hash string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Click", hash)
+}
+
+// Click indicates an expected call of Click.
+func (mr *MockStoreMockRecorder) Click(hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Click", reflect.TypeOf((*MockStore)(nil).Click), hash)
+}
+
+// Close mocks base method.
+func (m *MockStore) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockStoreMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockStore)(nil).Close))
+}
+
+// ConsumeClick mocks base method.
+func (m *MockStore) ConsumeClick(ctx context.Context, hash string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeClick", ctx, hash)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumeClick indicates an expected call of ConsumeClick.
+func (mr *MockStoreMockRecorder) ConsumeClick(ctx, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeClick", reflect.TypeOf((*MockStore)(nil).ConsumeClick), ctx, hash)
+}
+
 // DeleteByHash mocks base method.
-func (m *Mockstore) DeleteByHash(arg0 []string) error {
+func (m *MockStore) DeleteByHash(ctx context.Context, uuid string, hashes []string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteByHash", arg0)
+	ret := m.ctrl.Call(m, "DeleteByHash", ctx, uuid, hashes)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // DeleteByHash indicates an expected call of DeleteByHash.
-func (mr *MockstoreMockRecorder) DeleteByHash(arg0 interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) DeleteByHash(ctx, uuid, hashes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteByHash", reflect.TypeOf((*MockStore)(nil).DeleteByHash), ctx, uuid, hashes)
+}
+
+// DeleteUTMTemplate mocks base method.
+func (m *MockStore) DeleteUTMTemplate(ctx context.Context, uuid, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUTMTemplate", ctx, uuid, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUTMTemplate indicates an expected call of DeleteUTMTemplate.
+func (mr *MockStoreMockRecorder) DeleteUTMTemplate(ctx, uuid, name interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteByHash", reflect.TypeOf((*Mockstore)(nil).DeleteByHash), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUTMTemplate", reflect.TypeOf((*MockStore)(nil).DeleteUTMTemplate), ctx, uuid, name)
 }
 
 // Drop mocks base method.
-func (m *Mockstore) Drop() {
+func (m *MockStore) Drop() {
 	m.ctrl.T.Helper()
 	m.ctrl.Call(m, "Drop")
 }
 
 // Drop indicates an expected call of Drop.
-func (mr *MockstoreMockRecorder) Drop() *gomock.Call {
+func (mr *MockStoreMockRecorder) Drop() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Drop", reflect.TypeOf((*MockStore)(nil).Drop))
+}
+
+// Export mocks base method.
+func (m *MockStore) Export(ctx context.Context, uuid string, fn func(*types.URL) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Export", ctx, uuid, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Export indicates an expected call of Export.
+func (mr *MockStoreMockRecorder) Export(ctx, uuid, fn interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Drop", reflect.TypeOf((*Mockstore)(nil).Drop))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Export", reflect.TypeOf((*MockStore)(nil).Export), ctx, uuid, fn)
 }
 
 // FindByHash mocks base method.
-func (m *Mockstore) FindByHash(hash string) (bool, *types.URL, error) {
+func (m *MockStore) FindByHash(ctx context.Context, hash string) (bool, *types.URL, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindByHash", hash)
+	ret := m.ctrl.Call(m, "FindByHash", ctx, hash)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(*types.URL)
 	ret2, _ := ret[2].(error)
@@ -159,64 +296,196 @@ func (m *Mockstore) FindByHash(hash string) (bool, *types.URL, error) {
 }
 
 // FindByHash indicates an expected call of FindByHash.
-func (mr *MockstoreMockRecorder) FindByHash(hash interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) FindByHash(ctx, hash interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByHash", reflect.TypeOf((*Mockstore)(nil).FindByHash), hash)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByHash", reflect.TypeOf((*MockStore)(nil).FindByHash), ctx, hash)
 }
 
 // FindByUUID mocks base method.
-func (m *Mockstore) FindByUUID(uuid string) (map[string]*types.URL, error) {
+func (m *MockStore) FindByUUID(ctx context.Context, uuid string) (map[string]*types.URL, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindByUUID", uuid)
+	ret := m.ctrl.Call(m, "FindByUUID", ctx, uuid)
 	ret0, _ := ret[0].(map[string]*types.URL)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // FindByUUID indicates an expected call of FindByUUID.
-func (mr *MockstoreMockRecorder) FindByUUID(uuid interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) FindByUUID(ctx, uuid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByUUID", reflect.TypeOf((*MockStore)(nil).FindByUUID), ctx, uuid)
+}
+
+// Health mocks base method.
+func (m *MockStore) Health() types.Health {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Health")
+	ret0, _ := ret[0].(types.Health)
+	return ret0
+}
+
+// Health indicates an expected call of Health.
+func (mr *MockStoreMockRecorder) Health() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Health", reflect.TypeOf((*MockStore)(nil).Health))
+}
+
+// Import mocks base method.
+func (m *MockStore) Import(ctx context.Context, urls []*types.URL) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Import", ctx, urls)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Import indicates an expected call of Import.
+func (mr *MockStoreMockRecorder) Import(ctx, urls interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByUUID", reflect.TypeOf((*Mockstore)(nil).FindByUUID), uuid)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Import", reflect.TypeOf((*MockStore)(nil).Import), ctx, urls)
+}
+
+// ListURLs mocks base method.
+func (m *MockStore) ListURLs(ctx context.Context, q types.URLQuery) (types.URLPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListURLs", ctx, q)
+	ret0, _ := ret[0].(types.URLPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListURLs indicates an expected call of ListURLs.
+func (mr *MockStoreMockRecorder) ListURLs(ctx, q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListURLs", reflect.TypeOf((*MockStore)(nil).ListURLs), ctx, q)
 }
 
 // Ping mocks base method.
-func (m *Mockstore) Ping() error {
+func (m *MockStore) Ping(ctx context.Context) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Ping")
+	ret := m.ctrl.Call(m, "Ping", ctx)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Ping indicates an expected call of Ping.
-func (mr *MockstoreMockRecorder) Ping() *gomock.Call {
+func (mr *MockStoreMockRecorder) Ping(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockStore)(nil).Ping), ctx)
+}
+
+// RestoreByHash mocks base method.
+func (m *MockStore) RestoreByHash(ctx context.Context, uuid string, hashes []string) (types.RestoreResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestoreByHash", ctx, uuid, hashes)
+	ret0, _ := ret[0].(types.RestoreResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RestoreByHash indicates an expected call of RestoreByHash.
+func (mr *MockStoreMockRecorder) RestoreByHash(ctx, uuid, hashes interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*Mockstore)(nil).Ping))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreByHash", reflect.TypeOf((*MockStore)(nil).RestoreByHash), ctx, uuid, hashes)
 }
 
 // Save mocks base method.
-func (m *Mockstore) Save(url *types.URL) error {
+func (m *MockStore) Save(ctx context.Context, url *types.URL) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Save", url)
+	ret := m.ctrl.Call(m, "Save", ctx, url)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Save indicates an expected call of Save.
-func (mr *MockstoreMockRecorder) Save(url interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) Save(ctx, url interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*Mockstore)(nil).Save), url)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockStore)(nil).Save), ctx, url)
 }
 
 // SaveBatch mocks base method.
-func (m *Mockstore) SaveBatch(urls []*types.URL) error {
+func (m *MockStore) SaveBatch(ctx context.Context, urls []*types.URL) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveBatch", urls)
+	ret := m.ctrl.Call(m, "SaveBatch", ctx, urls)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SaveBatch indicates an expected call of SaveBatch.
-func (mr *MockstoreMockRecorder) SaveBatch(urls interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) SaveBatch(ctx, urls interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveBatch", reflect.TypeOf((*MockStore)(nil).SaveBatch), ctx, urls)
+}
+
+// SaveUTMTemplate mocks base method.
+func (m *MockStore) SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveUTMTemplate", ctx, template)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveUTMTemplate indicates an expected call of SaveUTMTemplate.
+func (mr *MockStoreMockRecorder) SaveUTMTemplate(ctx, template interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUTMTemplate", reflect.TypeOf((*MockStore)(nil).SaveUTMTemplate), ctx, template)
+}
+
+// Statistic mocks base method.
+func (m *MockStore) Statistic(ctx context.Context) types.Statistic {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Statistic", ctx)
+	ret0, _ := ret[0].(types.Statistic)
+	return ret0
+}
+
+// Statistic indicates an expected call of Statistic.
+func (mr *MockStoreMockRecorder) Statistic(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Statistic", reflect.TypeOf((*MockStore)(nil).Statistic), ctx)
+}
+
+// URLHistory mocks base method.
+func (m *MockStore) URLHistory(ctx context.Context, uuid, hash string) ([]types.URLRevision, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "URLHistory", ctx, uuid, hash)
+	ret0, _ := ret[0].([]types.URLRevision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// URLHistory indicates an expected call of URLHistory.
+func (mr *MockStoreMockRecorder) URLHistory(ctx, uuid, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "URLHistory", reflect.TypeOf((*MockStore)(nil).URLHistory), ctx, uuid, hash)
+}
+
+// UTMTemplates mocks base method.
+func (m *MockStore) UTMTemplates(ctx context.Context, uuid string) ([]types.UTMTemplate, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UTMTemplates", ctx, uuid)
+	ret0, _ := ret[0].([]types.UTMTemplate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UTMTemplates indicates an expected call of UTMTemplates.
+func (mr *MockStoreMockRecorder) UTMTemplates(ctx, uuid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UTMTemplates", reflect.TypeOf((*MockStore)(nil).UTMTemplates), ctx, uuid)
+}
+
+// UpdateURL mocks base method.
+func (m *MockStore) UpdateURL(ctx context.Context, uuid, hash string, update types.URLUpdate) (*types.URL, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateURL", ctx, uuid, hash, update)
+	ret0, _ := ret[0].(*types.URL)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateURL indicates an expected call of UpdateURL.
+func (mr *MockStoreMockRecorder) UpdateURL(ctx, uuid, hash, update interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveBatch", reflect.TypeOf((*Mockstore)(nil).SaveBatch), urls)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateURL", reflect.TypeOf((*MockStore)(nil).UpdateURL), ctx, uuid, hash, update)
 }
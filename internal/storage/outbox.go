@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// Операции, которые откладываются в outbox
+const (
+	outboxOpSave      = "save"
+	outboxOpSaveBatch = "save_batch"
+	outboxOpDelete    = "delete"
+)
+
+// dbWriter операции записи в бд, которые умеет повторять outbox
+type dbWriter interface {
+	Save(ctx context.Context, url *types.URL) error
+	SaveBatch(ctx context.Context, urls []*types.URL) error
+	DeleteByHash(ctx context.Context, uuid string, hashes []string) error
+}
+
+// outboxEntry отложенная операция с бд
+type outboxEntry struct {
+	ID     int64        `json:"id"`
+	Op     string       `json:"op"`
+	URLs   []*types.URL `json:"urls,omitempty"`
+	Hashes []string     `json:"hashes,omitempty"`
+	// UUID владелец удаляемых ссылок. В очередях старых версий пустой
+	UUID     string `json:"uuid,omitempty"`
+	Attempts int    `json:"attempts"`
+	// Error последняя ошибка. Пишется только в файл отброшенных операций
+	Error string `json:"error,omitempty"`
+}
+
+// Outbox очередь записей в бд, которые не удалось выполнить.
+// Очередь хранится в файле и переживает перезапуск, фоновый Run
+// повторяет операции по порядку с экспоненциальной задержкой.
+// Операции, которые бд отвергла, и те, что не прошли за maxAttempts
+// попыток, уходят в файл path.dead и больше не держат очередь
+type Outbox struct {
+	mx      sync.Mutex
+	path    string
+	entries []*outboxEntry
+	nextID  int64
+	db      dbWriter
+	wake    chan struct{}
+
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+// NewOutbox открывает очередь в файле path. Операции из файла,
+// оставшиеся с прошлого запуска, будут повторены. maxAttempts 0 -
+// повторять, пока не получится
+func NewOutbox(path string, db dbWriter, minBackoff time.Duration, maxBackoff time.Duration, maxAttempts int) (*Outbox, error) {
+	o := &Outbox{
+		path:        path,
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		maxAttempts: maxAttempts,
+	}
+
+	if o.minBackoff <= 0 {
+		o.minBackoff = time.Second
+	}
+	if o.maxBackoff < o.minBackoff {
+		o.maxBackoff = o.minBackoff
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &o.entries); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range o.entries {
+		if entry.ID >= o.nextID {
+			o.nextID = entry.ID + 1
+		}
+	}
+
+	return o, nil
+}
+
+// Enqueue откладывает операцию entry и будит фоновый повтор
+func (o *Outbox) Enqueue(entry outboxEntry) error {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	entry.ID = o.nextID
+	entry.Attempts = 0
+	o.entries = append(o.entries, &entry)
+	o.nextID++
+
+	if err := o.persist(); err != nil {
+		// не записали на диск - в очереди операции тоже нет
+		o.entries = o.entries[:len(o.entries)-1]
+		return err
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Depth количество операций в очереди
+func (o *Outbox) Depth() int {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	return len(o.entries)
+}
+
+// Run повторяет операции из очереди, пока не отменят ctx
+func (o *Outbox) Run(ctx context.Context) {
+	backoff := o.minBackoff
+
+	for {
+		entry := o.head()
+
+		if entry == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+				continue
+			}
+		}
+
+		err := o.apply(ctx, entry)
+		if err == nil {
+			o.remove(entry.ID)
+			backoff = o.minBackoff
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		attempts := o.failed(entry.ID)
+		if !isDBFailure(err) || (o.maxAttempts > 0 && attempts >= o.maxAttempts) {
+			log.Printf("Outbox. Операция %s отброшена после %d попыток. %s", entry.Op, attempts, err)
+			o.discard(entry, err)
+			backoff = o.minBackoff
+			continue
+		}
+
+		log.Printf("Outbox. Не удалось повторить %s (попытка %d), следующая через %s. %s", entry.Op, attempts, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > o.maxBackoff {
+			backoff = o.maxBackoff
+		}
+	}
+}
+
+// apply выполняет отложенную операцию в бд
+func (o *Outbox) apply(ctx context.Context, entry *outboxEntry) error {
+	switch entry.Op {
+	case outboxOpSave:
+		for _, url := range entry.URLs {
+			err := o.db.Save(ctx, url)
+			// ссылка уже в бд - операция выполнена
+			if err != nil && !errors.Is(err, shortenerErrors.ErrURLConflict) {
+				return err
+			}
+		}
+		return nil
+	case outboxOpSaveBatch:
+		err := o.db.SaveBatch(ctx, entry.URLs)
+		if !errors.Is(err, shortenerErrors.ErrURLConflict) {
+			return err
+		}
+		// часть пачки уже в бд - досохраняем по одной
+		return o.apply(ctx, &outboxEntry{Op: outboxOpSave, URLs: entry.URLs})
+	case outboxOpDelete:
+		return o.db.DeleteByHash(ctx, entry.UUID, entry.Hashes)
+	default:
+		log.Printf("Outbox. Неизвестная операция %s пропущена", entry.Op)
+		return nil
+	}
+}
+
+// head первая операция в очереди
+func (o *Outbox) head() *outboxEntry {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if len(o.entries) == 0 {
+		return nil
+	}
+
+	return o.entries[0]
+}
+
+// remove убирает выполненную операцию из очереди
+func (o *Outbox) remove(id int64) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	for i, entry := range o.entries {
+		if entry.ID == id {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			break
+		}
+	}
+
+	if err := o.persist(); err != nil {
+		log.Printf("Outbox. %s", err)
+	}
+}
+
+// discard переносит операцию entry, которую не удалось выполнить с
+// ошибкой err, в файл отброшенных операций и убирает из очереди.
+// Если записать не удалось, операция остается в очереди
+func (o *Outbox) discard(entry *outboxEntry, err error) {
+	dead := *entry
+	dead.Error = err.Error()
+
+	data, err := json.Marshal(dead)
+	if err != nil {
+		log.Printf("Outbox. %s", err)
+		return
+	}
+
+	file, err := os.OpenFile(o.path+".dead", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Outbox. %s", err)
+		return
+	}
+
+	if _, err = file.Write(append(data, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Outbox. %s", err)
+		return
+	}
+
+	o.remove(entry.ID)
+}
+
+// failed учитывает неудачную попытку и возвращает их количество
+func (o *Outbox) failed(id int64) (attempts int) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	for _, entry := range o.entries {
+		if entry.ID == id {
+			entry.Attempts++
+			attempts = entry.Attempts
+			break
+		}
+	}
+
+	if err := o.persist(); err != nil {
+		log.Printf("Outbox. %s", err)
+	}
+
+	return attempts
+}
+
+// persist перезаписывает файл очереди. Вызывается под o.mx
+func (o *Outbox) persist() error {
+	data, err := json.Marshal(o.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := o.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, o.path)
+}
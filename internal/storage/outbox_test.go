@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDB бд, которая отвечает ошибкой первые failures раз. Как и
+// DBRepository, сохраненный хеш повторно не пишет - ErrURLConflict, пачку с
+// таким хешем не пишет целиком. Хеши из rejected бд не принимает
+type flakyDB struct {
+	mx       sync.Mutex
+	failures int
+	rejected map[string]bool
+	saved    []string
+	deleted  []string
+	owners   []string
+}
+
+func (db *flakyDB) fail() error {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+
+	if db.failures > 0 {
+		db.failures--
+		return errors.New("connection refused")
+	}
+
+	return nil
+}
+
+// reject ошибка бд на ссылку, которую она не примет ни с какой попытки
+func (db *flakyDB) reject(urls []*types.URL) error {
+	for _, url := range urls {
+		if db.rejected[url.Hash] {
+			return &pq.Error{Code: "22001", Message: "value too long for type character varying(256)"}
+		}
+	}
+
+	return nil
+}
+
+// conflict ошибка бд на уже сохраненный хеш. Вызывается под db.mx
+func (db *flakyDB) conflict(urls []*types.URL) error {
+	for _, url := range urls {
+		for _, hash := range db.saved {
+			if hash == url.Hash {
+				return fmt.Errorf("%w", shortenerErrors.ErrURLConflict)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *flakyDB) Save(ctx context.Context, url *types.URL) error {
+	return db.SaveBatch(ctx, []*types.URL{url})
+}
+
+func (db *flakyDB) SaveBatch(ctx context.Context, urls []*types.URL) error {
+	if err := db.reject(urls); err != nil {
+		return err
+	}
+	if err := db.fail(); err != nil {
+		return err
+	}
+
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	if err := db.conflict(urls); err != nil {
+		return err
+	}
+	for _, url := range urls {
+		db.saved = append(db.saved, url.Hash)
+	}
+
+	return nil
+}
+
+func (db *flakyDB) DeleteByHash(ctx context.Context, uuid string, hashes []string) error {
+	if err := db.fail(); err != nil {
+		return err
+	}
+
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	db.deleted = append(db.deleted, hashes...)
+	db.owners = append(db.owners, uuid)
+
+	return nil
+}
+
+// TestOutboxReplay операции переживают перезапуск и повторяются по порядку
+func TestOutboxReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	db := &flakyDB{failures: 2}
+
+	outbox, err := NewOutbox(path, db, time.Millisecond, 4*time.Millisecond, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpSave, URLs: []*types.URL{{Hash: "hash-1"}}}))
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpSaveBatch, URLs: []*types.URL{{Hash: "hash-2"}, {Hash: "hash-3"}}}))
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpDelete, UUID: "user-1", Hashes: []string{"hash-1"}}))
+	assert.Equal(t, 3, outbox.Depth())
+
+	// "перезапуск": очередь читается из файла
+	outbox, err = NewOutbox(path, db, time.Millisecond, 4*time.Millisecond, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, outbox.Depth())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go outbox.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return outbox.Depth() == 0
+	}, time.Second, time.Millisecond)
+
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	assert.Equal(t, []string{"hash-1", "hash-2", "hash-3"}, db.saved)
+	assert.Equal(t, []string{"hash-1"}, db.deleted)
+	assert.Equal(t, []string{"user-1"}, db.owners)
+
+	// очередь пуста и на диске
+	restored, err := NewOutbox(path, db, time.Millisecond, time.Millisecond, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, restored.Depth())
+}
+
+// TestOutboxConflict пачка, часть которой уже в бд, досохраняется по одной
+func TestOutboxConflict(t *testing.T) {
+	db := &flakyDB{saved: []string{"hash-2"}}
+
+	outbox, err := NewOutbox(filepath.Join(t.TempDir(), "outbox"), db, time.Millisecond, time.Millisecond, 3)
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpSaveBatch, URLs: []*types.URL{{Hash: "hash-1"}, {Hash: "hash-2"}, {Hash: "hash-3"}}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go outbox.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return outbox.Depth() == 0
+	}, time.Second, time.Millisecond)
+
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	assert.Equal(t, []string{"hash-2", "hash-1", "hash-3"}, db.saved)
+}
+
+// TestOutboxDeadLetter отвергнутая бд операция и операция, исчерпавшая
+// попытки, уходят в файл отброшенных и не держат очередь
+func TestOutboxDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	// hash-1 не влезает в колонку - бд отвечает ошибкой запроса, а не сбоем
+	db := &flakyDB{failures: 3, rejected: map[string]bool{"hash-1": true}}
+
+	outbox, err := NewOutbox(path, db, time.Millisecond, time.Millisecond, 3)
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpSave, URLs: []*types.URL{{Hash: "hash-1"}}}))
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpSave, URLs: []*types.URL{{Hash: "hash-2"}}}))
+	require.NoError(t, outbox.Enqueue(outboxEntry{Op: outboxOpSave, URLs: []*types.URL{{Hash: "hash-3"}}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go outbox.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return outbox.Depth() == 0
+	}, time.Second, time.Millisecond)
+
+	// hash-2 съел все три сбоя и отброшен, hash-3 записан
+	db.mx.Lock()
+	assert.Equal(t, []string{"hash-3"}, db.saved)
+	db.mx.Unlock()
+
+	data, err := ioutil.ReadFile(path + ".dead")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var dead outboxEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &dead))
+	assert.Equal(t, []string{"hash-1"}, []string{dead.URLs[0].Hash})
+	assert.Equal(t, 1, dead.Attempts)
+	assert.Contains(t, dead.Error, "value too long")
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &dead))
+	assert.Equal(t, []string{"hash-2"}, []string{dead.URLs[0].Hash})
+	assert.Equal(t, 3, dead.Attempts)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// epoch время создания ссылок, сохраненных до появления created_at
+var epoch = time.Unix(0, 0).UTC()
+
+// urlCursor позиция в выборке: ключ сортировки и хеш последней отданной ссылки
+type urlCursor struct {
+	Sort    string    `json:"s"`
+	Created time.Time `json:"t"`
+	Clicks  int64     `json:"c"`
+	Hash    string    `json:"h"`
+}
+
+// normalizeQuery значения выборки по умолчанию
+func normalizeQuery(q types.URLQuery) types.URLQuery {
+	if q.Sort == "" {
+		q.Sort = types.SortCreated
+	}
+	if q.Now.IsZero() {
+		q.Now = time.Now()
+	}
+	q.Domain = strings.ToLower(strings.TrimSpace(q.Domain))
+
+	return q
+}
+
+// encodeCursor курсор, указывающий на url
+func encodeCursor(q types.URLQuery, url *types.URL) string {
+	data, _ := json.Marshal(urlCursor{
+		Sort:    q.Sort,
+		Created: createdKey(url),
+		Clicks:  url.Clicks,
+		Hash:    url.Hash,
+	})
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor разбирает курсор выборки. nil - выборка с начала
+func decodeCursor(q types.URLQuery) (*urlCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrInvalidCursor)
+	}
+
+	cursor := &urlCursor{}
+	if err = json.Unmarshal(data, cursor); err != nil || cursor.Sort != q.Sort || cursor.Hash == "" {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrInvalidCursor)
+	}
+
+	return cursor, nil
+}
+
+// urlDomain хост урла в нижнем регистре. Пусто, если урл не разбирается
+func urlDomain(raw string) string {
+	u, err := neturl.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// createdKey время создания для сортировки
+func createdKey(url *types.URL) time.Time {
+	if !url.CreatedAt.Valid {
+		return epoch
+	}
+
+	return url.CreatedAt.Time.UTC()
+}
+
+// matchURL подходит ли ссылка под фильтры выборки. Для памяти и файла,
+// бд фильтрует сама
+func matchURL(url *types.URL, q types.URLQuery) bool {
+	if url.UUID != q.UUID {
+		return false
+	}
+	if q.Deleted != nil && url.DeletedAt.Valid != *q.Deleted {
+		return false
+	}
+	if q.Expired != nil && url.Expired(q.Now) != *q.Expired {
+		return false
+	}
+	if q.Domain != "" {
+		domain := urlDomain(url.URL)
+		if domain != q.Domain && !strings.HasSuffix(domain, "."+q.Domain) {
+			return false
+		}
+	}
+	if q.Search != "" && !strings.Contains(strings.ToLower(url.URL), strings.ToLower(q.Search)) {
+		return false
+	}
+
+	return true
+}
+
+// compareURLs порядок двух ссылок по возрастанию ключа сортировки, затем хеша
+func compareURLs(sortBy string, a *types.URL, b *types.URL) int {
+	switch sortBy {
+	case types.SortClicks:
+		if a.Clicks != b.Clicks {
+			if a.Clicks < b.Clicks {
+				return -1
+			}
+			return 1
+		}
+	default:
+		if ak, bk := createdKey(a), createdKey(b); !ak.Equal(bk) {
+			if ak.Before(bk) {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return strings.Compare(a.Hash, b.Hash)
+}
+
+// pageURLs сортирует отфильтрованные ссылки и вырезает страницу после курсора
+func pageURLs(urls []*types.URL, q types.URLQuery) (page types.URLPage, err error) {
+	cursor, err := decodeCursor(q)
+	if err != nil {
+		return page, err
+	}
+
+	less := func(a *types.URL, b *types.URL) bool {
+		c := compareURLs(q.Sort, a, b)
+		if q.Asc {
+			return c < 0
+		}
+		return c > 0
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		return less(urls[i], urls[j])
+	})
+
+	page.Total = len(urls)
+
+	if cursor != nil {
+		last := &types.URL{
+			Hash:      cursor.Hash,
+			Clicks:    cursor.Clicks,
+			CreatedAt: sql.NullTime{Time: cursor.Created, Valid: true},
+		}
+		urls = urls[sort.Search(len(urls), func(i int) bool {
+			return less(last, urls[i])
+		}):]
+	}
+
+	if q.Limit > 0 && len(urls) > q.Limit {
+		urls = urls[:q.Limit]
+		page.NextCursor = encodeCursor(q, urls[len(urls)-1])
+	}
+
+	page.URLs = urls
+
+	return page, nil
+}
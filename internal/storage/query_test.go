@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type urlLister interface {
+	ListURLs(ctx context.Context, q types.URLQuery) (types.URLPage, error)
+}
+
+// listedURLs ссылки для выборок. Ссылка без created_at сохранена до его появления
+func listedURLs(start time.Time) []*types.URL {
+	at := func(hours int) sql.NullTime {
+		return sql.NullTime{Time: start.Add(time.Duration(hours) * time.Hour), Valid: true}
+	}
+
+	return []*types.URL{
+		{UUID: "user-1", Hash: "hash-1", URL: "https://ya.ru/a", CreatedAt: at(1), Clicks: 5},
+		{UUID: "user-1", Hash: "hash-2", URL: "https://news.ya.ru/b", CreatedAt: at(2), Clicks: 1},
+		{UUID: "user-1", Hash: "hash-3", URL: "https://google.com/News", CreatedAt: at(3), Clicks: 5,
+			DeletedAt: sql.NullTime{Time: time.Date(2022, 5, 2, 0, 0, 0, 0, time.UTC), Valid: true}},
+		{UUID: "user-1", Hash: "hash-4", URL: "https://example.com", CreatedAt: at(4), ExpiresAt: at(5)},
+		{UUID: "user-2", Hash: "hash-5", URL: "https://ya.ru/other", CreatedAt: at(5)},
+		{UUID: "user-1", Hash: "hash-6", URL: "https://old.ru"},
+	}
+}
+
+// listHashes обходит выборку страницами по две ссылки
+func listHashes(t *testing.T, repo urlLister, q types.URLQuery) []string {
+	q.UUID = "user-1"
+	q.Limit = 2
+	q = normalizeQuery(q)
+
+	hashes := []string{}
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 10, "курсор не продвигается")
+
+		page, err := repo.ListURLs(context.Background(), q)
+		require.NoError(t, err)
+
+		for _, url := range page.URLs {
+			hashes = append(hashes, url.Hash)
+		}
+
+		if page.NextCursor == "" {
+			assert.Equal(t, page.Total, len(hashes))
+			return hashes
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// TestListURLs выборки одинаковы в памяти, файле и бд
+func TestListURLs(t *testing.T) {
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	now := start.Add(10 * time.Hour)
+	yes, no := true, false
+	ctx := context.Background()
+
+	memory := NewMemoryRepository()
+	for _, url := range listedURLs(start) {
+		require.NoError(t, memory.Save(ctx, url))
+	}
+
+	file, err := NewFileRepository(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer file.Close()
+	for _, url := range listedURLs(start) {
+		require.NoError(t, file.Save(ctx, url))
+	}
+
+	db := newTestSQLiteRepository(t)
+	require.NoError(t, db.Replace(ctx, listedURLs(start)))
+
+	repos := map[string]urlLister{TierMemory: memory, TierFile: file, TierDB: db}
+
+	tests := []struct {
+		name  string
+		query types.URLQuery
+		want  []string
+	}{
+		{"сначала новые", types.URLQuery{}, []string{"hash-4", "hash-3", "hash-2", "hash-1", "hash-6"}},
+		{"сначала старые", types.URLQuery{Asc: true}, []string{"hash-6", "hash-1", "hash-2", "hash-3", "hash-4"}},
+		{"по переходам", types.URLQuery{Sort: types.SortClicks}, []string{"hash-3", "hash-1", "hash-2", "hash-6", "hash-4"}},
+		{"без удаленных", types.URLQuery{Deleted: &no}, []string{"hash-4", "hash-2", "hash-1", "hash-6"}},
+		{"только удаленные", types.URLQuery{Deleted: &yes}, []string{"hash-3"}},
+		{"без истекших", types.URLQuery{Expired: &no, Now: now}, []string{"hash-3", "hash-2", "hash-1", "hash-6"}},
+		{"только истекшие", types.URLQuery{Expired: &yes, Now: now}, []string{"hash-4"}},
+		{"домен с поддоменами", types.URLQuery{Domain: "YA.ru"}, []string{"hash-2", "hash-1"}},
+		{"подстрока без учета регистра", types.URLQuery{Search: "NEWS"}, []string{"hash-3", "hash-2"}},
+		{"подстрока со спецсимволами", types.URLQuery{Search: "%"}, []string{}},
+	}
+
+	for tier, repo := range repos {
+		for _, tt := range tests {
+			t.Run(tier+"/"+tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, listHashes(t, repo, tt.query))
+			})
+		}
+
+		t.Run(tier+"/курсор", func(t *testing.T) {
+			q := normalizeQuery(types.URLQuery{UUID: "user-1", Limit: 1})
+			page, err := repo.ListURLs(ctx, q)
+			require.NoError(t, err)
+			assert.Equal(t, 5, page.Total)
+
+			q.Sort, q.Cursor = types.SortClicks, page.NextCursor
+			_, err = repo.ListURLs(ctx, q)
+			assert.True(t, errors.Is(err, shortenerErrors.ErrInvalidCursor))
+
+			q.Cursor = "!!!"
+			_, err = repo.ListURLs(ctx, q)
+			assert.True(t, errors.Is(err, shortenerErrors.ErrInvalidCursor))
+		})
+	}
+}
+
+// TestClickCounter переходы копятся и пачкой пишутся в бд, неудачная запись не теряет их
+func TestClickCounter(t *testing.T) {
+	db := newTestSQLiteRepository(t)
+	ctx := context.Background()
+
+	require.NoError(t, db.Save(ctx, &types.URL{UUID: "user-1", Hash: "hash-1", URL: "https://ya.ru"}))
+
+	clicks := newClickCounter(db)
+	clicks.Add("hash-1")
+	clicks.Add("hash-1")
+	require.NoError(t, clicks.Flush(ctx))
+
+	clicks.Add("hash-1")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, clicks.Flush(canceled))
+	require.NoError(t, clicks.Flush(ctx))
+
+	_, url, err := db.FindByHash(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), url.Clicks)
+}
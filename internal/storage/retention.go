@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// purgeBatch сколько ссылок удаляется из бд за одну транзакцию
+const purgeBatch = 1000
+
+// Причины очистки ссылки
+const (
+	purgeReasonDeleted = "deleted"
+	purgeReasonExpired = "expired"
+)
+
+// purgeRecord запись журнала очистки
+type purgeRecord struct {
+	PurgedAt  time.Time  `json:"purged_at"`
+	Reason    string     `json:"reason"`
+	Hash      string     `json:"hash"`
+	UUID      string     `json:"uuid"`
+	URL       string     `json:"url"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newPurgeRecord(url *types.URL, before time.Time, now time.Time) purgeRecord {
+	record := purgeRecord{
+		PurgedAt: now,
+		Reason:   purgeReasonExpired,
+		Hash:     url.Hash,
+		UUID:     url.UUID,
+		URL:      url.URL,
+	}
+
+	if url.DeletedAt.Valid && url.DeletedAt.Time.Before(before) {
+		record.Reason = purgeReasonDeleted
+	}
+
+	record.CreatedAt = nullTimePtr(url.CreatedAt)
+	record.DeletedAt = nullTimePtr(url.DeletedAt)
+	record.ExpiresAt = nullTimePtr(url.ExpiresAt)
+
+	return record
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	v := t.Time.UTC()
+
+	return &v
+}
+
+// purgeable удалена или истекла ли ссылка раньше before
+func purgeable(url *types.URL, before time.Time) bool {
+	return (url.DeletedAt.Valid && url.DeletedAt.Time.Before(before)) ||
+		(url.ExpiresAt.Valid && url.ExpiresAt.Time.Before(before))
+}
+
+// runRetention раз в RetentionInterval с разбросом до RetentionJitter
+// очищает хранилище, пока не отменен ctx. Разброс разводит во времени
+// очистку на нескольких экземплярах сервиса с общей бд
+func (s *storage) runRetention(ctx context.Context) {
+	interval := s.cfg.RetentionInterval.Duration
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	for {
+		wait := interval
+		if jitter := s.cfg.RetentionJitter.Duration; jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(jitter)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		purged, err := s.purge(ctx, time.Now().Add(-s.cfg.RetentionPeriod.Duration))
+		if err != nil {
+			log.Printf("Очистка хранилища прервана. %s", err)
+		}
+		if purged > 0 {
+			log.Printf("Очистка хранилища: удалено ссылок %d", purged)
+		}
+	}
+}
+
+// purge безвозвратно удаляет ссылки, удаленные или истекшие раньше before,
+// из всех слоев и пишет их в журнал. Удаление хранится только в бд, поэтому
+// удаленные там хеши убираются из файла и памяти вместе с истекшими
+func (s *storage) purge(ctx context.Context, before time.Time) (count int, err error) {
+	now := time.Now().UTC()
+	hashes := map[string]bool{}
+
+	// журнал пишется после каждого шага: то, что уже удалено, должно в нем остаться
+	audit := func(urls []*types.URL) error {
+		records := make([]purgeRecord, 0, len(urls))
+		removed := make([]string, 0, len(urls))
+		for _, url := range urls {
+			if hashes[url.Hash] {
+				continue
+			}
+			hashes[url.Hash] = true
+			records = append(records, newPurgeRecord(url, before, now))
+			removed = append(removed, url.Hash)
+		}
+
+		s.cache.Remove(removed...)
+		count += len(records)
+
+		return s.writeAudit(records)
+	}
+
+	if s.dbEnabled() {
+		for {
+			urls, purgeErr := s.repositories.db.Purge(ctx, before, purgeBatch)
+			if purgeErr != nil {
+				return count, purgeErr
+			}
+			if err = audit(urls); err != nil {
+				return count, err
+			}
+			if len(urls) < purgeBatch {
+				break
+			}
+		}
+	}
+
+	drop := func(url *types.URL) bool {
+		return hashes[url.Hash] || purgeable(url, before)
+	}
+
+	urls, err := s.repositories.file.Purge(ctx, drop)
+	if auditErr := audit(urls); err == nil {
+		err = auditErr
+	}
+	if err != nil {
+		return count, err
+	}
+
+	return count, audit(s.repositories.memory.Purge(drop))
+}
+
+// writeAudit дописывает записи в журнал очистки. Пустой путь - без журнала
+func (s *storage) writeAudit(records []purgeRecord) error {
+	if len(records) == 0 || s.cfg.RetentionAuditPath == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(s.cfg.RetentionAuditPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, record := range records {
+		if err = encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPurge давно удаленные и истекшие ссылки убираются из всех слоев и попадают в журнал
+func TestPurge(t *testing.T) {
+	dir := t.TempDir()
+	audit := filepath.Join(dir, "retention.log")
+	st, err := NewStorage(&types.Config{
+		DBPath:             filepath.Join(dir, "db"),
+		DatabaseDsn:        sqliteScheme + filepath.Join(dir, "shortener.db"),
+		OutboxPath:         filepath.Join(dir, "outbox"),
+		RetentionAuditPath: audit,
+	})
+	require.NoError(t, err)
+	defer st.Close()
+
+	s := st.(*storage)
+	ctx := context.Background()
+	old := time.Now().UTC().Add(-48 * time.Hour)
+
+	for _, url := range []*types.URL{
+		{UUID: "user-1", Hash: "hash-1", URL: "http://yandex.ru?x=1"},
+		{UUID: "user-1", Hash: "hash-2", URL: "http://yandex.ru?x=2", ExpiresAt: sql.NullTime{Time: old, Valid: true}},
+		{UUID: "user-1", Hash: "hash-3", URL: "http://yandex.ru?x=3"},
+		{UUID: "user-1", Hash: "hash-4", URL: "http://yandex.ru?x=4"},
+	} {
+		require.NoError(t, s.Save(ctx, url))
+	}
+
+	// удалена давно, удалена только что
+	require.NoError(t, s.DeleteByHash(ctx, "user-1", []string{"hash-1", "hash-3"}))
+	_, err = s.repositories.db.DB.Exec("UPDATE urls SET deleted_at = ? WHERE hash = ?", old, "hash-1")
+	require.NoError(t, err)
+
+	count, err := s.purge(ctx, time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	for _, hash := range []string{"hash-1", "hash-2"} {
+		for _, repo := range []interface {
+			FindByHash(ctx context.Context, hash string) (bool, *types.URL, error)
+		}{s.repositories.db, s.repositories.file, s.repositories.memory} {
+			// файл на промахе отдает io.EOF
+			exist, _, _ := repo.FindByHash(ctx, hash)
+			assert.False(t, exist, hash)
+		}
+	}
+	for _, hash := range []string{"hash-3", "hash-4"} {
+		exist, _, err := s.repositories.file.FindByHash(ctx, hash)
+		require.NoError(t, err)
+		assert.True(t, exist, hash)
+	}
+
+	file, err := os.Open(audit)
+	require.NoError(t, err)
+	defer file.Close()
+
+	reasons := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := purgeRecord{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		reasons[record.Hash] = record.Reason
+	}
+	assert.Equal(t, map[string]string{"hash-1": purgeReasonDeleted, "hash-2": purgeReasonExpired}, reasons)
+
+	// повторный запуск ничего не находит
+	count, err = s.purge(ctx, time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"log"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// sqliteScheme префикс DSN встроенной базы: sqlite:///path/db
+const sqliteScheme = "sqlite://"
+
+// sqliteDefaultParams параметры подключения, если в DSN их нет
+const sqliteDefaultParams = "_busy_timeout=5000&_journal_mode=WAL"
+
+// isSQLiteDsn проверяет, указывает ли DSN на встроенную базу SQLite
+func isSQLiteDsn(dsn string) bool {
+	return strings.HasPrefix(dsn, sqliteScheme)
+}
+
+// sqlitePath возвращает путь к файлу базы из DSN вида sqlite:///path/db
+func sqlitePath(dsn string) string {
+	return strings.TrimPrefix(dsn, sqliteScheme)
+}
+
+// NewSQLiteRepository открывает (или создает) базу SQLite в файле path.
+// Запросы и миграции общие с postgres, отличается только драйвер.
+func NewSQLiteRepository(cfg *types.Config, path string) *DBRepository {
+	repo := newDBRepository(cfg, "sqlite3")
+
+	if !strings.Contains(path, "?") {
+		path = path + "?" + sqliteDefaultParams
+	}
+
+	db, err := sqlx.Open(repo.driver, path)
+	if err != nil {
+		log.Println(err)
+		return repo
+	}
+
+	configurePool(db, cfg)
+	repo.DB = db
+	repo.migrate()
+
+	return repo
+}
@@ -1,45 +1,89 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 )
 
-// Storage Хранилище ссылок
-var Storage store
+// Storage Хранилище ссылок. Глобальное значение оставлено для совместимости,
+// новый код получает хранилище через NewStorage
+var Storage Store
 
 type repository interface {
 	// Save сохраняет объект ссылки в хранилище
-	Save(url *types.URL) error
+	Save(ctx context.Context, url *types.URL) error
 	// FindByHash ищет урл в хранилище по хешу
-	FindByHash(hash string) (exist bool, url *types.URL, err error)
+	FindByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error)
 	// FindByUUID ищет все ссылки пользователя с uuid
-	FindByUUID(uuid string) (exist bool, urls map[string]*types.URL, err error)
-	// DeleteByHash удаляет урлы
-	DeleteByHash([]string) (err error)
+	FindByUUID(ctx context.Context, uuid string) (exist bool, urls map[string]*types.URL, err error)
+	// SaveUTMTemplate сохраняет шаблон utm-меток пользователя, шаблон с тем же именем заменяется
+	SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) (err error)
+	// UTMTemplates шаблоны utm-меток пользователя uuid по имени
+	UTMTemplates(ctx context.Context, uuid string) (templates []types.UTMTemplate, err error)
+	// DeleteUTMTemplate удаляет шаблон utm-меток. Нет шаблона - ErrTemplateNotFound
+	DeleteUTMTemplate(ctx context.Context, uuid string, name string) (err error)
+	// DeleteByHash удаляет урлы владельца uuid. Пустой uuid - любого владельца
+	DeleteByHash(ctx context.Context, uuid string, hashes []string) (err error)
+	// Walk вызывает fn для каждой ссылки в хранилище
+	Walk(ctx context.Context, fn func(url *types.URL) error) error
 }
 
-type store interface {
+// Store хранилище ссылок
+type Store interface {
 	// Save сохраняет объект ссылки в хранилище
-	Save(url *types.URL) error
+	Save(ctx context.Context, url *types.URL) error
 	// SaveBatch сохраняет массив объектов ссылок в хранилище
-	SaveBatch(urls []*types.URL) (err error)
+	SaveBatch(ctx context.Context, urls []*types.URL) (err error)
+	// Import сохраняет пачку ссылок, пропуская уже существующие хеши.
+	// Возвращает число сохраненных
+	Import(ctx context.Context, urls []*types.URL) (created int, err error)
 	// FindByHash ищет урл в хранилище по хешу
-	FindByHash(hash string) (exist bool, url *types.URL, err error)
+	FindByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error)
 	// FindByUUID ищет все ссылки пользователя с uuid
-	FindByUUID(uuid string) (urls map[string]*types.URL, err error)
-	// DeleteByHash удаляет урлы
-	DeleteByHash([]string) (err error)
+	FindByUUID(ctx context.Context, uuid string) (urls map[string]*types.URL, err error)
+	// Export потоково отдает ссылки пользователя uuid, при пустом uuid - все
+	Export(ctx context.Context, uuid string, fn func(url *types.URL) error) error
+	// ListURLs страница ссылок пользователя с фильтрами и сортировкой
+	ListURLs(ctx context.Context, q types.URLQuery) (page types.URLPage, err error)
+	// Click учитывает переход по ссылке
+	Click(hash string)
+	// ConsumeClick учитывает переход по ссылке с лимитом переходов и
+	// возвращает новое число переходов. Лимит исчерпан - ErrURLExhausted
+	ConsumeClick(ctx context.Context, hash string) (clicks int64, err error)
+	// UpdateURL меняет ссылку пользователя uuid, сохраняя прежнее значение в истории
+	UpdateURL(ctx context.Context, uuid string, hash string, update types.URLUpdate) (url *types.URL, err error)
+	// URLHistory прежние значения ссылки пользователя uuid, сначала последние
+	URLHistory(ctx context.Context, uuid string, hash string) (revisions []types.URLRevision, err error)
+	// SaveUTMTemplate сохраняет шаблон utm-меток пользователя, шаблон с тем же именем заменяется
+	SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) (err error)
+	// UTMTemplates шаблоны utm-меток пользователя uuid по имени
+	UTMTemplates(ctx context.Context, uuid string) (templates []types.UTMTemplate, err error)
+	// DeleteUTMTemplate удаляет шаблон utm-меток. Нет шаблона - ErrTemplateNotFound
+	DeleteUTMTemplate(ctx context.Context, uuid string, name string) (err error)
+	// DeleteByHash удаляет урлы владельца uuid. Пустой uuid - любого владельца
+	DeleteByHash(ctx context.Context, uuid string, hashes []string) (err error)
+	// RestoreByHash снимает удаление со ссылок пользователя uuid
+	RestoreByHash(ctx context.Context, uuid string, hashes []string) (result types.RestoreResult, err error)
 	// Drop чистит memory хранилище, удаляет файл
 	Drop()
 	// Ping Проверяет подключение к базе
-	Ping() (err error)
+	Ping(ctx context.Context) (err error)
 	// Statistic Статистика
-	Statistic() types.Statistic
+	Statistic(ctx context.Context) types.Statistic
+	// Health состояние хранилища
+	Health() types.Health
+	// CheckConsistency сверяет слои хранилища, при repair - исправляет по слою source
+	CheckConsistency(ctx context.Context, source string, repair bool) (report types.ConsistencyReport, err error)
+	// Close останавливает фоновые задачи и закрывает соединения
+	Close() error
 }
 
 type repositories struct {
@@ -51,18 +95,48 @@ type repositories struct {
 type storage struct {
 	cfg          *types.Config
 	repositories repositories
+	// outbox записи, отложенные до восстановления бд. nil, если бд не настроена
+	outbox *Outbox
+	// stop останавливает фоновые задачи
+	stop context.CancelFunc
+	// cache горячие ссылки для редиректов
+	cache *urlCache
+	// flight объединяет одновременные промахи кеша по одному хешу
+	flight flightGroup
+	// bloom отсекает запросы несуществующих хешей. nil - выключен
+	bloom *BloomFilter
+	// clicks переходы, ожидающие записи в бд. nil, если бд не настроена
+	clicks *clickCounter
+	// find поиск ссылки мимо кеша, в тестах подменяется
+	find func(ctx context.Context, hash string) (bool, *types.URL, error)
 }
 
+// New инициирует глобальное хранилище Storage
 func New(cfg *types.Config) (err error) {
+	st, err := NewStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	Storage = st
+
+	return nil
+}
+
+// NewStorage создает хранилище ссылок: память, файл и бд из конфига
+func NewStorage(cfg *types.Config) (Store, error) {
 	st := &storage{
-		cfg: cfg,
+		cfg:   cfg,
+		cache: newURLCache(cfg.CacheSize, cfg.CacheTTL.Duration),
+		bloom: NewBloomFilter(cfg.BloomExpectedItems, cfg.BloomFalsePositiveRate),
 	}
+	st.find = st.findByHash
 
 	mr := NewMemoryRepository()
 	dbr := NewDBRepository(cfg)
 	fr, err := NewFileRepository(cfg.DBPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Инициируем репозитории
@@ -72,14 +146,135 @@ func New(cfg *types.Config) (err error) {
 		db:     dbr,
 	}
 
-	Storage = st
+	ctx, stop := context.WithCancel(context.Background())
+	st.stop = stop
+
+	// Записи в бд, которые не прошли, повторяем в фоне
+	if st.dbEnabled() {
+		st.outbox, err = NewOutbox(cfg.OutboxPath, dbr, cfg.OutboxMinBackoff.Duration, cfg.OutboxMaxBackoff.Duration, cfg.OutboxMaxAttempts)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		go st.outbox.Run(ctx)
+
+		st.clicks = newClickCounter(dbr)
+		go st.clicks.Run(ctx, cfg.ClickFlushInterval.Duration)
+	}
+
+	if st.bloom != nil {
+		go st.buildBloom(ctx)
+	}
+
+	if cfg.RetentionPeriod.Duration > 0 {
+		if cfg.RetentionPeriod.Duration < cfg.RestoreGracePeriod.Duration {
+			log.Printf("RETENTION_PERIOD %s меньше RESTORE_GRACE_PERIOD %s: удаленные ссылки будут очищены раньше, чем истечет срок восстановления",
+				cfg.RetentionPeriod, cfg.RestoreGracePeriod)
+		}
+		go st.runRetention(ctx)
+	}
+
+	return st, nil
+}
+
+// buildBloom заполняет фильтр Блума хешами из хранилища. Пока фильтр
+// не собран целиком, он ничего не отсекает. Если бд недоступна - пробуем позже
+func (s *storage) buildBloom(ctx context.Context) {
+	backoff := time.Second
+
+	for {
+		err := s.fillBloom(ctx)
+		if err == nil {
+			s.bloom.SetReady()
+			return
+		}
+
+		log.Printf("Не удалось собрать фильтр Блума, повтор через %s. %s", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// fillBloom добавляет в фильтр хеши из всех репозиториев
+func (s *storage) fillBloom(ctx context.Context) error {
+	add := func(url *types.URL) error {
+		s.bloom.Add(url.Hash)
+		return nil
+	}
+
+	if err := s.repositories.file.Walk(ctx, add); err != nil {
+		return err
+	}
+
+	if s.dbEnabled() {
+		return s.repositories.db.Walk(ctx, add)
+	}
 
 	return nil
 }
 
-func (s *storage) Save(url *types.URL) (err error) {
+// dbEnabled настроена ли бд
+func (s *storage) dbEnabled() bool {
+	return s.repositories.db.DB != nil
+}
+
+// writeBehind пишет в бд или откладывает запись в outbox.
+// Пока в очереди есть операции, новые ставятся за ними, чтобы не нарушить порядок
+func (s *storage) writeBehind(entry outboxEntry, write func() error) error {
+	if s.outbox == nil {
+		return write()
+	}
+
+	if s.outbox.Depth() == 0 {
+		err := write()
+		// отвергнутую бд запись повторять бессмысленно, а прерванную
+		// вместе с запросом - можно
+		if err == nil || (!isDBFailure(err) && !errors.Is(err, context.Canceled)) {
+			return err
+		}
+		log.Printf("Не удалось записать в бд, откладываем %s. %s", entry.Op, err)
+	}
+
+	return s.outbox.Enqueue(entry)
+}
+
+// stamp проставляет время создания и изменения новым ссылкам. Время,
+// пришедшее вместе со ссылкой (повтор из outbox), не трогаем
+func stamp(urls ...*types.URL) {
+	now := time.Now().UTC()
+
+	for _, url := range urls {
+		if !url.CreatedAt.Valid {
+			url.CreatedAt = sql.NullTime{Time: now, Valid: true}
+		}
+		if !url.UpdatedAt.Valid {
+			url.UpdatedAt = url.CreatedAt
+		}
+		// время в бд хранится без зоны
+		if url.ExpiresAt.Valid {
+			url.ExpiresAt.Time = url.ExpiresAt.Time.UTC()
+		}
+		if url.ActiveFrom.Valid {
+			url.ActiveFrom.Time = url.ActiveFrom.Time.UTC()
+		}
+	}
+}
+
+func (s *storage) Save(ctx context.Context, url *types.URL) (err error) {
+	defer s.cache.Remove(url.Hash)
+	stamp(url)
+	s.bloom.Add(url.Hash)
+
 	// Сохраняем в память
-	err = s.repositories.memory.Save(url)
+	err = s.repositories.memory.Save(ctx, url)
 	// если не получилось записать в память - все плохо. выходим
 	if err != nil {
 		log.Println(err)
@@ -87,20 +282,23 @@ func (s *storage) Save(url *types.URL) (err error) {
 	}
 
 	// Сохраняем в файл
-	if exist, _, _ := s.repositories.file.FindByHash(url.Hash); !exist {
-		err = s.repositories.file.Save(url)
+	if exist, _, _ := s.repositories.file.FindByHash(ctx, url.Hash); !exist {
+		err = s.repositories.file.Save(ctx, url)
 		// не получилось записать в файл - идем дальше
 		if err != nil {
 			log.Println(err)
 		}
 	}
 
-	// Сохраняем в базу
-	err = s.repositories.db.Save(url)
 	// база опциональна
-	if errors.Is(err, shortenerErrors.ErrNoDBConnection) {
+	if !s.dbEnabled() {
 		return nil
 	}
+
+	// Сохраняем в базу. Если база недоступна - запись уйдет в outbox
+	err = s.writeBehind(outboxEntry{Op: outboxOpSave, URLs: []*types.URL{url}}, func() error {
+		return s.repositories.db.Save(ctx, url)
+	})
 	if err != nil {
 		log.Println(err)
 	}
@@ -108,33 +306,153 @@ func (s *storage) Save(url *types.URL) (err error) {
 	return
 }
 
-func (s *storage) SaveBatch(urls []*types.URL) (err error) {
-	err = s.repositories.db.SaveBatch(urls)
+func (s *storage) SaveBatch(ctx context.Context, urls []*types.URL) (err error) {
+	stamp(urls...)
+	for _, url := range urls {
+		s.cache.Remove(url.Hash)
+		s.bloom.Add(url.Hash)
+	}
+
+	// без бд пачка пишется в файл, как и при импорте
+	if !s.dbEnabled() {
+		err = s.repositories.file.SaveBatch(ctx, urls)
+	} else {
+		err = s.writeBehind(outboxEntry{Op: outboxOpSaveBatch, URLs: urls}, func() error {
+			return s.repositories.db.SaveBatch(ctx, urls)
+		})
+	}
+	if err != nil {
+		return
+	}
+
+	// в память - как и в Save. Ссылка, что уже есть в памяти, не заменяется
+	for _, url := range urls {
+		_ = s.repositories.memory.Save(ctx, url)
+	}
 
 	return
 }
 
-func (s *storage) DeleteByHash(urls []string) (err error) {
-	err = s.repositories.db.DeleteByHash(urls)
+// Import при настроенной бд пишет пачку только в бд, как и SaveBatch,
+// иначе - в файл. Outbox не используется: при ошибке пачку повторяет клиент
+func (s *storage) Import(ctx context.Context, urls []*types.URL) (created int, err error) {
+	stamp(urls...)
+	for _, url := range urls {
+		s.cache.Remove(url.Hash)
+		s.bloom.Add(url.Hash)
+	}
+
+	if s.dbEnabled() {
+		return s.repositories.db.Import(ctx, urls)
+	}
+
+	return s.repositories.file.Import(ctx, urls)
+}
+
+func (s *storage) DeleteByHash(ctx context.Context, uuid string, urls []string) (err error) {
+	defer s.cache.Remove(urls...)
+
+	// без бд удаление хранится в файле
+	if !s.dbEnabled() {
+		deleted, err := s.repositories.file.DeleteByHash(ctx, uuid, urls, time.Now().UTC())
+		for _, url := range deleted {
+			s.repositories.memory.Update(url)
+		}
+
+		return err
+	}
+
+	err = s.writeBehind(outboxEntry{Op: outboxOpDelete, UUID: uuid, Hashes: urls}, func() error {
+		return s.repositories.db.DeleteByHash(ctx, uuid, urls)
+	})
 
 	return
 }
 
-func (s *storage) FindByHash(hash string) (exist bool, url *types.URL, err error) {
+// RestoreByHash восстанавливает ссылки там же, где хранится удаление: в бд,
+// а без бд - в файле. Пока в outbox ждут операции, восстановление
+// отказывает: отложенное удаление выполнилось бы позже и затерло его
+func (s *storage) RestoreByHash(ctx context.Context, uuid string, hashes []string) (result types.RestoreResult, err error) {
+	if s.outbox != nil && s.outbox.Depth() > 0 {
+		return result, fmt.Errorf("%w", shortenerErrors.ErrPendingWrites)
+	}
+
+	var notBefore time.Time
+	if grace := s.cfg.RestoreGracePeriod.Duration; grace > 0 {
+		notBefore = time.Now().Add(-grace)
+	}
+
+	if !s.dbEnabled() {
+		var restored []*types.URL
+		result, restored, err = s.repositories.file.RestoreByHash(ctx, uuid, hashes, notBefore, time.Now().UTC())
+		for _, url := range restored {
+			s.repositories.memory.Update(url)
+		}
+		s.cache.Remove(result.Restored...)
+
+		return result, err
+	}
+
+	result, err = s.repositories.db.RestoreByHash(ctx, uuid, hashes, notBefore)
+	s.cache.Remove(result.Restored...)
+
+	return result, err
+}
+
+func (s *storage) FindByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error) {
+	if cached, ok := s.cache.Get(hash); ok {
+		return true, cached, nil
+	}
+
+	// такого хеша точно нет - в репозитории не ходим
+	if !s.bloom.MayContain(hash) {
+		return false, nil, nil
+	}
+
+	// изменение ссылки, случившееся во время поиска, не даст положить в кеш старое
+	generation := s.cache.Generation()
+
+	// Одновременные промахи по одному хешу идут в хранилище одним запросом
+	exist, url, shared, err := s.flight.Do(hash, func() (bool, *types.URL, error) {
+		return s.find(ctx, hash)
+	})
+
+	// запрос отменил тот, чей результат мы ждали, а не мы - ищем сами
+	if shared && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) && ctx.Err() == nil {
+		exist, url, err = s.find(ctx, hash)
+		shared = false
+	}
+
+	if !exist {
+		return exist, url, err
+	}
+
+	if shared {
+		u := *url
+		url = &u
+	} else {
+		s.cache.Add(url, generation)
+	}
+
+	return exist, url, err
+}
+
+// findByHash ищет ссылку по хешу во всех репозиториях, минуя кеш
+func (s *storage) findByHash(ctx context.Context, hash string) (exist bool, url *types.URL, err error) {
 	// Сначала в бд
-	exist, url, err = s.repositories.db.FindByHash(hash)
+	exist, url, err = s.repositories.db.FindByHash(ctx, hash)
 	if exist {
 		return
 	}
 
 	// ищем в файле
-	exist, url, err = s.repositories.file.FindByHash(hash)
+	exist, url, err = s.repositories.file.FindByHash(ctx, hash)
 	if exist {
 		return
 	}
 
 	// Ищем в памяти
-	exist, url, err = s.repositories.memory.FindByHash(hash)
+	exist, url, err = s.repositories.memory.FindByHash(ctx, hash)
 	if exist {
 		return
 	}
@@ -142,15 +460,15 @@ func (s *storage) FindByHash(hash string) (exist bool, url *types.URL, err error
 	return
 }
 
-func (s *storage) FindByUUID(uuid string) (urls map[string]*types.URL, err error) {
+func (s *storage) FindByUUID(ctx context.Context, uuid string) (urls map[string]*types.URL, err error) {
 	// Ищем в памяти
-	um, e := s.repositories.memory.FindByUUID(uuid)
+	um, e := s.repositories.memory.FindByUUID(ctx, uuid)
 	if e != nil {
 		return nil, e
 	}
 
 	// Ищем в файле
-	uf, e := s.repositories.file.FindByUUID(uuid)
+	uf, e := s.repositories.file.FindByUUID(ctx, uuid)
 	if e != nil {
 		return nil, e
 	}
@@ -166,20 +484,193 @@ func (s *storage) FindByUUID(uuid string) (urls map[string]*types.URL, err error
 	return urls, nil
 }
 
-func (s *storage) Statistic() types.Statistic {
+// Export при настроенной бд выгружает из бд - туда пишут все операции,
+// включая пачки и импорт. Без бд - из файла
+func (s *storage) Export(ctx context.Context, uuid string, fn func(url *types.URL) error) error {
+	if s.dbEnabled() {
+		return s.repositories.db.Export(ctx, uuid, fn)
+	}
+
+	return s.repositories.file.Export(ctx, uuid, fn)
+}
+
+// ListURLs при настроенной бд выбирает из бд, иначе - из файла
+func (s *storage) ListURLs(ctx context.Context, q types.URLQuery) (page types.URLPage, err error) {
+	q = normalizeQuery(q)
+
+	if s.dbEnabled() {
+		return s.repositories.db.ListURLs(ctx, q)
+	}
+
+	return s.repositories.file.ListURLs(ctx, q)
+}
+
+// UpdateURL при настроенной бд меняет ссылку в бд, иначе - в файле, и ведет
+// там историю. Остальные слои, где ссылка есть, получают новое значение,
+// чтобы при недоступной бд редирект не ушел на старый адрес
+func (s *storage) UpdateURL(ctx context.Context, uuid string, hash string, update types.URLUpdate) (url *types.URL, err error) {
+	defer s.cache.Remove(hash)
+
+	now := time.Now().UTC()
+
+	if !s.dbEnabled() {
+		url, err = s.repositories.file.UpdateURL(ctx, uuid, hash, update, now)
+		if err != nil {
+			return nil, err
+		}
+		s.repositories.memory.Update(url)
+
+		return url, nil
+	}
+
+	url, err = s.repositories.db.UpdateURL(ctx, uuid, hash, update, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if exist, _, _ := s.repositories.file.FindByHash(ctx, hash); exist {
+		fix := *url
+		if err = s.repositories.file.Rewrite(ctx, map[string]*types.URL{hash: &fix}); err != nil {
+			log.Printf("Не удалось обновить ссылку %s в файле. %s", hash, err)
+		}
+	}
+	s.repositories.memory.Update(url)
+
+	return url, nil
+}
+
+// URLHistory история из того же слоя, где ее пишет UpdateURL
+func (s *storage) URLHistory(ctx context.Context, uuid string, hash string) (revisions []types.URLRevision, err error) {
+	exist, url, err := s.findByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrURLNotFound)
+	}
+	if url.UUID != uuid {
+		return nil, fmt.Errorf("%w", shortenerErrors.ErrURLForbidden)
+	}
+
+	if s.dbEnabled() {
+		return s.repositories.db.History(ctx, hash)
+	}
+
+	return s.repositories.file.History(ctx, hash)
+}
+
+// SaveUTMTemplate шаблоны хранятся там же, где история: в бд или в файле рядом с хранилищем
+func (s *storage) SaveUTMTemplate(ctx context.Context, template *types.UTMTemplate) error {
+	if s.dbEnabled() {
+		return s.repositories.db.SaveUTMTemplate(ctx, template)
+	}
+
+	return s.repositories.file.SaveUTMTemplate(ctx, template)
+}
+
+func (s *storage) UTMTemplates(ctx context.Context, uuid string) ([]types.UTMTemplate, error) {
+	if s.dbEnabled() {
+		return s.repositories.db.UTMTemplates(ctx, uuid)
+	}
+
+	return s.repositories.file.UTMTemplates(ctx, uuid)
+}
+
+func (s *storage) DeleteUTMTemplate(ctx context.Context, uuid string, name string) error {
+	if s.dbEnabled() {
+		return s.repositories.db.DeleteUTMTemplate(ctx, uuid, name)
+	}
+
+	return s.repositories.file.DeleteUTMTemplate(ctx, uuid, name)
+}
+
+// Click считает переход в памяти сразу, а в бд - пачками в фоне
+func (s *storage) Click(hash string) {
+	s.repositories.memory.Click(hash)
+
+	if s.clicks != nil {
+		s.clicks.Add(hash)
+	}
+}
+
+// ConsumeClick в отличие от Click пишет переход сразу в основное хранилище:
+// лимит проверяется и счетчик растет атомарно
+func (s *storage) ConsumeClick(ctx context.Context, hash string) (clicks int64, err error) {
+	defer s.cache.Remove(hash)
+
+	if s.dbEnabled() {
+		clicks, err = s.repositories.db.ConsumeClick(ctx, hash)
+		// строки в бд нет: ссылка еще ждет в outbox или есть только
+		// в файле и памяти - считаем там
+		if !errors.Is(err, shortenerErrors.ErrURLNotFound) {
+			return clicks, err
+		}
+	}
+
+	url, err := s.repositories.file.ConsumeClick(ctx, hash)
+	if errors.Is(err, shortenerErrors.ErrURLNotFound) {
+		// ссылка только в памяти
+		if url, ok := s.repositories.memory.ConsumeClick(hash); ok {
+			return url.Clicks, nil
+		}
+		if exist, _, _ := s.repositories.memory.FindByHash(ctx, hash); exist {
+			return 0, fmt.Errorf("%w", shortenerErrors.ErrURLExhausted)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.repositories.memory.Update(url)
+
+	return url.Clicks, nil
+}
+
+func (s *storage) Statistic(ctx context.Context) types.Statistic {
 	stat := new(types.Statistic)
 
-	stat.Urls = s.repositories.db.UrlsCount()
-	stat.Users = s.repositories.db.UsersCount()
+	stat.Urls = s.repositories.db.UrlsCount(ctx)
+	stat.Users = s.repositories.db.UsersCount(ctx)
+	health := s.Health()
+	stat.OutboxDepth = health.OutboxDepth
+	stat.BreakerState = health.BreakerState
+
+	stat.BloomRejected = s.bloom.Rejected()
+	stat.CacheHits, stat.CacheMisses = s.cache.Stats()
+	if total := stat.CacheHits + stat.CacheMisses; total > 0 {
+		stat.CacheHitRate = float64(stat.CacheHits) / float64(total)
+	}
 
 	return *stat
 }
 
 func (s *storage) Drop() {
-	s.repositories.memory.items = map[string]*types.URL{}
+	s.cache.Purge()
+	s.repositories.memory.Clear()
 	os.Remove(s.cfg.DBPath)
 }
 
-func (s *storage) Ping() (err error) {
-	return s.repositories.db.Ping()
+func (s *storage) Ping(ctx context.Context) (err error) {
+	return s.repositories.db.Ping(ctx)
+}
+
+func (s *storage) Health() (health types.Health) {
+	health.BreakerState = s.repositories.db.BreakerState()
+	if s.outbox != nil {
+		health.OutboxDepth = s.outbox.Depth()
+	}
+
+	return health
+}
+
+func (s *storage) Close() error {
+	s.stop()
+
+	// переходы, не успевшие уйти в бд
+	if s.clicks != nil {
+		if err := s.clicks.Flush(context.Background()); err != nil {
+			log.Printf("Не удалось записать переходы по ссылкам. %s", err)
+		}
+	}
+
+	return s.repositories.db.Close()
 }
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
+	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
+)
+
+// checkEditable можно ли пользователю uuid менять ссылку
+func checkEditable(url *types.URL, uuid string) error {
+	if url.UUID != uuid {
+		return fmt.Errorf("%w", shortenerErrors.ErrURLForbidden)
+	}
+	if url.DeletedAt.Valid {
+		return fmt.Errorf("%w", shortenerErrors.ErrURLDeleted)
+	}
+
+	return nil
+}
+
+// newRevision текущее значение ссылки для истории
+func newRevision(url *types.URL, now time.Time) types.URLRevision {
+	return types.URLRevision{
+		Hash:      url.Hash,
+		URL:       url.URL,
+		Title:     url.Title,
+		Notes:     url.Notes,
+		Tags:      url.Tags,
+		ChangedAt: now,
+	}
+}
+
+// applyUpdate применяет изменение к ссылке. false - значения те же, менять нечего
+func applyUpdate(url *types.URL, update types.URLUpdate, now time.Time) bool {
+	changed := false
+
+	if update.URL != nil && *update.URL != url.URL {
+		url.URL = *update.URL
+		changed = true
+	}
+	if update.Title != nil && *update.Title != url.Title {
+		url.Title = *update.Title
+		changed = true
+	}
+	if update.Notes != nil && *update.Notes != url.Notes {
+		url.Notes = *update.Notes
+		changed = true
+	}
+	if update.Tags != nil && !sameTags(*update.Tags, url.Tags) {
+		url.Tags = *update.Tags
+		changed = true
+	}
+	if update.MaxClicks != nil && *update.MaxClicks != url.MaxClicks {
+		url.MaxClicks = *update.MaxClicks
+		changed = true
+	}
+	if update.RedirectCode != nil && *update.RedirectCode != url.RedirectCode {
+		url.RedirectCode = *update.RedirectCode
+		changed = true
+	}
+	if update.QueryPassthrough != nil && *update.QueryPassthrough != url.QueryPassthrough {
+		url.QueryPassthrough = *update.QueryPassthrough
+		changed = true
+	}
+	// новый хеш всегда отличается от прежнего - соль случайная
+	if update.PasswordHash != nil && *update.PasswordHash != url.PasswordHash {
+		url.PasswordHash = *update.PasswordHash
+		changed = true
+	}
+
+	if changed {
+		url.UpdatedAt.Time, url.UpdatedAt.Valid = now, true
+	}
+
+	return changed
+}
+
+// consumeClick засчитывает переход по ссылке с лимитом. false - лимит исчерпан
+func consumeClick(url *types.URL) bool {
+	if url.Exhausted() {
+		return false
+	}
+
+	url.Clicks++
+
+	return true
+}
+
+func sameTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,6 +1,13 @@
 package types
 
-import "database/sql"
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
 
 // Config конфиг приложения
 type Config struct {
@@ -9,20 +16,423 @@ type Config struct {
 	ServerAddress string `env:"SERVER_ADDRESS" envDefault:"localhost:8080" json:"server_address"`
 	DBPath        string `env:"FILE_STORAGE_PATH" envDefault:"./db" json:"file_storage_path"`
 	DatabaseDsn   string `env:"DATABASE_DSN" envDefault:"" json:"database_dsn"`
-	EnableHttps   bool   `env:"ENABLE_HTTPS" envDefault:"true" json:"enable_https"`
+	// DatabaseReplicaDsns реплики postgres для чтения, через запятую
+	DatabaseReplicaDsns []string `env:"DATABASE_REPLICA_DSN" envSeparator:"," json:"database_replica_dsn"`
+	EnableHttps         bool     `env:"ENABLE_HTTPS" envDefault:"true" json:"enable_https"`
+	// Таймауты операций с бд
+	DBReadTimeout  Duration `env:"DB_READ_TIMEOUT" envDefault:"3s" json:"db_read_timeout"`
+	DBWriteTimeout Duration `env:"DB_WRITE_TIMEOUT" envDefault:"5s" json:"db_write_timeout"`
+	DBPingTimeout  Duration `env:"DB_PING_TIMEOUT" envDefault:"5s" json:"db_ping_timeout"`
+	// Пул соединений. 0 - значение database/sql по умолчанию
+	DBMaxOpenConns    int      `env:"DB_MAX_OPEN_CONNS" envDefault:"0" json:"db_max_open_conns"`
+	DBMaxIdleConns    int      `env:"DB_MAX_IDLE_CONNS" envDefault:"0" json:"db_max_idle_conns"`
+	DBConnMaxLifetime Duration `env:"DB_CONN_MAX_LIFETIME" envDefault:"0s" json:"db_conn_max_lifetime"`
+	DBConnMaxIdleTime Duration `env:"DB_CONN_MAX_IDLE_TIME" envDefault:"0s" json:"db_conn_max_idle_time"`
+	// Очередь записей в бд, которые не удалось выполнить сразу
+	OutboxPath       string   `env:"OUTBOX_PATH" envDefault:"./outbox" json:"outbox_path"`
+	OutboxMinBackoff Duration `env:"OUTBOX_MIN_BACKOFF" envDefault:"1s" json:"outbox_min_backoff"`
+	OutboxMaxBackoff Duration `env:"OUTBOX_MAX_BACKOFF" envDefault:"1m" json:"outbox_max_backoff"`
+	// После стольких неудачных попыток запись уходит в OutboxPath.dead
+	OutboxMaxAttempts int `env:"OUTBOX_MAX_ATTEMPTS" envDefault:"20" json:"outbox_max_attempts"`
+	// Предохранитель и повторы запросов к бд
+	DBBreakerThreshold        int      `env:"DB_BREAKER_THRESHOLD" envDefault:"5" json:"db_breaker_threshold"`
+	DBBreakerOpenTimeout      Duration `env:"DB_BREAKER_OPEN_TIMEOUT" envDefault:"10s" json:"db_breaker_open_timeout"`
+	DBBreakerHalfOpenRequests int      `env:"DB_BREAKER_HALF_OPEN_REQUESTS" envDefault:"1" json:"db_breaker_half_open_requests"`
+	DBRetryAttempts           int      `env:"DB_RETRY_ATTEMPTS" envDefault:"3" json:"db_retry_attempts"`
+	DBRetryBackoff            Duration `env:"DB_RETRY_BACKOFF" envDefault:"50ms" json:"db_retry_backoff"`
+	// Кеш ссылок для редиректов. 0 - кеш выключен
+	CacheSize int      `env:"CACHE_SIZE" envDefault:"10000" json:"cache_size"`
+	CacheTTL  Duration `env:"CACHE_TTL" envDefault:"1m" json:"cache_ttl"`
+	// Фильтр Блума по хешам. 0 ожидаемых элементов - фильтр выключен.
+	// Фильтр собирается только при старте и не видит ссылок, созданных
+	// другими экземплярами или командами admin: включать, только если
+	// сервис единственный, кто пишет в хранилище
+	BloomExpectedItems     int     `env:"BLOOM_EXPECTED_ITEMS" envDefault:"0" json:"bloom_expected_items"`
+	BloomFalsePositiveRate float64 `env:"BLOOM_FALSE_POSITIVE_RATE" envDefault:"0.01" json:"bloom_false_positive_rate"`
+	// OwnershipMode как одинаковые урлы делятся между пользователями:
+	// global - один хеш на урл для всех, user - у каждого владельца свой
+	OwnershipMode string `env:"OWNERSHIP_MODE" envDefault:"global" json:"ownership_mode"`
+	// TrustedSubnet подсети CIDR через запятую, которым открыты служебные
+	// /api/internal/export и /api/internal/consistency. Пусто - закрыты для всех
+	TrustedSubnet string `env:"TRUSTED_SUBNET" json:"trusted_subnet"`
+	// TrustedProxies подсети прокси, чьим X-Real-IP и X-Forwarded-For верим.
+	// Пусто - адрес клиента берется только из соединения
+	TrustedProxies string `env:"TRUSTED_PROXIES" json:"trusted_proxies"`
+	// ImportBatchSize сколько строк импорта пишется в хранилище за раз
+	ImportBatchSize int `env:"IMPORT_BATCH_SIZE" envDefault:"1000" json:"import_batch_size"`
+	// RestoreGracePeriod сколько удаленную ссылку можно восстановить. 0 - без ограничения
+	RestoreGracePeriod Duration `env:"RESTORE_GRACE_PERIOD" envDefault:"720h" json:"restore_grace_period"`
+	// Очистка: ссылки, удаленные или истекшие дольше RetentionPeriod назад,
+	// удаляются безвозвратно раз в RetentionInterval плюс случайная задержка
+	// до RetentionJitter. 0 - очистка выключена
+	RetentionPeriod    Duration `env:"RETENTION_PERIOD" envDefault:"0s" json:"retention_period"`
+	RetentionInterval  Duration `env:"RETENTION_INTERVAL" envDefault:"1h" json:"retention_interval"`
+	RetentionJitter    Duration `env:"RETENTION_JITTER" envDefault:"5m" json:"retention_jitter"`
+	RetentionAuditPath string   `env:"RETENTION_AUDIT_PATH" envDefault:"./retention.log" json:"retention_audit_path"`
+	// Подбор паролей ссылок: после PasswordMaxAttempts неверных паролей
+	// с одного ip к одной ссылке попытки блокируются на PasswordLockout.
+	// PasswordMaxLinkAttempts - то же для ссылки со всех адресов вместе,
+	// против подбора с многих ip. 0 попыток - без ограничения
+	PasswordMaxAttempts     int      `env:"PASSWORD_MAX_ATTEMPTS" envDefault:"5" json:"password_max_attempts"`
+	PasswordMaxLinkAttempts int      `env:"PASSWORD_MAX_LINK_ATTEMPTS" envDefault:"100" json:"password_max_link_attempts"`
+	PasswordLockout         Duration `env:"PASSWORD_LOCKOUT" envDefault:"15m" json:"password_lockout"`
+	// NotActivePage показывать ли до ActiveFrom ссылки страницу со временем
+	// начала. false - 404, как будто ссылки нет
+	NotActivePage bool `env:"NOT_ACTIVE_PAGE" envDefault:"true" json:"not_active_page"`
+	// ClickFlushInterval как часто счетчики переходов сбрасываются в бд
+	ClickFlushInterval Duration `env:"CLICK_FLUSH_INTERVAL" envDefault:"1s" json:"click_flush_interval"`
+}
+
+// Перенос параметров запроса к короткой ссылке в полный урл
+const (
+	// QueryPassthroughAppend параметры дописываются к параметрам полного
+	// урла, одинаковые ключи остаются оба
+	QueryPassthroughAppend = "append"
+	// QueryPassthroughMerge параметры заменяют одноименные параметры
+	// полного урла
+	QueryPassthroughMerge = "merge"
+)
+
+// ValidQueryPassthrough известен ли режим переноса параметров. Пусто - не переносить
+func ValidQueryPassthrough(mode string) bool {
+	return mode == "" || mode == QueryPassthroughAppend || mode == QueryPassthroughMerge
+}
+
+// ValidRedirectCode можно ли отвечать на переход кодом code. 0 - по умолчанию
+func ValidRedirectCode(code int) bool {
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Режимы владения ссылками
+const (
+	// OwnershipGlobal одинаковый урл дает один хеш, ссылка принадлежит
+	// тому, кто сократил ее первым
+	OwnershipGlobal = "global"
+	// OwnershipUser хеш зависит от владельца, одинаковые урлы разных
+	// пользователей не пересекаются
+	OwnershipUser = "user"
+)
+
+// ValidOwnershipMode известен ли режим владения
+func ValidOwnershipMode(mode string) bool {
+	return mode == OwnershipGlobal || mode == OwnershipUser
+}
+
+// Duration - время, которое читается из env и json строкой вида "5s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText разбирает строку вида "1m30s"
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText возвращает строку вида "1m30s"
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
 }
 
 // URL - структура для url
 type URL struct {
-	UUID      string         `db:"uuid"`
-	Hash      string         `db:"hash"`
-	URL       string         `db:"url"`
-	ShortURL  string         `db:"short_url"`
-	DeletedAt sql.NullString `db:"deleted_at"`
+	UUID      string       `db:"uuid"`
+	Hash      string       `db:"hash"`
+	URL       string       `db:"url"`
+	ShortURL  string       `db:"short_url"`
+	CreatedAt sql.NullTime `db:"created_at"`
+	// UpdatedAt время последнего изменения ссылки
+	UpdatedAt sql.NullTime `db:"updated_at"`
+	DeletedAt sql.NullTime `db:"deleted_at"`
+	// ExpiresAt после этого времени ссылка не работает
+	ExpiresAt sql.NullTime `db:"expires_at"`
+	// ActiveFrom до этого времени ссылка еще не работает
+	ActiveFrom sql.NullTime `db:"active_from"`
+	// Clicks сколько раз по ссылке переходили. Без бд не считается,
+	// кроме ссылок с MaxClicks
+	Clicks int64 `db:"clicks"`
+	// MaxClicks сколько переходов разрешено. 0 - без ограничения
+	MaxClicks int64 `db:"max_clicks"`
+	// Domain хост исходного урла, только для записи в бд
+	Domain string `db:"domain" json:"-"`
+	// Title, Notes и Tags - описание ссылки от пользователя
+	Title string `db:"title"`
+	Notes string `db:"notes"`
+	Tags  Tags   `db:"tags"`
+	// PasswordHash соленый хеш пароля ссылки. Пусто - без пароля
+	PasswordHash string `db:"password_hash"`
+	// RedirectCode код ответа редиректа. 0 - 307
+	RedirectCode int `db:"redirect_code"`
+	// QueryPassthrough как параметры запроса к короткой ссылке переносятся
+	// в полный урл. Пусто - отбрасываются
+	QueryPassthrough string `db:"query_passthrough"`
+}
+
+// Tags - метки ссылки. В бд хранятся json массивом
+type Tags []string
+
+// Value json массив для записи в бд
+func (t Tags) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return "[]", nil
+	}
+
+	data, err := json.Marshal([]string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+// Scan читает json массив из бд
+func (t *Tags) Scan(src interface{}) error {
+	var data []byte
+
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("tags: неожиданный тип %T", src)
+	}
+
+	var tags []string
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &tags); err != nil {
+			return fmt.Errorf("tags: %w", err)
+		}
+	}
+
+	if len(tags) == 0 {
+		tags = nil
+	}
+	*t = tags
+
+	return nil
+}
+
+// URLUpdate - изменение ссылки. nil - поле не меняется
+type URLUpdate struct {
+	URL   *string
+	Title *string
+	Notes *string
+	Tags  *[]string
+	// Password новый пароль от пользователя, пустой - снять пароль.
+	// До хранилища доходит только PasswordHash
+	Password     *string
+	PasswordHash *string
+	// MaxClicks новый лимит переходов, 0 - снять лимит
+	MaxClicks *int64
+	// RedirectCode новый код редиректа, 0 - по умолчанию
+	RedirectCode *int
+	// QueryPassthrough перенос параметров запроса, "" - отключить
+	QueryPassthrough *string
+}
+
+// URLRevision - прежнее значение ссылки в истории изменений
+type URLRevision struct {
+	Hash  string `db:"hash"`
+	URL   string `db:"url"`
+	Title string `db:"title"`
+	Notes string `db:"notes"`
+	Tags  Tags   `db:"tags"`
+	// ChangedAt когда значение было заменено
+	ChangedAt time.Time `db:"changed_at"`
+}
+
+// UTM - utm-метки, которые дописываются к полному урлу
+type UTM struct {
+	Source   string `json:"source,omitempty" db:"source"`
+	Medium   string `json:"medium,omitempty" db:"medium"`
+	Campaign string `json:"campaign,omitempty" db:"campaign"`
+	Term     string `json:"term,omitempty" db:"term"`
+	Content  string `json:"content,omitempty" db:"content"`
+}
+
+// UTMTemplate - сохраненный набор utm-меток пользователя
+type UTMTemplate struct {
+	UUID string `json:"uuid" db:"uuid"`
+	Name string `json:"name" db:"name"`
+	UTM
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// LinkOptions - необязательные параметры новой ссылки
+type LinkOptions struct {
+	// ExpiresAt после этого времени ссылка не работает. Нулевое - без срока
+	ExpiresAt time.Time
+	// ActiveFrom до этого времени ссылка не работает. Нулевое - сразу
+	ActiveFrom time.Time
+	Title      string
+	Notes      string
+	Tags       []string
+	// Password пароль на переход по ссылке. Пустой - без пароля
+	Password string
+	// MaxClicks сколько переходов разрешено. 0 - без ограничения
+	MaxClicks int64
+	// RedirectCode код редиректа: 301, 302, 307 или 308. 0 - 307
+	RedirectCode int
+	// QueryPassthrough перенос параметров запроса: append или merge
+	QueryPassthrough string
+	// UTM и UTMTemplate utm-метки полного урла: метки из сохраненного
+	// шаблона пользователя, поверх - заданные явно
+	UTM         *UTM
+	UTMTemplate string
+}
+
+// Protected нужен ли пароль для перехода по ссылке
+func (u *URL) Protected() bool {
+	return u.PasswordHash != ""
+}
+
+// Exhausted исчерпан ли лимит переходов
+func (u *URL) Exhausted() bool {
+	return u.MaxClicks > 0 && u.Clicks >= u.MaxClicks
+}
+
+// RemainingClicks сколько переходов осталось. -1 - без ограничения
+func (u *URL) RemainingClicks() int64 {
+	if u.MaxClicks <= 0 {
+		return -1
+	}
+	if u.Exhausted() {
+		return 0
+	}
+	return u.MaxClicks - u.Clicks
+}
+
+// Expired истек ли срок ссылки к моменту now
+func (u *URL) Expired(now time.Time) bool {
+	return u.ExpiresAt.Valid && !u.ExpiresAt.Time.After(now)
+}
+
+// Pending не началось ли еще действие ссылки к моменту now
+func (u *URL) Pending(now time.Time) bool {
+	return u.ActiveFrom.Valid && now.Before(u.ActiveFrom.Time)
+}
+
+// Сортировка ссылок пользователя
+const (
+	SortCreated = "created"
+	SortClicks  = "clicks"
+)
+
+// URLQuery - выборка ссылок пользователя
+type URLQuery struct {
+	UUID string
+	// Sort SortCreated или SortClicks
+	Sort string
+	// Asc по возрастанию. По умолчанию - сначала новые или популярные
+	Asc bool
+	// Deleted nil - все, true - только удаленные, false - без удаленных
+	Deleted *bool
+	// Expired nil - все, true - только истекшие, false - без истекших
+	Expired *bool
+	// Domain хост урла или его поддомен
+	Domain string
+	// Search подстрока урла без учета регистра
+	Search string
+	// Cursor с какого места продолжать. Пусто - с начала
+	Cursor string
+	// Limit размер страницы. 0 - без ограничения
+	Limit int
+	// Now момент, относительно которого ссылка считается истекшей
+	Now time.Time
+}
+
+// URLPage - страница ссылок пользователя
+type URLPage struct {
+	URLs []*URL
+	// Total сколько всего ссылок подходит под фильтры
+	Total int
+	// NextCursor курсор следующей страницы. Пусто - страница последняя
+	NextCursor string
 }
 
 // Statistic - статистика
 type Statistic struct {
-	Urls  int `json:"urls"`
-	Users int `json:"users"`
+	Urls         int     `json:"urls"`
+	Users        int     `json:"users"`
+	OutboxDepth  int     `json:"outbox_depth"`
+	BreakerState string  `json:"breaker_state"`
+	CacheHits    int64   `json:"cache_hits"`
+	CacheMisses  int64   `json:"cache_misses"`
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	// BloomRejected запросы несуществующих ссылок, отсеченные фильтром Блума
+	BloomRejected int64 `json:"bloom_rejected"`
+}
+
+// Health - состояние хранилища
+type Health struct {
+	// OutboxDepth сколько записей ждут восстановления бд
+	OutboxDepth int
+	// BreakerState состояние предохранителя бд
+	BreakerState string
+}
+
+// ImportResult - итог импорта ссылок
+type ImportResult struct {
+	Created   int `json:"created"`
+	Conflicts int `json:"conflicts"`
+	Invalid   int `json:"invalid"`
+	// Errors ошибки в строках. Список ограничен, полное число - в Invalid
+	Errors []ImportError `json:"errors,omitempty"`
+	// Error импорт прерван на этой ошибке хранилища
+	Error string `json:"error,omitempty"`
+}
+
+// RestoreResult - итог восстановления удаленных ссылок
+type RestoreResult struct {
+	Restored []string `json:"restored"`
+	// Expired удалены раньше, чем позволяет срок восстановления
+	Expired []string `json:"expired,omitempty"`
+	// NotFound нет среди удаленных ссылок пользователя
+	NotFound []string `json:"not_found,omitempty"`
+}
+
+// ConsistencyReport - итог сверки слоев хранилища
+type ConsistencyReport struct {
+	// Checked сколько хешей сверено
+	Checked int `json:"checked"`
+	// Missing сколько хешей нет в слое
+	Missing map[string]int `json:"missing"`
+	// Conflicting хеши с разными владельцами или урлами в разных слоях
+	Conflicting int `json:"conflicting"`
+	// Differing хеши, удаленные не во всех слоях
+	Differing int `json:"differing"`
+	// Records расхождения. Список ограничен, полные числа - в счетчиках
+	Records []ConsistencyRecord `json:"records,omitempty"`
+	// Source слой-эталон при исправлении
+	Source string `json:"source,omitempty"`
+	// Repaired сколько хешей исправлено
+	Repaired int `json:"repaired"`
+}
+
+// ConsistencyRecord - расхождение по одному хешу
+type ConsistencyRecord struct {
+	Hash     string                      `json:"hash"`
+	Problems []string                    `json:"problems"`
+	Tiers    map[string]ConsistencyState `json:"tiers"`
+}
+
+// ConsistencyState - ссылка в одном слое
+type ConsistencyState struct {
+	UUID      string `json:"uuid"`
+	URL       string `json:"url"`
+	DeletedAt string `json:"deleted_at,omitempty"`
+}
+
+// ImportError - ошибка в строке импорта
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
 }
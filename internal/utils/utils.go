@@ -3,17 +3,30 @@ package utils
 import (
 	"crypto/md5"
 	"fmt"
-
-	"github.com/nastradamus39/ya_practicum_go_advanced/internal/app"
 )
 
-// GetShortURL создает короткий урл из полного и возвращает хеш
-func GetShortURL(value string) (hash string, shortURL string) {
+// GetShortURL создает короткий урл из полного и возвращает хеш.
+// baseURL - адрес сервиса, к которому добавляется хеш
+func GetShortURL(baseURL string, value string) (hash string, shortURL string) {
+	h := md5.New()
+	h.Write([]byte(value))
+
+	hash = fmt.Sprintf("%x", h.Sum(nil))
+	shortURL = fmt.Sprintf("%s/%x", baseURL, h.Sum(nil))
+
+	return
+}
+
+// GetUserShortURL как GetShortURL, но хеш зависит еще и от владельца uuid:
+// у разных пользователей одинаковый урл получает разные хеши
+func GetUserShortURL(baseURL string, value string, uuid string) (hash string, shortURL string) {
 	h := md5.New()
+	h.Write([]byte(uuid))
+	h.Write([]byte{0})
 	h.Write([]byte(value))
 
 	hash = fmt.Sprintf("%x", h.Sum(nil))
-	shortURL = fmt.Sprintf("%s/%x", app.Cfg.BaseURL, h.Sum(nil))
+	shortURL = fmt.Sprintf("%s/%s", baseURL, hash)
 
 	return
 }
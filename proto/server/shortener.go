@@ -2,11 +2,18 @@ package server
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/types"
 	"log"
+	"time"
 
+	shortenerErrors "github.com/nastradamus39/ya_practicum_go_advanced/internal/errors"
 	"github.com/nastradamus39/ya_practicum_go_advanced/internal/handlers"
 	proto "github.com/nastradamus39/ya_practicum_go_advanced/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // ShortenerServer поддерживает все необходимые методы сервера.
@@ -14,13 +21,20 @@ type ShortenerServer struct {
 	// Нужно встраивать тип pb.Unimplemented<TypeName>
 	// для совместимости с будущими версиями
 	proto.UnimplementedUrlsServer
+
+	svc *handlers.Service
+}
+
+// NewShortenerServer конструктор gRPC сервера поверх сервиса сокращения ссылок
+func NewShortenerServer(svc *handlers.Service) *ShortenerServer {
+	return &ShortenerServer{svc: svc}
 }
 
 // CreateShortURLHandler создает короткий url
 func (s *ShortenerServer) CreateShortURLHandler(ctx context.Context, in *proto.AddUrlRequest) (*proto.AddUrlResponse, error) {
 	var response proto.AddUrlResponse
 
-	url, err := handlers.CreateShortURLHandler(in.Url, in.Uuid)
+	url, err := s.svc.CreateShortURLHandler(ctx, in.Url, in.Uuid)
 
 	if err == nil {
 		response.Url = url.ShortURL
@@ -36,7 +50,7 @@ func (s *ShortenerServer) CreateShortURLHandler(ctx context.Context, in *proto.A
 func (s *ShortenerServer) GetShortURLHandler(ctx context.Context, in *proto.GetUrlRequest) (*proto.GetUrlResponse, error) {
 	var response proto.GetUrlResponse
 
-	url, err := handlers.GetShortURLHandler(in.Hash)
+	url, err := s.svc.GetShortURLHandler(ctx, in.Hash)
 
 	if err == nil {
 		response.Url = url.ShortURL
@@ -50,7 +64,7 @@ func (s *ShortenerServer) GetShortURLHandler(ctx context.Context, in *proto.GetU
 func (s *ShortenerServer) APICreateShortURLHandler(ctx context.Context, in *proto.APICreateShortURLRequest) (*proto.APICreateShortURLResponse, error) {
 	var response proto.APICreateShortURLResponse
 
-	url, err := handlers.GetShortURLHandler(in.OriginalURL)
+	url, err := s.svc.GetShortURLHandler(ctx, in.OriginalURL)
 
 	if err == nil {
 		response.ShortURL = url.ShortURL
@@ -68,7 +82,7 @@ func (s *ShortenerServer) APICreateShortURLBatchHandler(ctx context.Context, in
 	var urls []*types.URL
 
 	for _, url := range in.Urls {
-		u, e := handlers.GetShortURLHandler(url)
+		u, e := s.svc.GetShortURLHandler(ctx, url)
 
 		if e == nil {
 			urls = append(urls, u)
@@ -79,5 +93,123 @@ func (s *ShortenerServer) APICreateShortURLBatchHandler(ctx context.Context, in
 
 	//r, e := handlers.APICreateShortURLBatchHandler(urls)
 
-	return nil, nil
+	return &response, nil
+}
+
+// GetUserURLSHandler страница ссылок пользователя, сначала новые
+func (s *ShortenerServer) GetUserURLSHandler(ctx context.Context, in *proto.GetUserURLSRequest) (*proto.GetUserURLSResponse, error) {
+	if in.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit не может быть отрицательным")
+	}
+
+	q := types.URLQuery{
+		UUID:   in.Uuid,
+		Limit:  int(in.Limit),
+		Cursor: in.Cursor,
+	}
+	if !in.IncludeDeleted {
+		q.Deleted = new(bool)
+	}
+
+	page, err := s.svc.ListUserURLSHandler(ctx, q)
+	if errors.Is(err, shortenerErrors.ErrInvalidCursor) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := proto.GetUserURLSResponse{
+		Total:      int64(page.Total),
+		NextCursor: page.NextCursor,
+	}
+
+	for _, url := range page.URLs {
+		response.Urls = append(response.Urls, newUserURL(url))
+	}
+
+	return &response, nil
+}
+
+// UpdateUserURLHandler меняет адрес, описание, лимит переходов или редирект ссылки пользователя
+func (s *ShortenerServer) UpdateUserURLHandler(ctx context.Context, in *proto.UpdateUserURLRequest) (*proto.UpdateUserURLResponse, error) {
+	update := types.URLUpdate{
+		URL:              in.OriginalUrl,
+		Title:            in.Title,
+		Notes:            in.Notes,
+		MaxClicks:        in.MaxClicks,
+		QueryPassthrough: in.QueryPassthrough,
+	}
+	if in.Tags != nil {
+		update.Tags = &in.Tags.Tags
+	}
+	if in.RedirectCode != nil {
+		code := int(*in.RedirectCode)
+		update.RedirectCode = &code
+	}
+
+	url, err := s.svc.UpdateUserURLHandler(ctx, in.Uuid, in.Hash, update)
+	switch {
+	case errors.Is(err, shortenerErrors.ErrInvalidLink):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, shortenerErrors.ErrURLForbidden):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, shortenerErrors.ErrURLNotFound), errors.Is(err, shortenerErrors.ErrURLDeleted):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &proto.UpdateUserURLResponse{Url: newUserURL(url)}, nil
+}
+
+// RestoreUserURLSHandler восстанавливает удаленные ссылки пользователя
+func (s *ShortenerServer) RestoreUserURLSHandler(ctx context.Context, in *proto.RestoreUserURLSRequest) (*proto.RestoreUserURLSResponse, error) {
+	result, err := s.svc.RestoreUserURLSHandler(ctx, in.Uuid, in.Hashes)
+	if errors.Is(err, shortenerErrors.ErrPendingWrites) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if errors.Is(err, shortenerErrors.ErrCircuitOpen) || errors.Is(err, shortenerErrors.ErrNoDBConnection) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &proto.RestoreUserURLSResponse{
+		Restored: result.Restored,
+		Expired:  result.Expired,
+		NotFound: result.NotFound,
+	}, nil
+}
+
+// newUserURL ссылка пользователя в ответе
+func newUserURL(url *types.URL) *proto.UserURL {
+	return &proto.UserURL{
+		Hash:             url.Hash,
+		ShortUrl:         url.ShortURL,
+		OriginalUrl:      url.URL,
+		Title:            url.Title,
+		Notes:            url.Notes,
+		Tags:             url.Tags,
+		Clicks:           url.Clicks,
+		CreatedAt:        formatTime(url.CreatedAt),
+		UpdatedAt:        formatTime(url.UpdatedAt),
+		DeletedAt:        formatTime(url.DeletedAt),
+		ExpiresAt:        formatTime(url.ExpiresAt),
+		ActiveFrom:       formatTime(url.ActiveFrom),
+		RedirectCode:     int32(url.RedirectCode),
+		QueryPassthrough: url.QueryPassthrough,
+		MaxClicks:        url.MaxClicks,
+		RemainingClicks:  url.RemainingClicks(),
+	}
+}
+
+// formatTime время в RFC3339. Пусто, если времени нет
+func formatTime(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+
+	return t.Time.UTC().Format(time.RFC3339)
 }
@@ -26,6 +26,9 @@ type UrlsClient interface {
 	GetShortURLHandler(ctx context.Context, in *GetUrlRequest, opts ...grpc.CallOption) (*GetUrlResponse, error)
 	APICreateShortURLHandler(ctx context.Context, in *APICreateShortURLRequest, opts ...grpc.CallOption) (*APICreateShortURLResponse, error)
 	APICreateShortURLBatchHandler(ctx context.Context, in *APICreateShortURLBatchRequest, opts ...grpc.CallOption) (*APICreateShortURLBatchResponse, error)
+	GetUserURLSHandler(ctx context.Context, in *GetUserURLSRequest, opts ...grpc.CallOption) (*GetUserURLSResponse, error)
+	UpdateUserURLHandler(ctx context.Context, in *UpdateUserURLRequest, opts ...grpc.CallOption) (*UpdateUserURLResponse, error)
+	RestoreUserURLSHandler(ctx context.Context, in *RestoreUserURLSRequest, opts ...grpc.CallOption) (*RestoreUserURLSResponse, error)
 }
 
 type urlsClient struct {
@@ -72,6 +75,33 @@ func (c *urlsClient) APICreateShortURLBatchHandler(ctx context.Context, in *APIC
 	return out, nil
 }
 
+func (c *urlsClient) GetUserURLSHandler(ctx context.Context, in *GetUserURLSRequest, opts ...grpc.CallOption) (*GetUserURLSResponse, error) {
+	out := new(GetUserURLSResponse)
+	err := c.cc.Invoke(ctx, "/shortener.Urls/GetUserURLSHandler", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlsClient) UpdateUserURLHandler(ctx context.Context, in *UpdateUserURLRequest, opts ...grpc.CallOption) (*UpdateUserURLResponse, error) {
+	out := new(UpdateUserURLResponse)
+	err := c.cc.Invoke(ctx, "/shortener.Urls/UpdateUserURLHandler", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlsClient) RestoreUserURLSHandler(ctx context.Context, in *RestoreUserURLSRequest, opts ...grpc.CallOption) (*RestoreUserURLSResponse, error) {
+	out := new(RestoreUserURLSResponse)
+	err := c.cc.Invoke(ctx, "/shortener.Urls/RestoreUserURLSHandler", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UrlsServer is the server API for Urls service.
 // All implementations must embed UnimplementedUrlsServer
 // for forward compatibility
@@ -80,6 +110,9 @@ type UrlsServer interface {
 	GetShortURLHandler(context.Context, *GetUrlRequest) (*GetUrlResponse, error)
 	APICreateShortURLHandler(context.Context, *APICreateShortURLRequest) (*APICreateShortURLResponse, error)
 	APICreateShortURLBatchHandler(context.Context, *APICreateShortURLBatchRequest) (*APICreateShortURLBatchResponse, error)
+	GetUserURLSHandler(context.Context, *GetUserURLSRequest) (*GetUserURLSResponse, error)
+	UpdateUserURLHandler(context.Context, *UpdateUserURLRequest) (*UpdateUserURLResponse, error)
+	RestoreUserURLSHandler(context.Context, *RestoreUserURLSRequest) (*RestoreUserURLSResponse, error)
 	mustEmbedUnimplementedUrlsServer()
 }
 
@@ -99,6 +132,15 @@ func (UnimplementedUrlsServer) APICreateShortURLHandler(context.Context, *APICre
 func (UnimplementedUrlsServer) APICreateShortURLBatchHandler(context.Context, *APICreateShortURLBatchRequest) (*APICreateShortURLBatchResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method APICreateShortURLBatchHandler not implemented")
 }
+func (UnimplementedUrlsServer) GetUserURLSHandler(context.Context, *GetUserURLSRequest) (*GetUserURLSResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserURLSHandler not implemented")
+}
+func (UnimplementedUrlsServer) UpdateUserURLHandler(context.Context, *UpdateUserURLRequest) (*UpdateUserURLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateUserURLHandler not implemented")
+}
+func (UnimplementedUrlsServer) RestoreUserURLSHandler(context.Context, *RestoreUserURLSRequest) (*RestoreUserURLSResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreUserURLSHandler not implemented")
+}
 func (UnimplementedUrlsServer) mustEmbedUnimplementedUrlsServer() {}
 
 // UnsafeUrlsServer may be embedded to opt out of forward compatibility for this service.
@@ -184,6 +226,60 @@ func _Urls_APICreateShortURLBatchHandler_Handler(srv interface{}, ctx context.Co
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Urls_GetUserURLSHandler_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserURLSRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlsServer).GetUserURLSHandler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.Urls/GetUserURLSHandler",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlsServer).GetUserURLSHandler(ctx, req.(*GetUserURLSRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Urls_UpdateUserURLHandler_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateUserURLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlsServer).UpdateUserURLHandler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.Urls/UpdateUserURLHandler",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlsServer).UpdateUserURLHandler(ctx, req.(*UpdateUserURLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Urls_RestoreUserURLSHandler_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreUserURLSRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlsServer).RestoreUserURLSHandler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.Urls/RestoreUserURLSHandler",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlsServer).RestoreUserURLSHandler(ctx, req.(*RestoreUserURLSRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Urls_ServiceDesc is the grpc.ServiceDesc for Urls service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -207,6 +303,18 @@ var Urls_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "APICreateShortURLBatchHandler",
 			Handler:    _Urls_APICreateShortURLBatchHandler_Handler,
 		},
+		{
+			MethodName: "GetUserURLSHandler",
+			Handler:    _Urls_GetUserURLSHandler_Handler,
+		},
+		{
+			MethodName: "UpdateUserURLHandler",
+			Handler:    _Urls_UpdateUserURLHandler_Handler,
+		},
+		{
+			MethodName: "RestoreUserURLSHandler",
+			Handler:    _Urls_RestoreUserURLSHandler_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "shortener.proto",